@@ -13,6 +13,23 @@ type Config struct {
 	DBName     string
 	RedisHost  string
 	RedisPort  string
+	AdminUsers string
+
+	JWTSecret     string
+	JWTKeys       string
+	JWTSigningKID string
+	JWTIssuer     string
+	JWTAudience   string
+	JWTClockSkew  string
+
+	AccessTokenTTL  string
+	RefreshTokenTTL string
+
+	ReconcileInterval        string
+	CompositeRefreshInterval string
+	PeriodTimezone           string
+	WeekStart                string
+	RatingPeriod             string
 }
 
 func LoadConfig() *Config {
@@ -24,6 +41,23 @@ func LoadConfig() *Config {
 		DBName:     getEnv("DB_NAME", "leaderboard"),
 		RedisHost:  getEnv("REDIS_HOST", "localhost"),
 		RedisPort:  getEnv("REDIS_PORT", "6379"),
+		AdminUsers: getEnv("ADMIN_USERS", ""),
+
+		JWTSecret:     getEnv("JWT_SECRET", ""),
+		JWTKeys:       getEnv("JWT_KEYS", ""),
+		JWTSigningKID: getEnv("JWT_SIGNING_KID", ""),
+		JWTIssuer:     getEnv("JWT_ISSUER", "leaderboard"),
+		JWTAudience:   getEnv("JWT_AUDIENCE", "leaderboard"),
+		JWTClockSkew:  getEnv("JWT_CLOCK_SKEW", "30s"),
+
+		AccessTokenTTL:  getEnv("ACCESS_TOKEN_TTL", "15m"),
+		RefreshTokenTTL: getEnv("REFRESH_TOKEN_TTL", "720h"),
+
+		ReconcileInterval:        getEnv("RECONCILE_INTERVAL", ""),
+		CompositeRefreshInterval: getEnv("COMPOSITE_REFRESH_INTERVAL", "5m"),
+		PeriodTimezone:           getEnv("PERIOD_TIMEZONE", "UTC"),
+		WeekStart:                getEnv("WEEK_START", "monday"),
+		RatingPeriod:             getEnv("RATING_PERIOD", "168h"),
 	}
 }
 
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type scoreResult struct {
+	Value        float64
+	Previous     *float64
+	PreviousBest *float64
+	NewBest      bool
+	Duplicate    bool
+}
+
+func gameBoardKey(gameID string) string {
+	return fmt.Sprintf("leaderboard:%s", gameID)
+}
+
+// boardScriptKeys lists the keys making up a board, in the order the score
+// scripts expect.
+func boardScriptKeys(key string) []string {
+	return []string{
+		key,
+		key + ":best",
+		key + ":recent",
+		boardMembersKey(key),
+		key + ":attempts",
+		boardDistinctKey(key),
+		key + ":applied",
+	}
+}
+
+// scoreScriptArgs are the ARGV of the score scripts. historyID is the
+// submission's row in the Postgres leaderboard table and deliveredBelow a
+// history ID below which every outbox row is marked delivered (0 when
+// unknown), so the board can forget the IDs of those rows.
+func scoreScriptArgs(game models.Game, username string, score int, submittedAt time.Time, historyID, deliveredBelow int64) []interface{} {
+	ascending := 0
+	if game.Ascending() {
+		ascending = 1
+	}
+	return []interface{}{username, score, game.Aggregation, game.AverageWindow, ascending,
+		strings.Join(game.TieBreakers, ","), submittedAt.UnixMilli(), historyID, deliveredBelow}
+}
+
+// applyScore folds a submission into the game's Redis leaderboard atomically,
+// using the game's aggregation policy and tie-breakers. Applying the same
+// historyID again leaves the board unchanged and reports a duplicate.
+func applyScore(game models.Game, username string, score int, submittedAt time.Time, historyID, deliveredBelow int64) (*scoreResult, error) {
+	return applyToBoard(game, gameBoardKey(game.GameID), username, score, submittedAt, historyID, deliveredBelow)
+}
+
+// applyToBoard is applyScore for any board kept under the game's policies,
+// such as a tournament's.
+func applyToBoard(game models.Game, key, username string, score int, submittedAt time.Time, historyID, deliveredBelow int64) (*scoreResult, error) {
+	rebuild := rebuildKeysFor(key)
+	keys := append(boardScriptKeys(key), rebuild.lock)
+	keys = append(keys, boardScriptKeys(rebuild.board)...)
+	args := scoreScriptArgs(game, username, score, submittedAt, historyID, deliveredBelow)
+
+	reply, err := storage.SubmitScoreScript.Run(storage.RedisCtx, storage.RedisClient, keys, args...).Slice()
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 5 {
+		return nil, fmt.Errorf("unexpected script reply: %v", reply)
+	}
+
+	result := &scoreResult{}
+	if result.Value, err = strconv.ParseFloat(reply[0].(string), 64); err != nil {
+		return nil, err
+	}
+	if result.Previous, err = optionalFloat(reply[1]); err != nil {
+		return nil, err
+	}
+	if result.PreviousBest, err = optionalFloat(reply[2]); err != nil {
+		return nil, err
+	}
+	result.NewBest = reply[3].(int64) == 1
+	result.Duplicate = reply[4].(int64) == 1
+	return result, nil
+}
+
+func optionalFloat(v interface{}) (*float64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// historyAggregate returns the SQL expression that folds a player's rows of
+// the history CTE into a single score, mirroring the Redis policy.
+func historyAggregate(game models.Game) string {
+	switch game.Aggregation {
+	case models.AggregationLatest:
+		return "MAX(score) FILTER (WHERE recency = 1)"
+	case models.AggregationSum:
+		return "SUM(score)"
+	case models.AggregationAverage:
+		return fmt.Sprintf("AVG(score) FILTER (WHERE recency <= %d)", game.AverageWindow)
+	default:
+		return bestAggregate(game)
+	}
+}
+
+// bestAggregate is MIN(score) for ascending games and MAX(score) otherwise.
+func bestAggregate(game models.Game) string {
+	if game.Ascending() {
+		return "MIN(score)"
+	}
+	return "MAX(score)"
+}
+
+// sortDirection is the SQL ORDER BY direction that puts the best score first.
+func sortDirection(game models.Game) string {
+	if game.Ascending() {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// aggregateHistoryQuery selects (game_id, username, aggregate_score,
+// reached_at, attempt) from the Postgres history rows of game matching where,
+// whose placeholders must start at $2 ($1 is the game ID). reached_at and
+// attempt describe the submission that produced the aggregate, which is what
+// the Redis tie-breakers key on. Callers append ORDER BY / LIMIT as needed.
+func aggregateHistoryQuery(game models.Game, where string) string {
+	filter := "WHERE game_id = $1"
+	if where != "" {
+		filter += " AND " + where
+	}
+	reached := "h.recency = 1"
+	if game.Aggregation == models.AggregationBest {
+		reached = "h.score = s.aggregate_score"
+	}
+	return fmt.Sprintf(`
+        WITH history AS (
+            SELECT id, game_id, username, score, submitted_at,
+                ROW_NUMBER() OVER (PARTITION BY game_id, username ORDER BY submitted_at DESC, id DESC) AS recency,
+                ROW_NUMBER() OVER (PARTITION BY game_id, username ORDER BY submitted_at, id) AS attempt
+            FROM leaderboard
+            %s
+        ), scored AS (
+            SELECT game_id, username, %s AS aggregate_score
+            FROM history
+            GROUP BY game_id, username
+        )
+        SELECT s.game_id, s.username, s.aggregate_score, reached.submitted_at AS reached_at, reached.attempt
+        FROM scored s
+        JOIN LATERAL (
+            SELECT h.submitted_at, h.attempt
+            FROM history h
+            WHERE h.game_id = s.game_id AND h.username = s.username AND %s
+            ORDER BY h.submitted_at, h.id
+            LIMIT 1
+        ) reached ON true`, filter, historyAggregate(game), reached)
+}
+
+// rankingOrder is the ORDER BY list for aggregateHistoryQuery rows that
+// matches the Redis board order, tie-breakers included.
+func rankingOrder(game models.Game) string {
+	direction := sortDirection(game)
+	order := []string{"aggregate_score " + direction}
+	for _, key := range game.TieBreakers {
+		switch key {
+		case models.TieBreakEarliest:
+			order = append(order, "reached_at ASC")
+		case models.TieBreakAttempts:
+			order = append(order, "attempt ASC")
+		}
+	}
+	// Redis orders members with equal scores and tie keys by name.
+	order = append(order, "username "+direction)
+	return strings.Join(order, ", ")
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyScoreOutOfOrder(t *testing.T) {
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name        string
+		aggregation string
+		tieBreakers []string
+		want        float64
+	}{
+		{"latest", models.AggregationLatest, []string{}, 200},
+		{"latest with tie-breakers", models.AggregationLatest, []string{models.TieBreakEarliest}, 200},
+		{"average", models.AggregationAverage, []string{}, 150},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRedis(t)
+			game := models.Game{
+				GameID:        "g",
+				Aggregation:   tt.aggregation,
+				AverageWindow: 2,
+				SortOrder:     models.SortDescending,
+				TieBreakers:   tt.tieBreakers,
+			}
+
+			// Row 2 (newer) is delivered before row 1, which was in backoff.
+			if _, err := applyScore(game, "alice", 200, base.Add(time.Minute), 2, 0); err != nil {
+				t.Fatal(err)
+			}
+			got, err := applyScore(game, "alice", 100, base, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Value != tt.want {
+				t.Errorf("value after late delivery = %v, want %v", got.Value, tt.want)
+			}
+
+			_, score, err := boardPosition(game, gameBoardKey(game.GameID), "alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if score != tt.want {
+				t.Errorf("board score = %v, want %v", score, tt.want)
+			}
+
+			// A newer submission still replaces the older ones.
+			got, err = applyScore(game, "alice", 300, base.Add(2*time.Minute), 3, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := 300.0
+			if tt.aggregation == models.AggregationAverage {
+				want = 250
+			}
+			if got.Value != want {
+				t.Errorf("value after newer submission = %v, want %v", got.Value, want)
+			}
+		})
+	}
+}
+
+func TestApplyScoreRedeliveredAfterADay(t *testing.T) {
+	mr := useTestRedis(t)
+	game := models.Game{
+		GameID:      "g",
+		Aggregation: models.AggregationSum,
+		SortOrder:   models.SortDescending,
+		TieBreakers: []string{},
+	}
+	// The row was submitted two days ago and is still pending in the outbox.
+	submittedAt := time.Now().Add(-48 * time.Hour)
+	if _, err := applyScore(game, "alice", 100, submittedAt, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A day later, marking it delivered still has not succeeded.
+	mr.SetTime(time.Now().Add(25 * time.Hour))
+	if _, err := applyScore(game, "alice", 50, time.Now(), 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := applyScore(game, "alice", 100, submittedAt, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Duplicate || got.Value != 150 {
+		t.Errorf("redelivery = %+v, want duplicate with value 150", got)
+	}
+
+	// Once the row is marked delivered its ID is forgotten.
+	if _, err := applyScore(game, "bob", 10, time.Now(), 3, 3); err != nil {
+		t.Fatal(err)
+	}
+	applied := gameBoardKey(game.GameID) + ":applied"
+	if _, err := storage.RedisClient.ZScore(storage.RedisCtx, applied, "1").Result(); err != redis.Nil {
+		t.Errorf("history ID 1 still recorded: %v", err)
+	}
+	if _, err := storage.RedisClient.ZScore(storage.RedisCtx, applied, "2").Result(); err != nil {
+		t.Errorf("history ID 2 applied within the day was forgotten: %v", err)
+	}
+}
+
+// On an ascending board the lowest score is the best one and ranks first.
+func TestApplyScoreAscending(t *testing.T) {
+	useTestRedis(t)
+	game := models.Game{
+		GameID:        "speedrun",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortAscending,
+		TieBreakers:   []string{},
+	}
+	now := time.Now()
+	submissions := []struct {
+		username string
+		score    int
+		newBest  bool
+		want     float64
+	}{
+		{"alice", 95, true, 95},
+		{"bob", 80, true, 80},
+		{"alice", 120, false, 95},
+		{"alice", 70, true, 70},
+		{"carol", 110, true, 110},
+	}
+	for i, s := range submissions {
+		got, err := applyScore(game, s.username, s.score, now.Add(time.Duration(i)*time.Second), int64(i+1), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Value != s.want || got.NewBest != s.newBest {
+			t.Errorf("%s submits %d: value %v, new best %v; want %v, %v",
+				s.username, s.score, got.Value, got.NewBest, s.want, s.newBest)
+		}
+	}
+
+	entries, err := rangeBoard(game, gameBoardKey(game.GameID), 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, e := range entries {
+		order = append(order, e.Username)
+	}
+	if got := strings.Join(order, ","); got != "alice,bob,carol" {
+		t.Errorf("board order = %s, want alice,bob,carol", got)
+	}
+}
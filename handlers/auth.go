@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"Leaderboard/config"
+	"Leaderboard/models"
+	"context"
+	"errors"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthPolicy is what a route requires of the caller's bearer token.
+type AuthPolicy struct {
+	// Required rejects requests without a token.
+	Required bool
+	// Role, when set, also requires the caller to hold it.
+	Role string
+}
+
+var (
+	// AuthOptional validates a token when one is sent, so handlers can
+	// tell guests from players.
+	AuthOptional = AuthPolicy{}
+	// AuthRequired rejects requests without a valid token.
+	AuthRequired = AuthPolicy{Required: true}
+	// AuthAdmin only admits users listed in ADMIN_USERS.
+	AuthAdmin = AuthPolicy{Required: true, Role: models.RoleAdmin}
+)
+
+type claimsKey struct{}
+
+var errNoToken = errors.New("no bearer token")
+
+// jwtParser only accepts the algorithms of the configured keys (see
+// verificationKey) and checks issuer, audience and expiry with the
+// configured clock skew.
+var jwtParser = sync.OnceValue(func() *jwt.Parser {
+	cfg := config.LoadConfig()
+	return jwt.NewParser(
+		jwt.WithValidMethods([]string{
+			jwt.SigningMethodHS256.Alg(),
+			jwt.SigningMethodRS256.Alg(),
+			jwt.SigningMethodEdDSA.Alg(),
+		}),
+		jwt.WithIssuer(cfg.JWTIssuer),
+		jwt.WithAudience(cfg.JWTAudience),
+		jwt.WithLeeway(clockSkew()),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+})
+
+// clockSkew is the leeway allowed on token times, JWT_CLOCK_SKEW.
+func clockSkew() time.Duration {
+	skew, err := time.ParseDuration(config.LoadConfig().JWTClockSkew)
+	if err != nil || skew < 0 {
+		return 30 * time.Second
+	}
+	return skew
+}
+
+// bearerToken reads the token from the Authorization header. Browsers
+// cannot set headers on WebSocket handshakes, so those may pass it as the
+// token query parameter instead.
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("token")
+	}
+	return ""
+}
+
+// parseToken validates a bearer token and returns its claims. Revoked
+// tokens are rejected.
+func parseToken(tokenString string) (*models.Claims, error) {
+	claims := &models.Claims{}
+	token, err := jwtParser().ParseWithClaims(tokenString, claims, verificationKey)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Username == "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+	revoked, err := tokenRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errTokenRevoked
+	}
+	return claims, nil
+}
+
+// authenticate returns the caller's claims, reusing those the middleware put
+// in the request context.
+func authenticate(r *http.Request) (*models.Claims, error) {
+	if claims, ok := ClaimsFromContext(r.Context()); ok {
+		return claims, nil
+	}
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		return nil, errNoToken
+	}
+	return parseToken(tokenString)
+}
+
+// ClaimsFromContext returns the claims of the authenticated caller, if any.
+func ClaimsFromContext(ctx context.Context) (*models.Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*models.Claims)
+	return claims, ok
+}
+
+// hasRole reports whether username holds role. Admins are read from
+// ADMIN_USERS on every request, so removing one takes effect immediately.
+func hasRole(username, role string) bool {
+	if role != models.RoleAdmin || username == "" {
+		return false
+	}
+	for _, admin := range strings.Split(config.LoadConfig().AdminUsers, ",") {
+		if strings.TrimSpace(admin) == username {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAuth validates the caller's token under policy and puts the claims in
+// the request context. A token that is sent but invalid is always rejected,
+// even on optional routes.
+func WithAuth(policy AuthPolicy, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := authenticate(r)
+		if err == errNoToken {
+			if policy.Required {
+				http.Error(w, "Authorization required", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, "Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		if policy.Role != "" && !hasRole(claims.Username, policy.Role) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	}
+}
+
+// requireUser returns the caller's claims, writing a 401 response when the
+// token is missing or invalid.
+func requireUser(w http.ResponseWriter, r *http.Request) (*models.Claims, bool) {
+	claims, err := authenticate(r)
+	if err == errNoToken {
+		http.Error(w, "Authorization required", http.StatusUnauthorized)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return claims, true
+}
+
+// requireAdmin checks the caller is listed in ADMIN_USERS, writing a 401 or
+// 403 response otherwise.
+func requireAdmin(w http.ResponseWriter, r *http.Request) (*models.Claims, bool) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !hasRole(claims.Username, models.RoleAdmin) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+// issueToken signs an access token of the login session family for user,
+// valid for ttl.
+func issueToken(user models.User, family string, ttl time.Duration) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	cfg := config.LoadConfig()
+	now := time.Now()
+	claims := &models.Claims{
+		UserID:   user.UserId,
+		Username: user.Username,
+		Family:   family,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    cfg.JWTIssuer,
+			Subject:   user.Username,
+			Audience:  jwt.ClaimStrings{cfg.JWTAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return signToken(claims)
+}
@@ -5,10 +5,9 @@ import (
 	"Leaderboard/storage"
 	"database/sql"
 	"encoding/json"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
-	"time"
+	"strings"
 )
 
 func RegistrationDB(w http.ResponseWriter, r *http.Request) {
@@ -25,13 +24,28 @@ func RegistrationDB(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 		return
 	}
+	// '#' separates the tie key from the username in board members.
+	if strings.ContainsRune(req.Username, '#') {
+		http.Error(w, "Invalid username. It may not contain #", http.StatusBadRequest)
+		return
+	}
+	country, err := normalizeCountry(req.Country)
+	if err != nil {
+		http.Error(w, "Invalid country. Use an ISO 3166-1 alpha-2 code such as DE", http.StatusBadRequest)
+		return
+	}
+	region, err := normalizeRegion(req.Region)
+	if err != nil {
+		http.Error(w, "Invalid region. Use 1-64 characters: a-z, 0-9, _ or -", http.StatusBadRequest)
+		return
+	}
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.PasswordHash), bcrypt.DefaultCost)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	query := "INSERT INTO users (username, password_hash) VALUES ($1, $2)"
-	_, err = storage.DB.Exec(query, req.Username, string(hashedPassword))
+	query := "INSERT INTO users (username, password_hash, country, region) VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''))"
+	_, err = storage.DB.Exec(query, req.Username, string(hashedPassword), country, region)
 	if err != nil {
 		http.Error(w, "Username already exists", http.StatusConflict)
 		return
@@ -63,21 +77,13 @@ func LoginDB(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.PasswordHash)); err != nil {
 		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
 	}
-	expTime := time.Now().Add(365 * 24 * time.Hour)
-	claims := &models.Claims{
-		UserID:   user.UserId,
-		Username: user.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expTime),
-		},
-	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(models.JwtKey)
+	pair, err := startSession(user)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
+	json.NewEncoder(w).Encode(pair)
 }
@@ -0,0 +1,163 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// useTestKeys signs tokens with an HS256 key for the duration of the test and
+// marks the revocation cache loaded, so tokens are checked against Redis only.
+func useTestKeys(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := useTestRedis(t)
+	key, err := secretKey(defaultSecretKID, []byte(testSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := signingKeys
+	signingKeys = &keyRing{keys: map[string]*signingKey{key.kid: key}, signer: key}
+	t.Cleanup(func() { signingKeys = previous })
+	if err := storage.RedisClient.Set(storage.RedisCtx, revocationsLoadedKey, 1, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+	return mr
+}
+
+// testClaims are valid claims for username, changed by edit.
+func testClaims(username string, edit func(*models.Claims)) *models.Claims {
+	now := time.Now()
+	claims := &models.Claims{
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        username + "-jti",
+			Issuer:    "leaderboard",
+			Subject:   username,
+			Audience:  jwt.ClaimStrings{"leaderboard"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	return claims
+}
+
+// signTestToken signs claims with method and key under kid.
+func signTestToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.Claims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestWithAuth(t *testing.T) {
+	useTestKeys(t)
+	t.Setenv("ADMIN_USERS", "root")
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte(testSecret)
+	hs256 := func(claims *models.Claims) string {
+		return signTestToken(t, jwt.SigningMethodHS256, secret, defaultSecretKID, claims)
+	}
+	expiredBy := func(d time.Duration) func(*models.Claims) {
+		return func(c *models.Claims) {
+			c.IssuedAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+			c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-d))
+		}
+	}
+
+	tests := []struct {
+		name   string
+		policy AuthPolicy
+		token  string
+		want   int
+	}{
+		{"valid", AuthRequired, hs256(testClaims("alice", nil)), http.StatusOK},
+		{"missing on optional", AuthOptional, "", http.StatusOK},
+		{"missing on required", AuthRequired, "", http.StatusUnauthorized},
+		{"invalid on optional", AuthOptional, "not-a-token", http.StatusUnauthorized},
+		{"alg none", AuthRequired,
+			signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, defaultSecretKID, testClaims("alice", nil)),
+			http.StatusUnauthorized},
+		{"alg HS384", AuthRequired,
+			signTestToken(t, jwt.SigningMethodHS384, secret, defaultSecretKID, testClaims("alice", nil)),
+			http.StatusUnauthorized},
+		{"alg RS256 for an HS256 kid", AuthRequired,
+			signTestToken(t, jwt.SigningMethodRS256, rsaKey, defaultSecretKID, testClaims("alice", nil)),
+			http.StatusUnauthorized},
+		{"unknown kid", AuthRequired,
+			signTestToken(t, jwt.SigningMethodHS256, secret, "retired", testClaims("alice", nil)),
+			http.StatusUnauthorized},
+		{"wrong issuer", AuthRequired,
+			hs256(testClaims("alice", func(c *models.Claims) { c.Issuer = "someone-else" })),
+			http.StatusUnauthorized},
+		{"wrong audience", AuthRequired,
+			hs256(testClaims("alice", func(c *models.Claims) { c.Audience = jwt.ClaimStrings{"game-server"} })),
+			http.StatusUnauthorized},
+		{"expired within leeway", AuthRequired, hs256(testClaims("alice", expiredBy(10*time.Second))), http.StatusOK},
+		{"expired beyond leeway", AuthRequired, hs256(testClaims("alice", expiredBy(time.Minute))), http.StatusUnauthorized},
+		{"no expiry", AuthRequired,
+			hs256(testClaims("alice", func(c *models.Claims) { c.ExpiresAt = nil })),
+			http.StatusUnauthorized},
+		{"no username", AuthRequired, hs256(testClaims("", nil)), http.StatusUnauthorized},
+		{"non-admin on admin", AuthAdmin, hs256(testClaims("alice", nil)), http.StatusForbidden},
+		{"admin on admin", AuthAdmin, hs256(testClaims("root", nil)), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen *models.Claims
+			handler := WithAuth(tt.policy, func(w http.ResponseWriter, r *http.Request) {
+				seen, _ = ClaimsFromContext(r.Context())
+			})
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.want, w.Body.String())
+			}
+			if tt.want == http.StatusOK && tt.token != "" && seen == nil {
+				t.Error("claims missing from the request context")
+			}
+		})
+	}
+}
+
+func TestWithAuthRevoked(t *testing.T) {
+	useTestKeys(t)
+	claims := testClaims("alice", func(c *models.Claims) { c.Family = "session" })
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte(testSecret), defaultSecretKID, claims)
+	if err := storage.RedisClient.Set(storage.RedisCtx, revocationKey(revokeFamily, "session"), 1, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := WithAuth(AuthRequired, func(w http.ResponseWriter, r *http.Request) {})
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
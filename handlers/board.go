@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// boardMembersKey is the hash mapping usernames to their tie-encoded member
+// in the board's sorted set.
+func boardMembersKey(key string) string {
+	return key + ":members"
+}
+
+// boardUsername strips the tie key prefix SubmitScoreScript writes on the
+// boards of games with tie-breakers. Members of other boards are plain names.
+func boardUsername(game models.Game, member string) string {
+	if len(game.TieBreakers) == 0 {
+		return member
+	}
+	i := strings.IndexByte(member, '#')
+	if i <= 0 {
+		return member
+	}
+	for _, c := range member[:i] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return member
+		}
+	}
+	return member[i+1:]
+}
+
+// boardMember resolves username to the member stored in the sorted set,
+// falling back to the plain username for boards without tie-breakers.
+func boardMember(key, username string) (string, error) {
+	member, err := storage.RedisClient.HGet(storage.RedisCtx, boardMembersKey(key), username).Result()
+	if err == redis.Nil {
+		return username, nil
+	}
+	return member, err
+}
+
+// rangeMembers returns positions start..stop (0-based, inclusive) of a
+// sorted set with their raw members, best first according to the game's sort
+// order.
+func rangeMembers(game models.Game, key string, start, stop int64) ([]redis.Z, error) {
+	query := storage.RedisClient.ZRevRangeWithScores
+	if game.Ascending() {
+		query = storage.RedisClient.ZRangeWithScores
+	}
+	return query(storage.RedisCtx, key, start, stop).Result()
+}
+
+// boardEntries converts members returned by rangeMembers, the first of which
+// sits at 0-based position start.
+func boardEntries(game models.Game, results []redis.Z, start int64) []models.LeaderboardEntry {
+	var leaderboard []models.LeaderboardEntry
+	for i, result := range results {
+		leaderboard = append(leaderboard, models.LeaderboardEntry{
+			Username: boardUsername(game, result.Member.(string)),
+			Score:    result.Score,
+			Rank:     start + int64(i) + 1,
+		})
+	}
+	return leaderboard
+}
+
+// rangeBoard returns positions start..stop (0-based, inclusive) of a sorted
+// set, best first according to the game's sort order.
+func rangeBoard(game models.Game, key string, start, stop int64) ([]models.LeaderboardEntry, error) {
+	results, err := rangeMembers(game, key, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	return boardEntries(game, results, start), nil
+}
+
+// boardPosition returns the 0-based position and score of username in the
+// game's order. It returns redis.Nil when the user is not on the board.
+func boardPosition(game models.Game, key, username string) (int64, float64, error) {
+	member, err := boardMember(key, username)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rank *redis.IntCmd
+	var score *redis.FloatCmd
+	_, err = storage.RedisClient.Pipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		if game.Ascending() {
+			rank = pipe.ZRank(storage.RedisCtx, key, member)
+		} else {
+			rank = pipe.ZRevRank(storage.RedisCtx, key, member)
+		}
+		score = pipe.ZScore(storage.RedisCtx, key, member)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return rank.Val(), score.Val(), nil
+}
+
+// boardDistinctKey is the sorted set of distinct scores on the board.
+func boardDistinctKey(key string) string {
+	return key + ":distinct"
+}
+
+// parseRankMode reads the rank_mode query parameter, defaulting to ordinal.
+func parseRankMode(r *http.Request) (string, bool) {
+	mode := r.URL.Query().Get("rank_mode")
+	if mode == "" {
+		return models.RankOrdinal, true
+	}
+	for _, m := range models.RankModes {
+		if m == mode {
+			return mode, true
+		}
+	}
+	return "", false
+}
+
+// scoreRank returns the rank of a member at 0-based position with the given
+// score under mode. Standard and dense ranks count strictly better scores,
+// so both stay O(log N).
+func scoreRank(game models.Game, key, mode string, position int64, score float64) (int64, error) {
+	countKey := key
+	switch mode {
+	case models.RankStandard:
+	case models.RankDense:
+		countKey = boardDistinctKey(key)
+		err := storage.RebuildDistinctScoresScript.Run(storage.RedisCtx, storage.RedisClient,
+			[]string{key, countKey}).Err()
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return position + 1, nil
+	}
+
+	from, to := betterScores(game, score)
+	better, err := storage.RedisClient.ZCount(storage.RedisCtx, countKey, from, to).Result()
+	if err != nil {
+		return 0, err
+	}
+	return better + 1, nil
+}
+
+// betterScores is the ZCOUNT range of the scores that rank above score.
+func betterScores(game models.Game, score float64) (string, string) {
+	if game.Ascending() {
+		return "-inf", "(" + strconv.FormatFloat(score, 'f', -1, 64)
+	}
+	return "(" + strconv.FormatFloat(score, 'f', -1, 64), "+inf"
+}
+
+// assignRanks sets Rank on consecutive entries, the first of which sits at
+// 0-based position start and has rank first.
+func assignRanks(entries []models.LeaderboardEntry, mode string, start, first int64) {
+	for i := range entries {
+		switch {
+		case i == 0:
+			entries[i].Rank = first
+		case mode != models.RankOrdinal && entries[i].Score == entries[i-1].Score:
+			entries[i].Rank = entries[i-1].Rank
+		case mode == models.RankDense:
+			entries[i].Rank = entries[i-1].Rank + 1
+		default:
+			entries[i].Rank = start + int64(i) + 1
+		}
+	}
+}
+
+// rankBoard re-ranks a page returned by rangeBoard under mode.
+func rankBoard(game models.Game, key, mode string, entries []models.LeaderboardEntry) error {
+	if len(entries) == 0 || mode == models.RankOrdinal {
+		return nil
+	}
+	start := entries[0].Rank - 1
+	first, err := scoreRank(game, key, mode, start, entries[0].Score)
+	if err != nil {
+		return err
+	}
+	assignRanks(entries, mode, start, first)
+	return nil
+}
+
+// aroundBoard returns the window of up to 2n+1 entries centred on username
+// on a board of total players, ranked under mode. Near the top or
+// bottom of the board the window is shifted so it stays full. It returns
+// redis.Nil when the user is not on the board.
+func aroundBoard(game models.Game, key, mode, username string, n, total int64) ([]models.LeaderboardEntry, error) {
+	position, _, err := boardPosition(game, key, username)
+	if err != nil {
+		return nil, err
+	}
+
+	start, stop := position-n, position+n
+	if start < 0 {
+		stop -= start
+		start = 0
+	}
+	if stop > total-1 {
+		start -= stop - (total - 1)
+		stop = total - 1
+		if start < 0 {
+			start = 0
+		}
+	}
+
+	entries, err := rangeBoard(game, key, start, stop)
+	if err != nil {
+		return nil, err
+	}
+	if err := rankBoard(game, key, mode, entries); err != nil {
+		return nil, err
+	}
+	if err := placeEntries(game, key, entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useTestRedis points storage.RedisClient at an in-memory Redis for the
+// duration of the test.
+func useTestRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	previous := storage.RedisClient
+	storage.RedisClient = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		storage.RedisClient.Close()
+		storage.RedisClient = previous
+	})
+	return mr
+}
+
+func TestAssignRanks(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		scores []float64
+		start  int64
+		first  int64
+		want   []int64
+	}{
+		{"ordinal", models.RankOrdinal, []float64{100, 90, 90, 80}, 0, 1, []int64{1, 2, 3, 4}},
+		{"standard", models.RankStandard, []float64{100, 90, 90, 80}, 0, 1, []int64{1, 2, 2, 4}},
+		{"dense", models.RankDense, []float64{100, 90, 90, 80}, 0, 1, []int64{1, 2, 2, 3}},
+		{"ordinal all tied", models.RankOrdinal, []float64{50, 50, 50}, 0, 1, []int64{1, 2, 3}},
+		{"standard all tied", models.RankStandard, []float64{50, 50, 50}, 0, 1, []int64{1, 1, 1}},
+		{"dense all tied", models.RankDense, []float64{50, 50, 50}, 0, 1, []int64{1, 1, 1}},
+		// A page starting at position 2 inside the tie at 90 of 100, 90, 90,
+		// 90, 80: first comes from scoreRank.
+		{"ordinal page inside tie", models.RankOrdinal, []float64{90, 90, 80}, 2, 3, []int64{3, 4, 5}},
+		{"standard page inside tie", models.RankStandard, []float64{90, 90, 80}, 2, 2, []int64{2, 2, 5}},
+		{"dense page inside tie", models.RankDense, []float64{90, 90, 80}, 2, 2, []int64{2, 2, 3}},
+		{"standard ascending", models.RankStandard, []float64{10, 12, 12, 12, 15}, 0, 1, []int64{1, 2, 2, 2, 5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := make([]models.LeaderboardEntry, len(tt.scores))
+			for i, score := range tt.scores {
+				entries[i].Score = score
+			}
+			assignRanks(entries, tt.mode, tt.start, tt.first)
+
+			got := make([]int64, len(entries))
+			for i, e := range entries {
+				got[i] = e.Rank
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankBoardPages(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []int64
+	}{
+		{models.RankOrdinal, []int64{3, 4, 5}},
+		{models.RankStandard, []int64{2, 2, 5}},
+		{models.RankDense, []int64{2, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			useTestRedis(t)
+			game := models.Game{
+				GameID:        "g",
+				Aggregation:   models.AggregationBest,
+				AverageWindow: models.DefaultAverageWindow,
+				SortOrder:     models.SortDescending,
+				TieBreakers:   []string{},
+			}
+			scores := map[string]int{"alice": 100, "bob": 90, "carol": 90, "dave": 90, "erin": 80}
+			var historyID int64
+			for username, score := range scores {
+				historyID++
+				if _, err := applyScore(game, username, score, time.Now(), historyID, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			key := gameBoardKey(game.GameID)
+			entries, err := rangeBoard(game, key, 2, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rankBoard(game, key, tt.mode, entries); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int64, len(entries))
+			for i, e := range entries {
+				got[i] = e.Rank
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoardUsername(t *testing.T) {
+	tied := models.Game{TieBreakers: []string{models.TieBreakEarliest}}
+	untied := models.Game{TieBreakers: []string{}}
+	tests := []struct {
+		name   string
+		game   models.Game
+		member string
+		want   string
+	}{
+		{"tie prefix", tied, "00000001#alice", "alice"},
+		{"no prefix", tied, "alice", "alice"},
+		{"not hex", tied, "xyz#alice", "xyz#alice"},
+		{"untied board", untied, "dead#beef", "dead#beef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := boardUsername(tt.game, tt.member); got != tt.want {
+				t.Errorf("boardUsername(%q) = %q, want %q", tt.member, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCursorOffsetAmongTies(t *testing.T) {
+	useTestRedis(t)
+	key := "board:test"
+	members := []redis.Z{{Score: 10, Member: "a"}, {Score: 30, Member: "z"}}
+	for _, m := range []string{"b", "d", "f", "h", "j", "l", "n"} {
+		members = append(members, redis.Z{Score: 20, Member: m})
+	}
+	if err := storage.RedisClient.ZAdd(storage.RedisCtx, key, members...).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, order := range []string{models.SortAscending, models.SortDescending} {
+		game := models.Game{GameID: "g", SortOrder: order}
+		for _, member := range []string{"a", "b", "c", "h", "i", "n", "o"} {
+			// Count the entries sorting before (20, member) one by one.
+			var want int64
+			for _, z := range members {
+				m := z.Member.(string)
+				switch {
+				case z.Score != 20:
+					if (z.Score < 20) == game.Ascending() {
+						want++
+					}
+				case game.Ascending() && m < member, !game.Ascending() && m > member:
+					want++
+				}
+			}
+			present := int64(0)
+			if member != "a" && member != "c" && member != "i" && member != "o" {
+				present = 1
+			}
+			got, err := cursorOffset(game, key, pageCursor{Score: 20, Member: member}, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want+present {
+				t.Errorf("%s cursor at %q: offset = %d, want %d", order, member, got, want+present)
+			}
+		}
+	}
+}
@@ -0,0 +1,612 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errCompositeNotFound       = errors.New("composite board not found")
+	errCompositeRefreshRunning = errors.New("composite refresh already running")
+)
+
+var compositeCache struct {
+	sync.RWMutex
+	boards   map[string]models.CompositeBoard
+	loadedAt time.Time
+}
+
+const compositeColumns = "board_id, name, method, games, rank_points_depth, created_at"
+
+func scanComposite(row rowScanner) (models.CompositeBoard, error) {
+	var board models.CompositeBoard
+	var games []byte
+	err := row.Scan(&board.BoardID, &board.Name, &board.Method, &games, &board.RankPointsDepth, &board.CreatedAt)
+	if err != nil {
+		return board, err
+	}
+	return board, json.Unmarshal(games, &board.Games)
+}
+
+func loadComposites() (map[string]models.CompositeBoard, error) {
+	rows, err := storage.DB.Query("SELECT " + compositeColumns + " FROM composite_boards")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	boards := make(map[string]models.CompositeBoard)
+	for rows.Next() {
+		board, err := scanComposite(rows)
+		if err != nil {
+			return nil, err
+		}
+		boards[board.BoardID] = board
+	}
+	return boards, rows.Err()
+}
+
+func invalidateCompositeCache() {
+	compositeCache.Lock()
+	compositeCache.boards = nil
+	compositeCache.Unlock()
+}
+
+// composites returns every composite board, cached like the game registry.
+func composites() (map[string]models.CompositeBoard, error) {
+	compositeCache.RLock()
+	boards, fresh := compositeCache.boards, time.Since(compositeCache.loadedAt) < gameCacheTTL
+	compositeCache.RUnlock()
+
+	if boards != nil && fresh {
+		return boards, nil
+	}
+	loaded, err := loadComposites()
+	if err != nil {
+		return nil, err
+	}
+	compositeCache.Lock()
+	compositeCache.boards, compositeCache.loadedAt = loaded, time.Now()
+	compositeCache.Unlock()
+	return loaded, nil
+}
+
+func lookupComposite(boardID string) (models.CompositeBoard, error) {
+	boards, err := composites()
+	if err != nil {
+		return models.CompositeBoard{}, err
+	}
+	board, ok := boards[boardID]
+	if !ok {
+		return models.CompositeBoard{}, errCompositeNotFound
+	}
+	return board, nil
+}
+
+// compositeKeys name a composite board's Redis keys under base: the sorted
+// set itself, per-game z-score statistics, one hash per game holding each
+// player's contribution from that game and the lock held while the board is
+// recomputed.
+type compositeKeys struct {
+	board string
+	stats string
+	lock  string
+}
+
+func compositeKeysFor(base string) compositeKeys {
+	return compositeKeys{board: base, stats: base + ":stats", lock: base + ":refresh:lock"}
+}
+
+// refreshed names the keys a refresh recomputes the board into.
+func (k compositeKeys) refreshed() compositeKeys {
+	return compositeKeysFor(k.board + ":refresh")
+}
+
+func (k compositeKeys) contributions(gameID string) string {
+	return k.board + ":contrib:" + gameID
+}
+
+func compositeBoardKey(boardID string) string {
+	return "composite:" + boardID
+}
+
+// compositeGame is the pseudo game used to page and rank a composite board
+// with the game board helpers. Composite scores are always higher-is-better.
+func compositeGame(board models.CompositeBoard) models.Game {
+	return models.Game{GameID: compositeBoardKey(board.BoardID), SortOrder: models.SortDescending}
+}
+
+// gameStatistics is the mean and population standard deviation of a game's
+// leaderboard scores, as of the last refresh.
+type gameStatistics struct {
+	mean, std float64
+}
+
+// contribution is what a leaderboard score in game adds to a weighted or
+// z-score composite.
+func contribution(board models.CompositeBoard, cg models.CompositeGame, game models.Game, score float64, stats gameStatistics) float64 {
+	sign := 1.0
+	if game.Ascending() {
+		sign = -1
+	}
+	switch board.Method {
+	case models.CompositeZScore:
+		if stats.std == 0 {
+			return 0
+		}
+		return sign * cg.Weight * (score - stats.mean) / stats.std
+	default:
+		return sign * cg.Weight * score
+	}
+}
+
+func loadStatistics(keys compositeKeys, gameID string) (gameStatistics, error) {
+	values, err := storage.RedisClient.HMGet(storage.RedisCtx, keys.stats, gameID+":mean", gameID+":std").Result()
+	if err != nil {
+		return gameStatistics{}, err
+	}
+	var stats gameStatistics
+	if v, ok := values[0].(string); ok {
+		stats.mean, _ = strconv.ParseFloat(v, 64)
+	}
+	if v, ok := values[1].(string); ok {
+		stats.std, _ = strconv.ParseFloat(v, 64)
+	}
+	return stats, nil
+}
+
+// contributionKeys are the keys SetContributionScript takes for a game's
+// contributions to the board at keys.
+func contributionKeys(keys compositeKeys, gameID string) []string {
+	next := keys.refreshed()
+	return []string{keys.board, keys.contributions(gameID), keys.lock, next.board, next.contributions(gameID)}
+}
+
+func setContribution(keys compositeKeys, gameID, username string, value float64) error {
+	return storage.SetContributionScript.Run(storage.RedisCtx, storage.RedisClient,
+		contributionKeys(keys, gameID), username, value).Err()
+}
+
+// compositeScriptArgs describe a game of a composite board to the scripts
+// reading its game board.
+func compositeScriptArgs(game models.Game) (ascending, tied int) {
+	if game.Ascending() {
+		ascending = 1
+	}
+	if len(game.TieBreakers) > 0 {
+		tied = 1
+	}
+	return ascending, tied
+}
+
+// updateComposites folds a player's new leaderboard score in game into every
+// composite board that includes the game. Rank points also move the players
+// the submission pushed down the game's top ranks.
+func updateComposites(game models.Game, username string, score float64) error {
+	boards, err := composites()
+	if err != nil {
+		return err
+	}
+
+	for _, board := range boards {
+		for _, cg := range board.Games {
+			if cg.GameID != game.GameID {
+				continue
+			}
+			keys := compositeKeysFor(compositeBoardKey(board.BoardID))
+
+			if board.Method == models.CompositeRankPoints {
+				if err := updateRankPoints(board, cg, game, keys); err != nil {
+					return err
+				}
+				continue
+			}
+
+			stats, err := loadStatistics(keys, game.GameID)
+			if err != nil {
+				return err
+			}
+			if err := setContribution(keys, game.GameID, username, contribution(board, cg, game, score, stats)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateRankPoints recomputes the points of a game's current top players and
+// takes them away from those who dropped out of it, in one script.
+func updateRankPoints(board models.CompositeBoard, cg models.CompositeGame, game models.Game, keys compositeKeys) error {
+	ascending, tied := compositeScriptArgs(game)
+	scriptKeys := append([]string{gameBoardKey(game.GameID)}, contributionKeys(keys, game.GameID)...)
+	return storage.SetRankPointsScript.Run(storage.RedisCtx, storage.RedisClient, scriptKeys,
+		board.RankPointsDepth, cg.Weight, ascending, tied).Err()
+}
+
+// RefreshComposite recomputes a composite board from its game boards into
+// fresh keys and swaps them in. It also refreshes the z-score statistics.
+// Like a board rebuild it holds a lock while it runs, and contributions set
+// meanwhile are mirrored into the fresh keys so the swap keeps them.
+func RefreshComposite(board models.CompositeBoard) (err error) {
+	live := compositeKeysFor(compositeBoardKey(board.BoardID))
+	next := live.refreshed()
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	locked, err := storage.RedisClient.SetNX(storage.RedisCtx, live.lock, token, rebuildLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errCompositeRefreshRunning
+	}
+	defer func() {
+		if err != nil {
+			storage.ReleaseLockScript.Run(storage.RedisCtx, storage.RedisClient, []string{live.lock}, token)
+		}
+	}()
+
+	current := []string{live.board, live.stats}
+	fresh := []string{next.board, next.stats}
+	for _, cg := range board.Games {
+		current = append(current, live.contributions(cg.GameID))
+		fresh = append(fresh, next.contributions(cg.GameID))
+	}
+	// Clear anything left by an interrupted refresh. Contributions mirrored
+	// since the lock was taken are recomputed from the game boards below.
+	if err = storage.RedisClient.Del(storage.RedisCtx, fresh...).Err(); err != nil {
+		return err
+	}
+
+	for _, cg := range board.Games {
+		game, err := lookupGame(cg.GameID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cg.GameID, err)
+		}
+		ascending, tied := compositeScriptArgs(game)
+		err = storage.RefreshContributionsScript.Run(storage.RedisCtx, storage.RedisClient,
+			[]string{gameBoardKey(game.GameID), next.board, next.contributions(game.GameID), next.stats},
+			board.Method, cg.Weight, ascending, tied, board.RankPointsDepth, game.GameID).Err()
+		if err != nil {
+			return err
+		}
+
+		refreshed, err := storage.RefreshLockScript.Run(storage.RedisCtx, storage.RedisClient,
+			[]string{live.lock}, token, rebuildLockTTL.Milliseconds()).Int()
+		if err != nil {
+			return err
+		}
+		if refreshed == 0 {
+			return errors.New("composite refresh lock lost")
+		}
+	}
+
+	swapKeys := append(append(current, fresh...), live.lock)
+	swapped, err := storage.SwapRefreshedKeysScript.Run(storage.RedisCtx, storage.RedisClient, swapKeys, token).Int()
+	if err != nil {
+		return err
+	}
+	if swapped == 0 {
+		return errors.New("composite refresh lock lost")
+	}
+	return nil
+}
+
+// RefreshComposites recomputes every composite board.
+func RefreshComposites() {
+	boards, err := composites()
+	if err != nil {
+		log.Println("Failed to load composite boards:", err)
+		return
+	}
+	for _, board := range boards {
+		if err := RefreshComposite(board); err != nil && err != errCompositeRefreshRunning {
+			log.Printf("Failed to refresh composite board %s: %v", board.BoardID, err)
+		}
+	}
+}
+
+// RunCompositeRefresher recomputes every composite board each interval. This
+// keeps z-score statistics current and corrects any drift from the
+// incremental updates.
+func RunCompositeRefresher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		RefreshComposites()
+	}
+}
+
+func validateComposite(board *models.CompositeBoard) error {
+	if !gameIDPattern.MatchString(board.BoardID) {
+		return errors.New("board_id must be 1-64 characters of a-z, 0-9, '_' or '-'")
+	}
+	if board.Name == "" {
+		board.Name = board.BoardID
+	}
+
+	switch board.Method {
+	case "":
+		board.Method = models.CompositeWeighted
+	case models.CompositeWeighted, models.CompositeRankPoints, models.CompositeZScore:
+	default:
+		return errors.New("method must be one of: weighted, rank_points, zscore")
+	}
+	if board.RankPointsDepth <= 0 {
+		board.RankPointsDepth = models.DefaultRankPointsDepth
+	}
+
+	if len(board.Games) == 0 {
+		return errors.New("games must list at least one game")
+	}
+	seen := make(map[string]bool)
+	for i, cg := range board.Games {
+		if seen[cg.GameID] {
+			return errors.New("games must not repeat a game")
+		}
+		seen[cg.GameID] = true
+		if _, err := lookupGame(cg.GameID); err != nil {
+			return fmt.Errorf("game %q not found", cg.GameID)
+		}
+		if cg.Weight == 0 {
+			board.Games[i].Weight = 1
+		}
+	}
+	return nil
+}
+
+func CompositesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListComposites(w, r)
+	case http.MethodPost:
+		SaveComposite(w, r)
+	case http.MethodPut:
+		SaveComposite(w, r)
+	case http.MethodDelete:
+		DeleteComposite(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func ListComposites(w http.ResponseWriter, r *http.Request) {
+	rows, err := storage.DB.Query("SELECT " + compositeColumns + " FROM composite_boards ORDER BY board_id")
+	if err != nil {
+		http.Error(w, "Failed to list composite boards", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	boards := []models.CompositeBoard{}
+	for rows.Next() {
+		board, err := scanComposite(rows)
+		if err != nil {
+			http.Error(w, "Failed to list composite boards", http.StatusInternalServerError)
+			return
+		}
+		boards = append(boards, board)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(boards)
+}
+
+// SaveComposite creates (POST) or replaces (PUT ?board_id=) a composite
+// board and recomputes it in the background.
+func SaveComposite(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var board models.CompositeBoard
+	if err := json.NewDecoder(r.Body).Decode(&board); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if boardID := r.URL.Query().Get("board_id"); boardID != "" {
+		board.BoardID = boardID
+	}
+	if err := validateComposite(&board); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	games, _ := json.Marshal(board.Games)
+	var saved, previous models.CompositeBoard
+	var err error
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		saved, err = scanComposite(storage.DB.QueryRow(`
+            INSERT INTO composite_boards (board_id, name, method, games, rank_points_depth)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING `+compositeColumns,
+			board.BoardID, board.Name, board.Method, string(games), board.RankPointsDepth))
+		if isUniqueViolation(err) {
+			http.Error(w, "Composite board already exists", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to create composite board", http.StatusInternalServerError)
+			return
+		}
+		status = http.StatusCreated
+	} else {
+		tx, err := storage.DB.Begin()
+		if err != nil {
+			http.Error(w, "Failed to update composite board", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		previous, err = scanComposite(tx.QueryRow(
+			"SELECT "+compositeColumns+" FROM composite_boards WHERE board_id = $1 FOR UPDATE", board.BoardID))
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Composite board %q not found", board.BoardID), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to update composite board", http.StatusInternalServerError)
+			return
+		}
+		saved, err = scanComposite(tx.QueryRow(`
+            UPDATE composite_boards SET name = $2, method = $3, games = $4, rank_points_depth = $5
+            WHERE board_id = $1
+            RETURNING `+compositeColumns,
+			board.BoardID, board.Name, board.Method, string(games), board.RankPointsDepth))
+		if err != nil {
+			http.Error(w, "Failed to update composite board", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to update composite board", http.StatusInternalServerError)
+			return
+		}
+	}
+	invalidateCompositeCache()
+
+	// Contributions of games the board no longer includes would otherwise
+	// stay in Redis; the refresh below only replaces those of its games.
+	if dropped := droppedContributions(previous, saved); len(dropped) > 0 {
+		if err := storage.RedisClient.Del(storage.RedisCtx, dropped...).Err(); err != nil {
+			log.Printf("Failed to remove contributions from composite board %s: %v", saved.BoardID, err)
+		}
+	}
+
+	go func() {
+		if err := RefreshComposite(saved); err != nil {
+			log.Printf("Failed to refresh composite board %s: %v", saved.BoardID, err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// droppedContributions are the contribution keys of the games in previous
+// that board no longer includes.
+func droppedContributions(previous, board models.CompositeBoard) []string {
+	kept := make(map[string]bool, len(board.Games))
+	for _, cg := range board.Games {
+		kept[cg.GameID] = true
+	}
+	keys := compositeKeysFor(compositeBoardKey(previous.BoardID))
+	var dropped []string
+	for _, cg := range previous.Games {
+		if !kept[cg.GameID] {
+			dropped = append(dropped, keys.contributions(cg.GameID))
+		}
+	}
+	return dropped
+}
+
+func DeleteComposite(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	boardID := r.URL.Query().Get("board_id")
+	board, err := scanComposite(storage.DB.QueryRow(
+		"DELETE FROM composite_boards WHERE board_id = $1 RETURNING "+compositeColumns, boardID))
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Composite board %q not found", boardID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to delete composite board", http.StatusInternalServerError)
+		return
+	}
+	invalidateCompositeCache()
+
+	keys := compositeKeysFor(compositeBoardKey(board.BoardID))
+	del := []string{keys.board, keys.stats}
+	for _, cg := range board.Games {
+		del = append(del, keys.contributions(cg.GameID))
+	}
+	storage.RedisClient.Del(storage.RedisCtx, del...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(board)
+}
+
+// GetCompositeLeaderboard pages through a composite board like /leaderboard.
+func GetCompositeLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok || rankMode == models.RankDense {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard", http.StatusBadRequest)
+		return
+	}
+
+	boardID := r.URL.Query().Get("board_id")
+	board, err := lookupComposite(boardID)
+	if err == errCompositeNotFound {
+		http.Error(w, fmt.Sprintf("Composite board %q not found", boardID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load composite board", http.StatusInternalServerError)
+		return
+	}
+
+	page, err := boardPage(r, compositeGame(board), compositeBoardKey(board.BoardID), rankMode)
+	if err == errInvalidPage {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	} else if err == errInvalidCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+	page.GameID = board.BoardID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// RefreshCompositeHandler recomputes one composite board (?board_id=) or all
+// of them in the background.
+func RefreshCompositeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	boardID := r.URL.Query().Get("board_id")
+	if boardID == "" {
+		go RefreshComposites()
+	} else {
+		board, err := lookupComposite(boardID)
+		if err == errCompositeNotFound {
+			http.Error(w, fmt.Sprintf("Composite board %q not found", boardID), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to load composite board", http.StatusInternalServerError)
+			return
+		}
+		go func() {
+			if err := RefreshComposite(board); err != nil {
+				log.Printf("Failed to refresh composite board %s: %v", board.BoardID, err)
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Refresh started"})
+}
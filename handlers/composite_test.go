@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestGames stands in for the game registry for the duration of the test.
+func useTestGames(t *testing.T, games ...models.Game) {
+	t.Helper()
+	gameCache.Lock()
+	previous, loadedAt := gameCache.games, gameCache.loadedAt
+	gameCache.games, gameCache.loadedAt = make(map[string]models.Game), time.Now()
+	for _, game := range games {
+		gameCache.games[game.GameID] = game
+	}
+	gameCache.Unlock()
+	t.Cleanup(func() {
+		gameCache.Lock()
+		gameCache.games, gameCache.loadedAt = previous, loadedAt
+		gameCache.Unlock()
+	})
+}
+
+// useTestComposites stands in for the composite board registry for the
+// duration of the test.
+func useTestComposites(t *testing.T, boards ...models.CompositeBoard) {
+	t.Helper()
+	compositeCache.Lock()
+	previous, loadedAt := compositeCache.boards, compositeCache.loadedAt
+	compositeCache.boards, compositeCache.loadedAt = make(map[string]models.CompositeBoard), time.Now()
+	for _, board := range boards {
+		compositeCache.boards[board.BoardID] = board
+	}
+	compositeCache.Unlock()
+	t.Cleanup(func() {
+		compositeCache.Lock()
+		compositeCache.boards, compositeCache.loadedAt = previous, loadedAt
+		compositeCache.Unlock()
+	})
+}
+
+// compositeScores reads the composite board at key as username -> score.
+func compositeScores(t *testing.T, key string) map[string]float64 {
+	t.Helper()
+	members, err := storage.RedisClient.ZRangeWithScores(storage.RedisCtx, key, 0, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores := make(map[string]float64, len(members))
+	for _, m := range members {
+		scores[m.Member.(string)] = m.Score
+	}
+	return scores
+}
+
+func checkScores(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	for username, score := range want {
+		if got[username] != score {
+			t.Errorf("%s = %v, want %v (board %v)", username, got[username], score, got)
+		}
+	}
+}
+
+func TestUpdateRankPoints(t *testing.T) {
+	useTestRedis(t)
+	game := models.Game{
+		GameID:        "sprint",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortAscending,
+		TieBreakers:   []string{models.TieBreakEarliest},
+	}
+	cg := models.CompositeGame{GameID: game.GameID, Weight: 2}
+	board := models.CompositeBoard{BoardID: "b", Method: models.CompositeRankPoints, RankPointsDepth: 3, Games: []models.CompositeGame{cg}}
+	keys := compositeKeysFor(compositeBoardKey(board.BoardID))
+
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	submit := func(historyID int64, username string, score int) {
+		t.Helper()
+		if _, err := applyScore(game, username, score, at.Add(time.Duration(historyID)*time.Second), historyID, 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := updateRankPoints(board, cg, game, keys); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	submit(1, "alice", 10)
+	submit(2, "bob", 20)
+	submit(3, "carol", 30)
+	checkScores(t, compositeScores(t, keys.board), map[string]float64{"alice": 6, "bob": 4, "carol": 2})
+
+	// dave pushes carol out of the top three.
+	submit(4, "dave", 5)
+	want := map[string]float64{"dave": 6, "alice": 4, "bob": 2, "carol": 0}
+	checkScores(t, compositeScores(t, keys.board), want)
+
+	// A refresh recomputes the same points.
+	useTestGames(t, game)
+	if err := RefreshComposite(board); err != nil {
+		t.Fatal(err)
+	}
+	checkScores(t, compositeScores(t, keys.board), want)
+}
+
+// A contribution set while a refresh runs must survive the swap, even though
+// the refresh computed that game before the change.
+func TestRefreshCompositeKeepsMirroredUpdates(t *testing.T) {
+	useTestRedis(t)
+	game := models.Game{
+		GameID:        "darts",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortDescending,
+		TieBreakers:   []string{},
+	}
+	useTestGames(t, game)
+	cg := models.CompositeGame{GameID: game.GameID, Weight: 1}
+	board := models.CompositeBoard{BoardID: "b", Method: models.CompositeWeighted, RankPointsDepth: 3, Games: []models.CompositeGame{cg}}
+	useTestComposites(t, board)
+	live := compositeKeysFor(compositeBoardKey(board.BoardID))
+	next := live.refreshed()
+
+	for i, s := range []struct {
+		username string
+		score    int
+	}{{"alice", 100}, {"bob", 50}} {
+		if _, err := applyScore(game, s.username, s.score, time.Now(), int64(i+1), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RefreshComposite(board); err != nil {
+		t.Fatal(err)
+	}
+	checkScores(t, compositeScores(t, live.board), map[string]float64{"alice": 100, "bob": 50})
+
+	// Run a refresh by hand so a submission can land between computing the
+	// game and swapping the keys.
+	const token = "test"
+	if err := storage.RedisClient.Set(storage.RedisCtx, live.lock, token, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	err := storage.RefreshContributionsScript.Run(storage.RedisCtx, storage.RedisClient,
+		[]string{gameBoardKey(game.GameID), next.board, next.contributions(game.GameID), next.stats},
+		board.Method, cg.Weight, 0, 0, board.RankPointsDepth, game.GameID).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := applyScore(game, "bob", 150, time.Now(), 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateComposites(game, "bob", 150); err != nil {
+		t.Fatal(err)
+	}
+
+	swapKeys := []string{live.board, live.stats, live.contributions(game.GameID),
+		next.board, next.stats, next.contributions(game.GameID), live.lock}
+	if swapped, err := storage.SwapRefreshedKeysScript.Run(storage.RedisCtx, storage.RedisClient, swapKeys, token).Int(); err != nil || swapped != 1 {
+		t.Fatalf("swap = %d, %v", swapped, err)
+	}
+	checkScores(t, compositeScores(t, live.board), map[string]float64{"alice": 100, "bob": 150})
+}
+
+func TestDroppedContributions(t *testing.T) {
+	games := func(ids ...string) []models.CompositeGame {
+		var cgs []models.CompositeGame
+		for _, id := range ids {
+			cgs = append(cgs, models.CompositeGame{GameID: id, Weight: 1})
+		}
+		return cgs
+	}
+	previous := models.CompositeBoard{BoardID: "b", Games: games("chess", "go", "poker")}
+	board := models.CompositeBoard{BoardID: "b", Games: games("go", "darts")}
+	keys := compositeKeysFor(compositeBoardKey("b"))
+
+	got := droppedContributions(previous, board)
+	want := []string{keys.contributions("chess"), keys.contributions("poker")}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("dropped = %v, want %v", got, want)
+	}
+	if got := droppedContributions(models.CompositeBoard{}, board); len(got) != 0 {
+		t.Errorf("a new board drops %v", got)
+	}
+}
@@ -0,0 +1,479 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	scopeFollowing = "following"
+	scopeFriends   = "friends"
+)
+
+// followSetTTL bounds how long a cached follow set lives without being read
+// from Postgres again.
+const followSetTTL = 10 * time.Minute
+
+// followSetSentinel is cached in every follow set, so a user who follows
+// nobody (or has no followers) is not looked up in Postgres on every read.
+// No username is empty.
+const followSetSentinel = ""
+
+// maxFollows caps how many players one user can follow, which bounds the
+// friends leaderboard.
+const maxFollows = 1000
+
+// The follow graph lives in the follows table and is cached in one Redis set
+// per user and direction. A set that is missing is loaded from Postgres on
+// first use; follows and unfollows drop the sets they change.
+func followingKey(username string) string {
+	return fmt.Sprintf("user:%s:following", username)
+}
+
+func followersKey(username string) string {
+	return fmt.Sprintf("user:%s:followers", username)
+}
+
+// followVersionKey counts the changes to the follow set at key, so a load
+// that raced a change is not cached.
+func followVersionKey(key string) string {
+	return key + ":version"
+}
+
+// followSet returns the members of a cached follow set, loading it with
+// query (one $1 placeholder for username) when it is not cached.
+func followSet(key, query, username string) ([]string, error) {
+	var members *redis.StringSliceCmd
+	var version *redis.StringCmd
+	_, err := storage.RedisClient.Pipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		members = pipe.SMembers(storage.RedisCtx, key)
+		version = pipe.Get(storage.RedisCtx, followVersionKey(key))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if cached := members.Val(); len(cached) > 0 {
+		var usernames []string
+		for _, member := range cached {
+			if member != followSetSentinel {
+				usernames = append(usernames, member)
+			}
+		}
+		return usernames, nil
+	}
+
+	rows, err := storage.DB.Query(query, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var loaded []string
+	for rows.Next() {
+		var member string
+		if err := rows.Scan(&member); err != nil {
+			return nil, err
+		}
+		loaded = append(loaded, member)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	args := []interface{}{version.Val(), followSetTTL.Milliseconds(), followSetSentinel}
+	for _, member := range loaded {
+		args = append(args, member)
+	}
+	err = storage.LoadFollowSetScript.Run(storage.RedisCtx, storage.RedisClient,
+		[]string{key, followVersionKey(key)}, args...).Err()
+	if err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+// invalidateFollowSets drops cached follow sets after the follows behind
+// them changed. Bumping their versions stops loads that read the follows
+// before the change from caching them again.
+func invalidateFollowSets(keys ...string) error {
+	_, err := storage.RedisClient.TxPipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Incr(storage.RedisCtx, followVersionKey(key))
+			pipe.Expire(storage.RedisCtx, followVersionKey(key), followSetTTL)
+		}
+		pipe.Del(storage.RedisCtx, keys...)
+		return nil
+	})
+	return err
+}
+
+func following(username string) ([]string, error) {
+	return followSet(followingKey(username), "SELECT followee FROM follows WHERE follower = $1", username)
+}
+
+func followers(username string) ([]string, error) {
+	return followSet(followersKey(username), "SELECT follower FROM follows WHERE followee = $1", username)
+}
+
+// friends returns the users username follows who follow them back.
+func friends(username string) ([]string, error) {
+	out, err := following(username)
+	if err != nil {
+		return nil, err
+	}
+	in, err := followers(username)
+	if err != nil {
+		return nil, err
+	}
+
+	followsBack := make(map[string]bool, len(in))
+	for _, u := range in {
+		followsBack[u] = true
+	}
+	var mutual []string
+	for _, u := range out {
+		if followsBack[u] {
+			mutual = append(mutual, u)
+		}
+	}
+	return mutual, nil
+}
+
+func FriendsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListFollows(w, r)
+	case http.MethodPost:
+		Follow(w, r)
+	case http.MethodDelete:
+		Unfollow(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListFollows returns who the caller follows, who follows them and their
+// friends (mutual follows).
+func ListFollows(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	out, err := following(claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to list friends", http.StatusInternalServerError)
+		return
+	}
+	in, err := followers(claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to list friends", http.StatusInternalServerError)
+		return
+	}
+	mutual, err := friends(claims.Username)
+	if err != nil {
+		http.Error(w, "Failed to list friends", http.StatusInternalServerError)
+		return
+	}
+
+	lists := [][]string{out, in, mutual}
+	for i := range lists {
+		if lists[i] == nil {
+			lists[i] = []string{}
+		}
+		sort.Strings(lists[i])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":  claims.Username,
+		"following": lists[0],
+		"followers": lists[1],
+		"friends":   lists[2],
+	})
+}
+
+// Follow makes the caller follow ?username=.
+func Follow(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	target := r.URL.Query().Get("username")
+	if target == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+	if target == claims.Username {
+		http.Error(w, "Cannot follow yourself", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	err := storage.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)", target).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Failed to follow user", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("User %q not found", target), http.StatusNotFound)
+		return
+	}
+
+	// Nothing is inserted when the caller already follows target or follows
+	// maxFollows players; only the latter is an error.
+	result, err := storage.DB.Exec(`
+        INSERT INTO follows (follower, followee)
+        SELECT $1, $2
+        WHERE (SELECT COUNT(*) FROM follows WHERE follower = $1) < $3
+        ON CONFLICT DO NOTHING
+    `, claims.Username, target, maxFollows)
+	if err != nil {
+		http.Error(w, "Failed to follow user", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		var following bool
+		err := storage.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM follows WHERE follower = $1 AND followee = $2)",
+			claims.Username, target).Scan(&following)
+		if err != nil {
+			http.Error(w, "Failed to follow user", http.StatusInternalServerError)
+			return
+		}
+		if !following {
+			http.Error(w, fmt.Sprintf("You can follow at most %d players", maxFollows), http.StatusConflict)
+			return
+		}
+	}
+
+	if err := invalidateFollowSets(followingKey(claims.Username), followersKey(target)); err != nil {
+		log.Printf("Failed to invalidate follow sets of %s and %s: %v", claims.Username, target, err)
+	}
+
+	var isFriend bool
+	storage.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM follows WHERE follower = $1 AND followee = $2)",
+		target, claims.Username).Scan(&isFriend)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   fmt.Sprintf("Now following %s", target),
+		"following": target,
+		"friends":   isFriend,
+	})
+}
+
+// Unfollow makes the caller stop following ?username=.
+func Unfollow(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	target := r.URL.Query().Get("username")
+	if target == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := storage.DB.Exec("DELETE FROM follows WHERE follower = $1 AND followee = $2", claims.Username, target)
+	if err != nil {
+		http.Error(w, "Failed to unfollow user", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, fmt.Sprintf("Not following %q", target), http.StatusNotFound)
+		return
+	}
+
+	if err := invalidateFollowSets(followingKey(claims.Username), followersKey(target)); err != nil {
+		log.Printf("Failed to invalidate follow sets of %s and %s: %v", claims.Username, target, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": fmt.Sprintf("Unfollowed %s", target),
+	})
+}
+
+// friendEntry is a player on a friends leaderboard: Rank is among the
+// friends shown, GlobalRank on the whole board.
+type friendEntry struct {
+	models.LeaderboardEntry
+	GlobalRank int64 `json:"global_rank"`
+}
+
+// friendsBoard ranks usernames on the game's board, dropping those without a
+// score. Members are looked up through the board's members hash since they
+// may carry a tie-breaker prefix.
+func friendsBoard(game models.Game, key, mode string, usernames []string) ([]friendEntry, error) {
+	if len(usernames) == 0 {
+		return []friendEntry{}, nil
+	}
+
+	stored, err := storage.RedisClient.HMGet(storage.RedisCtx, boardMembersKey(key), usernames...).Result()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, len(usernames))
+	for i, username := range usernames {
+		members[i] = username
+		if member, ok := stored[i].(string); ok {
+			members[i] = member
+		}
+	}
+
+	positions := make([]*redis.IntCmd, len(members))
+	scores := make([]*redis.FloatCmd, len(members))
+	_, err = storage.RedisClient.Pipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		for i, member := range members {
+			if game.Ascending() {
+				positions[i] = pipe.ZRank(storage.RedisCtx, key, member)
+			} else {
+				positions[i] = pipe.ZRevRank(storage.RedisCtx, key, member)
+			}
+			scores[i] = pipe.ZScore(storage.RedisCtx, key, member)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	type ranked struct {
+		username string
+		position int64
+		score    float64
+	}
+	var onBoard []ranked
+	for i, username := range usernames {
+		if positions[i].Err() != nil {
+			continue
+		}
+		onBoard = append(onBoard, ranked{username, positions[i].Val(), scores[i].Val()})
+	}
+	sort.Slice(onBoard, func(i, j int) bool {
+		return onBoard[i].position < onBoard[j].position
+	})
+
+	entries := make([]models.LeaderboardEntry, len(onBoard))
+	for i, player := range onBoard {
+		entries[i] = models.LeaderboardEntry{Username: player.username, Score: player.score}
+	}
+	assignRanks(entries, mode, 0, 1)
+
+	// Global ranks and placements are counts of better scores, read for
+	// every player in one round trip.
+	distinctKey := boardDistinctKey(key)
+	if mode == models.RankDense {
+		err := storage.RebuildDistinctScoresScript.Run(storage.RedisCtx, storage.RedisClient,
+			[]string{key, distinctKey}).Err()
+		if err != nil {
+			return nil, err
+		}
+	}
+	var total *redis.IntCmd
+	better := make([]*redis.IntCmd, len(onBoard))
+	betterDistinct := make([]*redis.IntCmd, len(onBoard))
+	_, err = storage.RedisClient.Pipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		total = pipe.ZCard(storage.RedisCtx, key)
+		for i, player := range onBoard {
+			from, to := betterScores(game, player.score)
+			better[i] = pipe.ZCount(storage.RedisCtx, key, from, to)
+			if mode == models.RankDense {
+				betterDistinct[i] = pipe.ZCount(storage.RedisCtx, distinctKey, from, to)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	board := make([]friendEntry, len(onBoard))
+	for i, player := range onBoard {
+		globalRank := player.position + 1
+		switch mode {
+		case models.RankStandard:
+			globalRank = better[i].Val() + 1
+		case models.RankDense:
+			globalRank = betterDistinct[i].Val() + 1
+		}
+		entries[i].TopPercent = topPercent(better[i].Val()+1, total.Val())
+		entries[i].Tier = tierFor(game, player.score, entries[i].TopPercent)
+		board[i] = friendEntry{LeaderboardEntry: entries[i], GlobalRank: globalRank}
+	}
+	return board, nil
+}
+
+// GetFriendsLeaderboard ranks the caller and the players they follow
+// (scope=following, the default) or their mutual friends (scope=friends).
+func GetFriendsLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	scope := r.URL.Query().Get("scope")
+	var usernames []string
+	var err error
+	switch scope {
+	case "", scopeFollowing:
+		scope = scopeFollowing
+		usernames, err = following(claims.Username)
+	case scopeFriends:
+		usernames, err = friends(claims.Username)
+	default:
+		http.Error(w, "Invalid scope. Use: following, friends", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to get friends", http.StatusInternalServerError)
+		return
+	}
+	usernames = append(usernames, claims.Username)
+
+	board, err := friendsBoard(game, gameBoardKey(game.GameID), rankMode, usernames)
+	if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"game_id":     game.GameID,
+		"rank_mode":   rankMode,
+		"scope":       scope,
+		"username":    claims.Username,
+		"leaderboard": board,
+	})
+}
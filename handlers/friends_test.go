@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+	"time"
+)
+
+// A load that read the follows before a follow committed must not cache its
+// stale copy after the follow dropped the set.
+func TestLoadFollowSetAfterChange(t *testing.T) {
+	mr := useTestRedis(t)
+	key := followingKey("alice")
+	load := func(version string, members ...interface{}) int {
+		t.Helper()
+		args := append([]interface{}{version, followSetTTL.Milliseconds()}, members...)
+		n, err := storage.LoadFollowSetScript.Run(storage.RedisCtx, storage.RedisClient,
+			[]string{key, followVersionKey(key)}, args...).Int()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// The reader saw no version and read [bob] from Postgres; meanwhile
+	// alice followed carol.
+	if err := invalidateFollowSets(key, followersKey("carol")); err != nil {
+		t.Fatal(err)
+	}
+	if load("", "bob") != 0 {
+		t.Fatal("stale follow set was cached")
+	}
+	if mr.Exists(key) {
+		t.Fatal("stale follow set exists")
+	}
+
+	// The next reader sees the new version and caches what it read.
+	version, err := storage.RedisClient.Get(storage.RedisCtx, followVersionKey(key)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if load(version, "bob", "carol") != 1 {
+		t.Fatal("fresh follow set was not cached")
+	}
+	members, _ := storage.RedisClient.SMembers(storage.RedisCtx, key).Result()
+	if len(members) != 2 {
+		t.Errorf("cached members = %v, want bob and carol", members)
+	}
+	if ttl := mr.TTL(key); ttl <= 0 || ttl > followSetTTL {
+		t.Errorf("follow set TTL = %v, want up to %v", ttl, followSetTTL)
+	}
+}
+
+// Following nobody is cached too, so it is read from Postgres once.
+func TestFollowSetCachesEmptySet(t *testing.T) {
+	useTestRedis(t)
+	mock := useTestDB(t)
+	mock.ExpectQuery("SELECT followee FROM follows").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"followee"}))
+
+	for i := 0; i < 2; i++ {
+		usernames, err := following("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(usernames) != 0 {
+			t.Fatalf("following = %v, want none", usernames)
+		}
+	}
+}
+
+func TestFriendsBoardMatchesBoard(t *testing.T) {
+	useTestRedis(t)
+	game := models.Game{
+		GameID:        "g",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortDescending,
+		TieBreakers:   []string{},
+		Tiers:         models.DefaultTiers(),
+	}
+	scores := map[string]int{"alice": 100, "bob": 90, "carol": 90, "dave": 80, "erin": 70}
+	var historyID int64
+	for username, score := range scores {
+		historyID++
+		if _, err := applyScore(game, username, score, time.Now(), historyID, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := gameBoardKey(game.GameID)
+	for _, mode := range models.RankModes {
+		board, err := friendsBoard(game, key, mode, []string{"erin", "carol", "dave", "nobody"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(board) != 3 {
+			t.Fatalf("%s: %d entries, want 3", mode, len(board))
+		}
+		for i, entry := range board {
+			if entry.Rank != int64(i+1) {
+				t.Errorf("%s: %s rank = %d, want %d", mode, entry.Username, entry.Rank, i+1)
+			}
+			position, score, err := boardPosition(game, key, entry.Username)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := scoreRank(game, key, mode, position, score)
+			if err != nil {
+				t.Fatal(err)
+			}
+			percent, tier, err := placement(game, key, score, int64(len(scores)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.GlobalRank != want || entry.TopPercent != percent || entry.Tier != tier {
+				t.Errorf("%s: %s = rank %d, %v%%, %q; want rank %d, %v%%, %q", mode, entry.Username,
+					entry.GlobalRank, entry.TopPercent, entry.Tier, want, percent, tier)
+			}
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var errGameNotFound = errors.New("game not found")
+
+var gameIDPattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// gameCacheTTL bounds how long another instance's registry changes take to
+// become visible here.
+const gameCacheTTL = 30 * time.Second
+
+var gameCache struct {
+	sync.RWMutex
+	games    map[string]models.Game
+	loadedAt time.Time
+}
+
+const gameColumns = `game_id, game_name, aggregation, average_window, sort_order, tie_breakers,
+        score_unit, min_score, max_score, tiers, team_aggregation, team_best_n, archived_at, created_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanGame(row rowScanner) (models.Game, error) {
+	var game models.Game
+	var minScore, maxScore sql.NullInt64
+	var archivedAt sql.NullTime
+	var tiers []byte
+	err := row.Scan(&game.GameID, &game.GameName, &game.Aggregation, &game.AverageWindow,
+		&game.SortOrder, pq.Array(&game.TieBreakers), &game.ScoreUnit, &minScore, &maxScore,
+		&tiers, &game.TeamAggregation, &game.TeamBestN, &archivedAt, &game.CreatedAt)
+	if err != nil {
+		return game, err
+	}
+	if err := json.Unmarshal(tiers, &game.Tiers); err != nil {
+		return game, err
+	}
+	if minScore.Valid {
+		v := int(minScore.Int64)
+		game.MinScore = &v
+	}
+	if maxScore.Valid {
+		v := int(maxScore.Int64)
+		game.MaxScore = &v
+	}
+	if archivedAt.Valid {
+		game.ArchivedAt = &archivedAt.Time
+	}
+	if game.TieBreakers == nil {
+		game.TieBreakers = []string{}
+	}
+	return game, nil
+}
+
+func loadGames() (map[string]models.Game, error) {
+	rows, err := storage.DB.Query("SELECT " + gameColumns + " FROM games")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	games := make(map[string]models.Game)
+	for rows.Next() {
+		game, err := scanGame(rows)
+		if err != nil {
+			return nil, err
+		}
+		games[game.GameID] = game
+	}
+	return games, rows.Err()
+}
+
+func invalidateGameCache() {
+	gameCache.Lock()
+	gameCache.games = nil
+	gameCache.Unlock()
+}
+
+// lookupGame returns the registered game, including archived ones, or
+// errGameNotFound.
+func lookupGame(gameID string) (models.Game, error) {
+	gameCache.RLock()
+	games, fresh := gameCache.games, time.Since(gameCache.loadedAt) < gameCacheTTL
+	gameCache.RUnlock()
+
+	if games == nil || !fresh {
+		loaded, err := loadGames()
+		if err != nil {
+			return models.Game{}, err
+		}
+		gameCache.Lock()
+		gameCache.games, gameCache.loadedAt = loaded, time.Now()
+		gameCache.Unlock()
+		games = loaded
+	}
+
+	game, ok := games[gameID]
+	if !ok {
+		return models.Game{}, errGameNotFound
+	}
+	return game, nil
+}
+
+// requireGame looks up gameID and writes a 404 or 500 response when it cannot
+// be used.
+func requireGame(w http.ResponseWriter, gameID string) (models.Game, bool) {
+	game, err := lookupGame(gameID)
+	if err == errGameNotFound {
+		http.Error(w, fmt.Sprintf("Game %q not found", gameID), http.StatusNotFound)
+		return game, false
+	} else if err != nil {
+		http.Error(w, "Failed to load game", http.StatusInternalServerError)
+		return game, false
+	}
+	return game, true
+}
+
+// validateGame fills in defaults and rejects settings the boards cannot use.
+func validateGame(game *models.Game) error {
+	if !gameIDPattern.MatchString(game.GameID) {
+		return errors.New("game_id must be 1-64 characters of a-z, 0-9, '_' or '-'")
+	}
+	if game.GameName == "" {
+		game.GameName = game.GameID
+	}
+
+	switch game.Aggregation {
+	case "":
+		game.Aggregation = models.AggregationBest
+	case models.AggregationBest, models.AggregationLatest, models.AggregationSum, models.AggregationAverage:
+	case models.AggregationRating:
+		// Ratings are ranked highest first and are unique enough that ties
+		// fall back to username order.
+		if game.SortOrder == models.SortAscending {
+			return errors.New("rated games must sort desc")
+		}
+		if game.MinScore != nil || game.MaxScore != nil {
+			return errors.New("rated games do not take min_score or max_score")
+		}
+		game.TieBreakers = []string{}
+		if game.ScoreUnit == "" {
+			game.ScoreUnit = "rating"
+		}
+	default:
+		return errors.New("aggregation must be one of: best, latest, sum, average, rating")
+	}
+	if game.AverageWindow <= 0 {
+		game.AverageWindow = models.DefaultAverageWindow
+	}
+
+	switch game.SortOrder {
+	case "":
+		game.SortOrder = models.SortDescending
+	case models.SortDescending, models.SortAscending:
+	default:
+		return errors.New("sort_order must be desc or asc")
+	}
+
+	if game.TieBreakers == nil {
+		game.TieBreakers = []string{models.TieBreakEarliest}
+	}
+	seen := make(map[string]bool)
+	for _, key := range game.TieBreakers {
+		if key != models.TieBreakEarliest && key != models.TieBreakAttempts {
+			return errors.New("tie_breakers may only contain earliest and attempts")
+		}
+		if seen[key] {
+			return errors.New("tie_breakers must not repeat a key")
+		}
+		seen[key] = true
+	}
+
+	if game.ScoreUnit == "" {
+		game.ScoreUnit = "points"
+	}
+	if game.MinScore != nil && game.MaxScore != nil && *game.MinScore > *game.MaxScore {
+		return errors.New("min_score must not exceed max_score")
+	}
+
+	switch game.TeamAggregation {
+	case "":
+		game.TeamAggregation = models.TeamScoreSum
+	case models.TeamScoreSum, models.TeamScoreBestN:
+	default:
+		return errors.New("team_aggregation must be sum or best_n")
+	}
+	if game.TeamBestN <= 0 {
+		game.TeamBestN = models.DefaultTeamBestN
+	}
+
+	if game.Tiers == nil {
+		game.Tiers = models.DefaultTiers()
+	}
+	names := make(map[string]bool)
+	for i, tier := range game.Tiers {
+		if tier.Name == "" || names[tier.Name] {
+			return errors.New("every tier needs a unique name")
+		}
+		names[tier.Name] = true
+		if tier.TopPercent != nil && tier.Threshold != nil {
+			return errors.New("a tier may set top_percent or threshold, not both")
+		}
+		if tier.TopPercent != nil && (*tier.TopPercent <= 0 || *tier.TopPercent > 100) {
+			return errors.New("top_percent must be greater than 0 and at most 100")
+		}
+		if tier.TopPercent == nil && tier.Threshold == nil && i != len(game.Tiers)-1 {
+			return errors.New("only the last tier may omit top_percent and threshold")
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres unique_violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// validateScore checks a submission against the game's valid range. Games
+// without a min_score keep rejecting negative scores.
+func validateScore(game models.Game, score int) error {
+	if game.MinScore == nil && score < 0 {
+		return errors.New("Score cannot be negative")
+	}
+	if game.MinScore != nil && score < *game.MinScore {
+		return fmt.Errorf("Score must be at least %d", *game.MinScore)
+	}
+	if game.MaxScore != nil && score > *game.MaxScore {
+		return fmt.Errorf("Score must be at most %d", *game.MaxScore)
+	}
+	return nil
+}
+
+func GamesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListGames(w, r)
+	case http.MethodPost:
+		CreateGame(w, r)
+	case http.MethodPut:
+		UpdateGame(w, r)
+	case http.MethodDelete:
+		ArchiveGame(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func ListGames(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT " + gameColumns + " FROM games"
+	if r.URL.Query().Get("include_archived") != "true" {
+		query += " WHERE archived_at IS NULL"
+	}
+	query += " ORDER BY game_id"
+
+	rows, err := storage.DB.Query(query)
+	if err != nil {
+		http.Error(w, "Failed to list games", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	games := []models.Game{}
+	for rows.Next() {
+		game, err := scanGame(rows)
+		if err != nil {
+			http.Error(w, "Failed to list games", http.StatusInternalServerError)
+			return
+		}
+		games = append(games, game)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(games)
+}
+
+func CreateGame(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var game models.Game
+	if err := json.NewDecoder(r.Body).Decode(&game); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateGame(&game); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := `
+        INSERT INTO games (game_id, game_name, aggregation, average_window, sort_order, tie_breakers,
+            score_unit, min_score, max_score, tiers, team_aggregation, team_best_n)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+        RETURNING ` + gameColumns
+	tiers, _ := json.Marshal(game.Tiers)
+	created, err := scanGame(storage.DB.QueryRow(query, game.GameID, game.GameName, game.Aggregation,
+		game.AverageWindow, game.SortOrder, pq.Array(game.TieBreakers), game.ScoreUnit,
+		game.MinScore, game.MaxScore, string(tiers), game.TeamAggregation, game.TeamBestN))
+	if isUniqueViolation(err) {
+		http.Error(w, "Game already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create game", http.StatusInternalServerError)
+		return
+	}
+	invalidateGameCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(created)
+}
+
+// UpdateGame replaces a game's settings. Sort order and tie-breakers decide
+// how board members are encoded, so they can only change while the game has
+// no scores yet. Changing the aggregation only affects scores submitted
+// afterwards until the board is rebuilt, and changing the team aggregation
+// only rescores a team when its board next changes. A game cannot be switched
+// to or from rating, as its board would mix scores and ratings.
+func UpdateGame(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var game models.Game
+	if err := json.NewDecoder(r.Body).Decode(&game); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if gameID := r.URL.Query().Get("game_id"); gameID != "" {
+		game.GameID = gameID
+	}
+	if err := validateGame(&game); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if current, err := lookupGame(game.GameID); err == nil && current.Rated() != game.Rated() {
+		http.Error(w, "aggregation cannot be changed to or from rating", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+        UPDATE games
+        SET game_name = $2, aggregation = $3, average_window = $4, sort_order = $5, tie_breakers = $6,
+            score_unit = $7, min_score = $8, max_score = $9, tiers = $10,
+            team_aggregation = $11, team_best_n = $12
+        WHERE game_id = $1 AND (
+            (sort_order = $5 AND tie_breakers = $6)
+            OR NOT EXISTS (SELECT 1 FROM leaderboard WHERE game_id = $1)
+        )
+        RETURNING ` + gameColumns
+	tiers, _ := json.Marshal(game.Tiers)
+	updated, err := scanGame(storage.DB.QueryRow(query, game.GameID, game.GameName, game.Aggregation,
+		game.AverageWindow, game.SortOrder, pq.Array(game.TieBreakers), game.ScoreUnit,
+		game.MinScore, game.MaxScore, string(tiers), game.TeamAggregation, game.TeamBestN))
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := storage.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM games WHERE game_id = $1)", game.GameID).Scan(&exists); err != nil {
+			http.Error(w, "Failed to update game", http.StatusInternalServerError)
+			return
+		}
+		if exists {
+			http.Error(w, "sort_order and tie_breakers cannot be changed once the game has scores", http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Game %q not found", game.GameID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update game", http.StatusInternalServerError)
+		return
+	}
+	invalidateGameCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated)
+}
+
+// ArchiveGame stops a game from accepting scores. Its leaderboard stays
+// readable.
+func ArchiveGame(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	query := `
+        UPDATE games SET archived_at = COALESCE(archived_at, CURRENT_TIMESTAMP)
+        WHERE game_id = $1
+        RETURNING ` + gameColumns
+	archived, err := scanGame(storage.DB.QueryRow(query, gameID))
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Game %q not found", gameID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to archive game", http.StatusInternalServerError)
+		return
+	}
+	invalidateGameCache()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(archived)
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"Leaderboard/config"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// minSecretLength is the shortest HMAC secret accepted: 256 bits, the
+// output size of HS256.
+const minSecretLength = 32
+
+// defaultSecretKID identifies the key given by JWT_SECRET.
+const defaultSecretKID = "default"
+
+// signingKey is a key tokens are signed or verified with, identified by the
+// kid header of the token.
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	// sign is nil for keys that only verify tokens, e.g. a retired key
+	// whose tokens have not expired yet.
+	sign   interface{}
+	verify interface{}
+}
+
+// keyRing holds every key tokens are accepted from and the one new tokens
+// are signed with.
+type keyRing struct {
+	keys   map[string]*signingKey
+	signer *signingKey
+}
+
+var signingKeys *keyRing
+
+// LoadSigningKeys loads the JWT keys from JWT_SECRET and JWT_KEYS. It must be
+// called before the server starts and fails when no key can sign tokens.
+//
+// JWT_KEYS is a comma separated list of kid=path entries. Files ending in
+// .pem hold an RSA or Ed25519 key (PKCS#1, PKCS#8 or, for keys that only
+// verify, PKIX public keys); other files hold an HS256 secret. New tokens are
+// signed with JWT_SIGNING_KID, by default the first key able to sign.
+func LoadSigningKeys() error {
+	cfg := config.LoadConfig()
+	ring := &keyRing{keys: make(map[string]*signingKey)}
+	var order []string
+
+	if cfg.JWTSecret != "" {
+		key, err := secretKey(defaultSecretKID, []byte(cfg.JWTSecret))
+		if err != nil {
+			return fmt.Errorf("JWT_SECRET: %w", err)
+		}
+		ring.keys[key.kid] = key
+		order = append(order, key.kid)
+	}
+
+	for _, entry := range strings.Split(cfg.JWTKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, path, ok := strings.Cut(entry, "=")
+		kid, path = strings.TrimSpace(kid), strings.TrimSpace(path)
+		if !ok || kid == "" || path == "" {
+			return fmt.Errorf("JWT_KEYS: invalid entry %q, use kid=path", entry)
+		}
+		if _, dup := ring.keys[kid]; dup {
+			return fmt.Errorf("JWT_KEYS: duplicate kid %q", kid)
+		}
+		key, err := loadKeyFile(kid, path)
+		if err != nil {
+			return fmt.Errorf("JWT_KEYS: key %q: %w", kid, err)
+		}
+		ring.keys[kid] = key
+		order = append(order, kid)
+	}
+
+	if cfg.JWTSigningKID != "" {
+		ring.signer = ring.keys[cfg.JWTSigningKID]
+		if ring.signer == nil || ring.signer.sign == nil {
+			return fmt.Errorf("JWT_SIGNING_KID: no private key or secret with kid %q", cfg.JWTSigningKID)
+		}
+	} else {
+		for _, kid := range order {
+			if ring.keys[kid].sign != nil {
+				ring.signer = ring.keys[kid]
+				break
+			}
+		}
+		if ring.signer == nil {
+			return errors.New("set JWT_SECRET or JWT_KEYS with at least one private key")
+		}
+	}
+
+	signingKeys = ring
+	return nil
+}
+
+// secretKey is an HS256 key.
+func secretKey(kid string, secret []byte) (*signingKey, error) {
+	if len(secret) < minSecretLength {
+		return nil, fmt.Errorf("secret must be at least %d bytes", minSecretLength)
+	}
+	return &signingKey{kid: kid, method: jwt.SigningMethodHS256, sign: secret, verify: secret}, nil
+}
+
+// loadKeyFile reads a PEM key or an HS256 secret from path.
+func loadKeyFile(kid, path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".pem") {
+		return secretKey(kid, []byte(strings.TrimSpace(string(data))))
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var parsed interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, sign: k, verify: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodRS256, verify: k}, nil
+	case ed25519.PrivateKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, sign: k, verify: k.Public()}, nil
+	case ed25519.PublicKey:
+		return &signingKey{kid: kid, method: jwt.SigningMethodEdDSA, verify: k}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T, use RSA or Ed25519", parsed)
+}
+
+// verificationKey is the jwt.Keyfunc of parseToken. The token's kid picks the
+// key and the key pins the algorithm, so an RS256 public key can never be
+// used as an HS256 secret.
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := signingKeys.keys[kid]
+	if key == nil {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("kid %q does not sign with %s", kid, token.Method.Alg())
+	}
+	return key.verify, nil
+}
+
+// signToken signs claims with the current signing key.
+func signToken(claims jwt.Claims) (string, error) {
+	signer := signingKeys.signer
+	token := jwt.NewWithClaims(signer.method, claims)
+	token.Header["kid"] = signer.kid
+	return token.SignedString(signer.sign)
+}
+
+// jwk is a public key in JSON Web Key form (RFC 7517, RFC 8037).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// publicJWK returns the JWK of an asymmetric key. HMAC secrets are never
+// published.
+func publicJWK(key *signingKey) (jwk, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch k := key.verify.(type) {
+	case *rsa.PublicKey:
+		return jwk{
+			Kty: "RSA", Kid: key.kid, Use: "sig", Alg: key.method.Alg(),
+			N: b64(k.N.Bytes()), E: b64(big.NewInt(int64(k.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return jwk{Kty: "OKP", Kid: key.kid, Use: "sig", Alg: key.method.Alg(), Crv: "Ed25519", X: b64(k)}, true
+	}
+	return jwk{}, false
+}
+
+// GetJWKS publishes the public keys tokens are signed with, so game servers
+// can verify player tokens without calling the API. Keys that only verify
+// stay listed until they are removed from JWT_KEYS.
+func GetJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	keys := []jwk{}
+	for _, key := range signingKeys.keys {
+		if k, ok := publicJWK(key); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"Leaderboard/storage"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePEM writes a PEM block to a file in dir and returns its path.
+func writePEM(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useKeyConfig sets the JWT key configuration for the test and restores the
+// loaded keys afterwards.
+func useKeyConfig(t *testing.T, secret, keys, signingKID string) {
+	t.Helper()
+	t.Setenv("JWT_SECRET", secret)
+	t.Setenv("JWT_KEYS", keys)
+	t.Setenv("JWT_SIGNING_KID", signingKID)
+	previous := signingKeys
+	t.Cleanup(func() { signingKeys = previous })
+}
+
+func TestLoadSigningKeysRejectsWeakKeys(t *testing.T) {
+	dir := t.TempDir()
+	weakRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakPEM := writePEM(t, dir, "weak.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(weakRSA))
+	shortSecret := filepath.Join(dir, "short.key")
+	if err := os.WriteFile(shortSecret, []byte(strings.Repeat("x", minSecretLength-1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		secret string
+		keys   string
+	}{
+		{"short JWT_SECRET", strings.Repeat("x", minSecretLength-1), ""},
+		{"short secret file", "", "short=" + shortSecret},
+		{"1024 bit RSA key", "", "weak=" + weakPEM},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useKeyConfig(t, tt.secret, tt.keys, "")
+			if err := LoadSigningKeys(); err == nil {
+				t.Error("LoadSigningKeys accepted a weak key")
+			}
+		})
+	}
+
+	useKeyConfig(t, strings.Repeat("x", minSecretLength), "", "")
+	if err := LoadSigningKeys(); err != nil {
+		t.Errorf("LoadSigningKeys rejected a %d byte secret: %v", minSecretLength, err)
+	}
+}
+
+func TestGetJWKSOmitsSecrets(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(dir, "hmac.key")
+	if err := os.WriteFile(secretFile, []byte(testSecret), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys := strings.Join([]string{
+		"rsa=" + writePEM(t, dir, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+		"ed=" + writePEM(t, dir, "ed.pem", "PRIVATE KEY", edDER),
+		"hmac=" + secretFile,
+	}, ",")
+	useKeyConfig(t, testSecret, keys, "")
+	if err := LoadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	GetJWKS(w, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d", w.Code)
+	}
+	if strings.Contains(w.Body.String(), testSecret) || strings.Contains(w.Body.String(), `"k"`) {
+		t.Fatalf("JWKS publishes a secret: %s", w.Body.String())
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	var kids []string
+	for _, k := range set.Keys {
+		kids = append(kids, k.Kid)
+	}
+	if got := strings.Join(kids, ","); got != "ed,rsa" {
+		t.Errorf("JWKS kids = %s, want ed,rsa", got)
+	}
+}
+
+func TestRetiredKeyStillVerifies(t *testing.T) {
+	useTestRedis(t)
+	dir := t.TempDir()
+	oldKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPublic, err := x509.MarshalPKIXPublicKey(&oldKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The retired key is only listed by its public half.
+	keys := "old=" + writePEM(t, dir, "old.pem", "PUBLIC KEY", oldPublic) +
+		",new=" + writePEM(t, dir, "new.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(newKey))
+	useKeyConfig(t, "", keys, "new")
+	if err := LoadSigningKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RedisClient.Set(storage.RedisCtx, revocationsLoadedKey, 1, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	old := signTestToken(t, jwt.SigningMethodRS256, oldKey, "old", testClaims("alice", nil))
+	if _, err := parseToken(old); err != nil {
+		t.Errorf("token of the retired key rejected: %v", err)
+	}
+
+	issued, err := signToken(testClaims("bob", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(issued, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Header["kid"] != "new" {
+		t.Errorf("new tokens signed with kid %v, want new", token.Header["kid"])
+	}
+}
@@ -4,93 +4,73 @@ import (
 	"Leaderboard/models"
 	"Leaderboard/storage"
 	"encoding/json"
-	"github.com/golang-jwt/jwt/v5"
 	"net/http"
-	"strings"
+	"strconv"
 )
 
-func SubmitScoreHandlerDB(w http.ResponseWriter, r *http.Request) {
-
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	authHeader := r.Header.Get("Authorization")
-
-	if authHeader == "" {
-
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-	claims := &models.Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return models.JwtKey, nil
-	})
-
-	if err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
+func GetLeaderboardHandlerDB(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	if !token.Valid {
-		w.WriteHeader(http.StatusUnauthorized)
+	game, ok := requireGame(w, "global")
+	if !ok {
 		return
 	}
-
-	var req struct {
-		Score int `json:"score"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	offset, limit, ok := parsePage(r)
+	if !ok {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
 		return
 	}
 
-	if req.Score < 0 {
-		http.Error(w, "score cannot be negative", http.StatusBadRequest)
-		return
-	}
-
-	query := "INSERT INTO leaderboard (username, score) VALUES ($1, $2)"
-	_, err = storage.DB.Exec(query, claims.Username, req.Score)
+	var total int64
+	err := storage.DB.QueryRow("SELECT COUNT(DISTINCT username) FROM leaderboard WHERE game_id = $1", game.GameID).Scan(&total)
 	if err != nil {
-		http.Error(w, "Failed to submit score", http.StatusInternalServerError)
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "score submitted successfully"})
-}
-
-func GetLeaderboardHandlerDB(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
 	query := `
-        SELECT username, MAX(score) as max_score 
-        FROM leaderboard 
-        GROUP BY username 
-        ORDER BY max_score DESC 
-        LIMIT 10
+        SELECT username, aggregate_score
+        FROM (` + aggregateHistoryQuery(game, "") + `
+        ) ranked
+        ORDER BY ` + rankingOrder(game) + `
+        LIMIT $2 OFFSET $3
     `
-	rows, err := storage.DB.Query(query)
+	rows, err := storage.DB.Query(query, game.GameID, limit, offset)
 	if err != nil {
 		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
-	var leaderboard []models.LeaderboardEntry
+	leaderboard := []models.LeaderboardEntry{}
 	for rows.Next() {
 		var entry models.LeaderboardEntry
 		if err := rows.Scan(&entry.Username, &entry.Score); err != nil {
 			continue
 		}
+		entry.Rank = offset + int64(len(leaderboard)) + 1
 		leaderboard = append(leaderboard, entry)
 	}
+
+	page := LeaderboardPage{
+		GameID:   game.GameID,
+		RankMode: models.RankOrdinal,
+		Total:    total,
+		Offset:   offset,
+		Limit:    limit,
+		Entries:  leaderboard,
+	}
+	if offset+limit < total {
+		page.Next = pageLink(r, "offset", strconv.FormatInt(offset+limit, 10))
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		page.Prev = pageLink(r, "offset", strconv.FormatInt(prev, 10))
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(leaderboard)
+	json.NewEncoder(w).Encode(page)
 }
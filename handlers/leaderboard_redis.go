@@ -3,12 +3,14 @@ package handlers
 import (
 	"Leaderboard/models"
 	"Leaderboard/storage"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/redis/go-redis/v9"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 )
 
 func SubmitScoreRedis(w http.ResponseWriter, r *http.Request) {
@@ -17,21 +19,8 @@ func SubmitScoreRedis(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization required", http.StatusUnauthorized)
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	claims := &models.Claims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return models.JwtKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	claims, ok := requireUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -41,57 +30,61 @@ func SubmitScoreRedis(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Score < 0 {
-		http.Error(w, "Score cannot be negative", http.StatusBadRequest)
-		return
-	}
-
 	if req.GameID == "" {
 		req.GameID = "global"
 	}
 
-	leaderboardKey := fmt.Sprintf("leaderboard:%s", req.GameID)
-
-	err = storage.RedisClient.ZAdd(storage.RedisCtx, leaderboardKey, redis.Z{
-		Score:  float64(req.Score),
-		Member: claims.Username,
-	}).Err()
+	game, ok := requireGame(w, req.GameID)
+	if !ok {
+		return
+	}
+	if game.Archived() {
+		http.Error(w, "Game is archived", http.StatusConflict)
+		return
+	}
+	if game.Rated() {
+		http.Error(w, fmt.Sprintf("Game %q is rated from match results; submit them to /matches", game.GameID), http.StatusBadRequest)
+		return
+	}
+	if err := validateScore(game, req.Score); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	// The submission is stored with its outbox row before Redis is touched,
+	// so it reaches the board even if Redis is down right now.
+	submissionID, err := enqueueSubmission(req.GameID, claims.Username, req.Score, time.Now())
 	if err != nil {
 		http.Error(w, "Failed to submit score", http.StatusInternalServerError)
 		return
 	}
 
-	userDbKey := fmt.Sprintf("user:%s:games", claims.Username)
-	storage.RedisClient.SAdd(storage.RedisCtx, userDbKey, req.GameID)
-
-	pgQuery := "INSERT INTO leaderboard (username, score) VALUES ($1, $2)"
-	storage.DB.Exec(pgQuery, claims.Username, req.Score)
-
-	rank, _ := storage.RedisClient.ZRevRank(storage.RedisCtx, leaderboardKey, claims.Username).Result()
+	w.Header().Set("Content-Type", "application/json")
 
-	results, _ := storage.RedisClient.ZRevRangeWithScores(storage.RedisCtx, leaderboardKey, 0, 9).Result()
-	var leaderboard []models.LeaderboardEntry
-	for i, result := range results {
-		entry := models.LeaderboardEntry{
-			Username: result.Member.(string),
-			Score:    result.Score,
-			Rank:     int64(i + 1),
-		}
-		leaderboard = append(leaderboard, entry)
+	result := deliverNow(submissionID)
+	if result == nil {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":       "Score accepted",
+			"submission_id": submissionID,
+			"status":        submissionPending,
+		})
+		return
 	}
 
-	BroadcastLeaderboardUpdate(req.GameID, map[string]interface{}{
-		"type":        "leaderboard_update",
-		"game_id":     req.GameID,
-		"leaderboard": leaderboard,
-	})
-	
-	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "Score submitted successfully",
-		"rank":    rank + 1,
-		"score":   req.Score,
+		"message":           "Score submitted successfully",
+		"submission_id":     submissionID,
+		"status":            submissionApplied,
+		"rank":              result.Rank,
+		"score":             result.Score,
+		"leaderboard_score": result.LeaderboardScore,
+		"aggregation":       result.Aggregation,
+		"new_personal_best": result.NewPersonalBest,
+		"previous_best":     result.PreviousBest,
+		"previous_score":    result.PreviousScore,
+		"top_percent":       result.TopPercent,
+		"tier":              result.Tier,
 	})
 }
 
@@ -106,26 +99,68 @@ func GetLeaderboardRedis(w http.ResponseWriter, r *http.Request) {
 		gameID = "global"
 	}
 
-	leaderboardKey := fmt.Sprintf("leaderboard:%s", gameID)
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	window, err := parsePeriod(r, gameID)
+	if err != nil {
+		http.Error(w, "Invalid period. Use: all, day, week, month; period_start as YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
 
-	results, err := storage.RedisClient.ZRevRangeWithScores(storage.RedisCtx, leaderboardKey, 0, 9).Result()
+	filter, err := parseRegionFilter(r)
 	if err != nil {
-		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		http.Error(w, "Invalid region filter. Use either country (ISO 3166-1 alpha-2) or region", http.StatusBadRequest)
+		return
+	}
+	if !filter.global() && window.Period != periodAll {
+		http.Error(w, "Regional leaderboards are only kept for period=all", http.StatusBadRequest)
 		return
 	}
 
-	var leaderboard []models.LeaderboardEntry
-	for i, result := range results {
-		entry := models.LeaderboardEntry{
-			Username: result.Member.(string),
-			Score:    result.Score,
-			Rank:     int64(i + 1),
-		}
-		leaderboard = append(leaderboard, entry)
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	// Period and regional boards get their own cursors, so a cursor from one
+	// board is rejected by another.
+	board, key := game, window.Key
+	if window.Period != periodAll {
+		board.GameID = window.Key
+	} else if !filter.global() {
+		key = regionalBoardKey(game.GameID, filter)
+		board.GameID = key
+	}
+	page, err := boardPage(r, board, key, rankMode)
+	if err == errInvalidPage {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	} else if err == errInvalidCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+	page.GameID = game.GameID
+	if window.Period != periodAll {
+		page.Period = window.Period
+		page.PeriodStart = &window.Start
+		page.PeriodEnd = &window.End
+	}
+	switch filter.Scope {
+	case scopeCountry:
+		page.Country = filter.Code
+	case scopeRegion:
+		page.Region = filter.Code
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(leaderboard)
+	json.NewEncoder(w).Encode(page)
 }
 
 func GetUserRank(w http.ResponseWriter, r *http.Request) {
@@ -134,21 +169,8 @@ func GetUserRank(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		http.Error(w, "Authorization required", http.StatusUnauthorized)
-		return
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	claims := &models.Claims{}
-
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return models.JwtKey, nil
-	})
-
-	if err != nil || !token.Valid {
-		http.Error(w, "Invalid token", http.StatusUnauthorized)
+	claims, ok := requireUser(w, r)
+	if !ok {
 		return
 	}
 
@@ -157,27 +179,267 @@ func GetUserRank(w http.ResponseWriter, r *http.Request) {
 		gameID = "global"
 	}
 
-	leaderboardKey := fmt.Sprintf("leaderboard:%s", gameID)
+	leaderboardKey := gameBoardKey(gameID)
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
 
-	rank, err := storage.RedisClient.ZRevRank(storage.RedisCtx, leaderboardKey, claims.Username).Result()
+	filter, err := parseRegionFilter(r)
 	if err != nil {
+		http.Error(w, "Invalid region filter. Use either country (ISO 3166-1 alpha-2) or region", http.StatusBadRequest)
+		return
+	}
+
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+	position, score, err := boardPosition(game, leaderboardKey, claims.Username)
+	if err == redis.Nil {
 		http.Error(w, "User not found in leaderboard", http.StatusNotFound)
 		return
+	} else if err != nil {
+		http.Error(w, "Failed to get rank", http.StatusInternalServerError)
+		return
 	}
 
-	score, err := storage.RedisClient.ZScore(storage.RedisCtx, leaderboardKey, claims.Username).Result()
+	rank, err := scoreRank(game, leaderboardKey, rankMode, position, score)
 	if err != nil {
-		http.Error(w, "Failed to get score", http.StatusInternalServerError)
+		http.Error(w, "Failed to get rank", http.StatusInternalServerError)
 		return
 	}
 
 	total, _ := storage.RedisClient.ZCard(storage.RedisCtx, leaderboardKey).Result()
 
+	percent, tier, err := placement(game, leaderboardKey, score, total)
+	if err != nil {
+		http.Error(w, "Failed to get rank", http.StatusInternalServerError)
+		return
+	}
+
+	// Without a filter the player is ranked in their own country and region.
+	filters := []regionFilter{filter}
+	if filter.global() {
+		country, region, err := userProfile(claims.Username)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Failed to get rank", http.StatusInternalServerError)
+			return
+		}
+		filters = profileFilters(country, region)
+	}
+	regional := []*regionalRank{}
+	for _, f := range filters {
+		rr, err := regionalRankOf(game, f, claims.Username, rankMode)
+		if err == redis.Nil && filter.global() {
+			continue
+		} else if err == redis.Nil {
+			http.Error(w, "User not found in that regional leaderboard", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get rank", http.StatusInternalServerError)
+			return
+		}
+		regional = append(regional, rr)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"username":      claims.Username,
-		"rank":          rank + 1,
+		"rank":          rank,
+		"rank_mode":     rankMode,
 		"score":         score,
 		"total_players": total,
+		"top_percent":   percent,
+		"tier":          tier,
+		"regional":      regional,
 	})
 }
+
+const (
+	defaultAroundSize = 5
+	maxAroundSize     = 50
+)
+
+// parseAroundSize reads how many players to show on each side of the user
+// from the query parameter name, defaulting to 5.
+func parseAroundSize(r *http.Request, name string) (int64, bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultAroundSize, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 1 || n > maxAroundSize {
+		return 0, false
+	}
+	return n, true
+}
+
+// GetAroundMe returns the players ranked just above and below the caller.
+func GetAroundMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	n, ok := parseAroundSize(r, "n")
+	if !ok {
+		http.Error(w, "Invalid n. Use a number between 1 and 50", http.StatusBadRequest)
+		return
+	}
+
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	payload, err := aroundPayload(game, rankMode, claims.Username, n)
+	if err == redis.Nil {
+		http.Error(w, "User not found in leaderboard", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payload)
+}
+
+// aroundPayload is the /leaderboard/around response and the matching
+// WebSocket message.
+func aroundPayload(game models.Game, rankMode, username string, n int64) (map[string]interface{}, error) {
+	key := gameBoardKey(game.GameID)
+	total, err := storage.RedisClient.ZCard(storage.RedisCtx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := aroundBoard(game, key, rankMode, username, n, total)
+	if err != nil {
+		return nil, err
+	}
+
+	var me models.LeaderboardEntry
+	for _, entry := range entries {
+		if entry.Username == username {
+			me = entry
+		}
+	}
+
+	return map[string]interface{}{
+		"game_id":       game.GameID,
+		"rank_mode":     rankMode,
+		"username":      username,
+		"rank":          me.Rank,
+		"score":         me.Score,
+		"top_percent":   me.TopPercent,
+		"tier":          me.Tier,
+		"total_players": total,
+		"leaderboard":   entries,
+	}, nil
+}
+
+// broadcastTopBoard pushes the game's top 10 to WebSocket subscribers, ranked
+// under each rank mode that currently has subscribers. "Around me"
+// subscribers get their windows from RunAroundBroadcaster.
+func broadcastTopBoard(game models.Game, key string) {
+	if GlobalHub.HasSubscribers(aroundTopic(game.GameID)) {
+		markAroundDirty(game)
+	}
+	broadcastTop(game, key, game.GameID, nil)
+}
+
+// aroundBroadcastInterval is how often "around me" subscribers of a game with
+// new scores are sent their windows, however many scores arrived meanwhile.
+const aroundBroadcastInterval = time.Second
+
+// aroundDirty holds the games whose boards changed since the last around
+// broadcast.
+var aroundDirty = struct {
+	sync.Mutex
+	games map[string]models.Game
+}{games: make(map[string]models.Game)}
+
+// markAroundDirty schedules the game's around windows for the next broadcast.
+func markAroundDirty(game models.Game) {
+	aroundDirty.Lock()
+	defer aroundDirty.Unlock()
+	aroundDirty.games[game.GameID] = game
+}
+
+// takeAroundDirty returns the games marked since the last call and clears
+// them.
+func takeAroundDirty() map[string]models.Game {
+	aroundDirty.Lock()
+	defer aroundDirty.Unlock()
+	games := aroundDirty.games
+	aroundDirty.games = make(map[string]models.Game)
+	return games
+}
+
+// RunAroundBroadcaster sends "around me" subscribers their windows, at most
+// once per aroundBroadcastInterval and game, off the score delivery path.
+func RunAroundBroadcaster() {
+	ticker := time.NewTicker(aroundBroadcastInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, game := range takeAroundDirty() {
+			for _, client := range GlobalHub.subscribers(aroundTopic(game.GameID)) {
+				sendAroundWindow(game, client)
+			}
+		}
+	}
+}
+
+// broadcastTop pushes the top 10 of a board to the subscribers of each rank
+// mode topic of base. fields are added to every message.
+func broadcastTop(game models.Game, key, base string, fields map[string]interface{}) {
+	leaderboard, err := rangeBoard(game, key, 0, 9)
+	if err != nil {
+		return
+	}
+	if err := placeEntries(game, key, leaderboard); err != nil {
+		return
+	}
+
+	for _, mode := range models.RankModes {
+		topic := leaderboardTopic(base, mode)
+		if !GlobalHub.HasSubscribers(topic) {
+			continue
+		}
+
+		ranked := append([]models.LeaderboardEntry(nil), leaderboard...)
+		if err := rankBoard(game, key, mode, ranked); err != nil {
+			continue
+		}
+		message := map[string]interface{}{
+			"type":        "leaderboard_update",
+			"game_id":     game.GameID,
+			"rank_mode":   mode,
+			"leaderboard": ranked,
+		}
+		for name, value := range fields {
+			message[name] = value
+		}
+		BroadcastLeaderboardUpdate(topic, message)
+	}
+}
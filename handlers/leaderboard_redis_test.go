@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"testing"
+)
+
+func TestAroundDirtyCoalesces(t *testing.T) {
+	takeAroundDirty()
+	first := models.Game{GameID: "game1"}
+	for i := 0; i < 3; i++ {
+		markAroundDirty(first)
+	}
+	markAroundDirty(models.Game{GameID: "game2"})
+
+	games := takeAroundDirty()
+	if len(games) != 2 {
+		t.Fatalf("takeAroundDirty() = %d games, want 2", len(games))
+	}
+	if _, ok := games["game1"]; !ok {
+		t.Errorf("game1 not marked")
+	}
+	if games := takeAroundDirty(); len(games) != 0 {
+		t.Errorf("second takeAroundDirty() = %d games, want 0", len(games))
+	}
+}
@@ -4,10 +4,8 @@ import (
 	"Leaderboard/models"
 	"Leaderboard/storage"
 	"encoding/json"
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"net/http"
-	"time"
 )
 
 func Login(w http.ResponseWriter, r *http.Request) {
@@ -42,20 +40,10 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid password", http.StatusBadRequest)
 		return
 	}
-	expTime := (time.Now().Add(24 * time.Hour))
-
-	claims := &models.Claims{
-		UserID:   userfound.UserId,
-		Username: userfound.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expTime),
-		},
-	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(models.JwtKey)
+	tokenString, err := issueToken(*userfound, "", accessTokenTTL)
 	if err != nil {
 		http.Error(w, "Could not create token", http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
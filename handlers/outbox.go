@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	outboxPollInterval = 500 * time.Millisecond
+	outboxBatchSize    = 100
+	outboxMaxBackoff   = time.Minute
+	// outboxClaimLease is how long a claimed row is left to the instance
+	// delivering it.
+	outboxClaimLease = 30 * time.Second
+)
+
+const (
+	submissionPending = "pending"
+	submissionApplied = "applied"
+)
+
+// submissionResult is what applying a submission to its board produced. It
+// is returned by /score and stored on the outbox row for /score/status.
+type submissionResult struct {
+	Rank             int64    `json:"rank"`
+	Score            int      `json:"score"`
+	LeaderboardScore float64  `json:"leaderboard_score"`
+	Aggregation      string   `json:"aggregation"`
+	NewPersonalBest  bool     `json:"new_personal_best"`
+	PreviousBest     *float64 `json:"previous_best"`
+	PreviousScore    *float64 `json:"previous_score"`
+	TopPercent       float64  `json:"top_percent"`
+	Tier             string   `json:"tier,omitempty"`
+}
+
+type pendingSubmission struct {
+	HistoryID   int64
+	GameID      string
+	Username    string
+	Score       int
+	SubmittedAt time.Time
+	Attempts    int
+	// DeliveredBelow is a history ID below which every outbox row was
+	// marked delivered when this one was claimed.
+	DeliveredBelow int64
+}
+
+// enqueueSubmission records a submission in the score history together with
+// its outbox row, in one transaction, and returns the submission ID.
+func enqueueSubmission(gameID, username string, score int, submittedAt time.Time) (int64, error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var historyID int64
+	err = tx.QueryRow(
+		"INSERT INTO leaderboard (game_id, username, score, submitted_at) VALUES ($1, $2, $3, $4) RETURNING id",
+		gameID, username, score, submittedAt,
+	).Scan(&historyID)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO score_outbox (history_id) VALUES ($1)", historyID); err != nil {
+		return 0, err
+	}
+	return historyID, tx.Commit()
+}
+
+// deliverSubmission applies a submission to its Redis boards, all-time, per
+// period, tournament and team, and broadcasts the new top 10s. It is safe to
+// call again for the same submission.
+func deliverSubmission(sub pendingSubmission) (*submissionResult, error) {
+	game, err := lookupGame(sub.GameID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyTournamentScores(game, sub); err != nil {
+		return nil, err
+	}
+
+	// A submission delivered after its season ended only counts towards that
+	// season's archived standings, which are read from Postgres.
+	boundary, err := seasonBoundary(game.GameID)
+	if err != nil {
+		return nil, err
+	}
+	if sub.SubmittedAt.Before(boundary) {
+		return &submissionResult{Score: sub.Score, LeaderboardScore: float64(sub.Score), Aggregation: game.Aggregation}, nil
+	}
+
+	if err := applyPeriodScores(game, sub.Username, sub.Score, sub.SubmittedAt, sub.HistoryID, sub.DeliveredBelow); err != nil {
+		return nil, err
+	}
+
+	applied, err := applyScore(game, sub.Username, sub.Score, sub.SubmittedAt, sub.HistoryID, sub.DeliveredBelow)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := applyTeamScores(game, sub); err != nil {
+		return nil, err
+	}
+
+	if err := syncPlayerRegions(game, sub.Username); err != nil {
+		return nil, err
+	}
+
+	userDbKey := fmt.Sprintf("user:%s:games", sub.Username)
+	if err := storage.RedisClient.SAdd(storage.RedisCtx, userDbKey, sub.GameID).Err(); err != nil {
+		return nil, err
+	}
+
+	key := gameBoardKey(game.GameID)
+	position, _, err := boardPosition(game, key, sub.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcastTopBoard(game, key)
+	broadcastPeriodBoards(game, sub.SubmittedAt)
+
+	previous := applied.Previous
+	if applied.Duplicate {
+		previous = &applied.Value
+	}
+	tier, percent := announceTierChange(game, key, sub.Username, previous, applied.Value)
+
+	if !applied.Duplicate {
+		if err := updateComposites(game, sub.Username, applied.Value); err != nil {
+			// The periodic refresh rebuilds composite boards from the game
+			// boards, so this submission is not lost to them.
+			log.Printf("Failed to update composite boards for %s: %v", game.GameID, err)
+		}
+	}
+
+	return &submissionResult{
+		Rank:             position + 1,
+		Score:            sub.Score,
+		LeaderboardScore: applied.Value,
+		Aggregation:      game.Aggregation,
+		NewPersonalBest:  applied.NewBest,
+		PreviousBest:     applied.PreviousBest,
+		PreviousScore:    applied.Previous,
+		TopPercent:       percent,
+		Tier:             tier,
+	}, nil
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 6 {
+		return outboxMaxBackoff
+	}
+	backoff := time.Second << attempts
+	if backoff > outboxMaxBackoff {
+		return outboxMaxBackoff
+	}
+	return backoff
+}
+
+// claimOutbox claims up to limit due outbox rows matching where by pushing
+// their next attempt past the delivery lease, in a short transaction that
+// skips rows other instances are claiming. A row whose delivery dies with
+// its process is claimed again once the lease runs out.
+func claimOutbox(where string, limit int, args ...interface{}) ([]pendingSubmission, error) {
+	filter := ""
+	if where != "" {
+		filter = " AND " + where
+	}
+	rows, err := storage.DB.Query(`
+        UPDATE score_outbox
+        SET next_attempt_at = CURRENT_TIMESTAMP + `+strconv.FormatInt(outboxClaimLease.Milliseconds(), 10)+` * INTERVAL '1 millisecond'
+        FROM leaderboard l
+        WHERE l.id = score_outbox.history_id AND score_outbox.history_id IN (
+            SELECT o.history_id
+            FROM score_outbox o
+            WHERE o.status = 'pending' AND o.next_attempt_at <= CURRENT_TIMESTAMP`+filter+`
+            ORDER BY o.history_id
+            LIMIT `+strconv.Itoa(limit)+`
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING score_outbox.history_id, l.game_id, l.username, l.score, l.submitted_at, score_outbox.attempts
+    `, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pending []pendingSubmission
+	for rows.Next() {
+		var sub pendingSubmission
+		if err := rows.Scan(&sub.HistoryID, &sub.GameID, &sub.Username, &sub.Score, &sub.SubmittedAt, &sub.Attempts); err != nil {
+			return nil, err
+		}
+		pending = append(pending, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Read after the claim, so it is no higher than any claimed row.
+	var deliveredBelow sql.NullInt64
+	err = storage.DB.QueryRow("SELECT MIN(history_id) FROM score_outbox WHERE status = 'pending'").Scan(&deliveredBelow)
+	if err != nil {
+		return nil, err
+	}
+	for i := range pending {
+		pending[i].DeliveredBelow = deliveredBelow.Int64
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].HistoryID < pending[j].HistoryID })
+	return pending, nil
+}
+
+// processOutbox claims up to limit due outbox rows matching where and
+// delivers them outside any transaction. Failed rows are rescheduled with
+// exponential backoff. It returns the number of rows claimed and the results
+// of those delivered.
+func processOutbox(where string, limit int, args ...interface{}) (int, map[int64]*submissionResult, error) {
+	pending, err := claimOutbox(where, limit, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	results := make(map[int64]*submissionResult)
+	for _, sub := range pending {
+		result, err := deliverSubmission(sub)
+		if err != nil {
+			_, err = storage.DB.Exec(`
+                UPDATE score_outbox
+                SET attempts = attempts + 1, last_error = $2,
+                    next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond'
+                WHERE history_id = $1 AND status = 'pending'
+            `, sub.HistoryID, err.Error(), outboxBackoff(sub.Attempts).Milliseconds())
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		payload, err := json.Marshal(result)
+		if err != nil {
+			return 0, nil, err
+		}
+		// If this fails the row is delivered again once its lease runs out;
+		// the board ignores submissions it has already applied.
+		_, err = storage.DB.Exec(`
+            UPDATE score_outbox
+            SET status = 'applied', attempts = attempts + 1, last_error = NULL,
+                result = $2, applied_at = CURRENT_TIMESTAMP
+            WHERE history_id = $1 AND status = 'pending'
+        `, sub.HistoryID, string(payload))
+		if err != nil {
+			return 0, nil, err
+		}
+		results[sub.HistoryID] = result
+	}
+	return len(pending), results, nil
+}
+
+// deliverNow tries to deliver a just-enqueued submission within the request.
+// It returns nil when the submission is left to the outbox worker.
+func deliverNow(historyID int64) *submissionResult {
+	_, results, err := processOutbox("o.history_id = $1", 1, historyID)
+	if err != nil {
+		log.Printf("Delivering submission %d failed, leaving it to the outbox worker: %v", historyID, err)
+		return nil
+	}
+	return results[historyID]
+}
+
+// RunOutboxWorker delivers pending submissions until the process exits.
+func RunOutboxWorker() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			claimed, _, err := processOutbox("", outboxBatchSize)
+			if err != nil {
+				log.Println("Outbox worker error:", err)
+				break
+			}
+			if claimed < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// GetSubmissionStatus reports whether a submission has reached the
+// leaderboard yet. Players can only look up their own submissions.
+func GetSubmissionStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	submissionID, err := strconv.ParseInt(r.URL.Query().Get("submission_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid submission_id", http.StatusBadRequest)
+		return
+	}
+
+	var status struct {
+		SubmissionID int64           `json:"submission_id"`
+		GameID       string          `json:"game_id"`
+		Score        int             `json:"score"`
+		SubmittedAt  time.Time       `json:"submitted_at"`
+		Status       string          `json:"status"`
+		Attempts     int             `json:"attempts"`
+		LastError    *string         `json:"last_error,omitempty"`
+		AppliedAt    *time.Time      `json:"applied_at,omitempty"`
+		Result       json.RawMessage `json:"result,omitempty"`
+	}
+	var username string
+	var lastError sql.NullString
+	var appliedAt sql.NullTime
+	var result []byte
+
+	err = storage.DB.QueryRow(`
+        SELECT l.id, l.game_id, l.username, l.score, l.submitted_at,
+            o.status, o.attempts, o.last_error, o.applied_at, o.result
+        FROM leaderboard l
+        JOIN score_outbox o ON o.history_id = l.id
+        WHERE l.id = $1
+    `, submissionID).Scan(&status.SubmissionID, &status.GameID, &username, &status.Score, &status.SubmittedAt,
+		&status.Status, &status.Attempts, &lastError, &appliedAt, &result)
+	if err == sql.ErrNoRows || (err == nil && username != claims.Username) {
+		http.Error(w, "Submission not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get submission", http.StatusInternalServerError)
+		return
+	}
+
+	if lastError.Valid {
+		status.LastError = &lastError.String
+	}
+	if appliedAt.Valid {
+		status.AppliedAt = &appliedAt.Time
+	}
+	status.Result = result
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
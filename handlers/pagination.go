@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageLimit = 10
+	maxPageLimit     = 100
+)
+
+var (
+	errInvalidPage   = errors.New("invalid offset or limit")
+	errInvalidCursor = errors.New("invalid cursor")
+)
+
+// LeaderboardPage is one page of a leaderboard. Next and Prev are links to
+// the neighbouring pages, omitted at either end.
+type LeaderboardPage struct {
+	GameID      string                    `json:"game_id"`
+	RankMode    string                    `json:"rank_mode"`
+	Period      string                    `json:"period,omitempty"`
+	PeriodStart *time.Time                `json:"period_start,omitempty"`
+	PeriodEnd   *time.Time                `json:"period_end,omitempty"`
+	Country     string                    `json:"country,omitempty"`
+	Region      string                    `json:"region,omitempty"`
+	Total       int64                     `json:"total"`
+	Offset      int64                     `json:"offset"`
+	Limit       int64                     `json:"limit"`
+	Entries     []models.LeaderboardEntry `json:"entries"`
+	NextCursor  string                    `json:"next_cursor,omitempty"`
+	PrevCursor  string                    `json:"prev_cursor,omitempty"`
+	Next        string                    `json:"next,omitempty"`
+	Prev        string                    `json:"prev,omitempty"`
+}
+
+// pageCursor anchors a page to a board entry rather than a position, so
+// paging is not thrown off by players moving between requests. A next cursor
+// starts after the entry, a prev cursor (Before) ends just before it.
+type pageCursor struct {
+	GameID string  `json:"g"`
+	Score  float64 `json:"s"`
+	Member string  `json:"m"`
+	Before bool    `json:"b,omitempty"`
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.GameID == "" || c.Member == "" {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+// parsePage reads the offset (default 0) and limit (default 10, at most 100)
+// query parameters.
+func parsePage(r *http.Request) (int64, int64, bool) {
+	offset, limit := int64(0), int64(defaultPageLimit)
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, false
+		}
+		limit = n
+	}
+	return offset, limit, true
+}
+
+// pageLink is the request URL with its paging parameters replaced by name
+// and value.
+func pageLink(r *http.Request, name, value string) string {
+	query := r.URL.Query()
+	query.Del("offset")
+	query.Del("cursor")
+	query.Set(name, value)
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// cursorOffset resolves a cursor to the offset of the page it points at.
+func cursorOffset(game models.Game, key string, c pageCursor, limit int64) (int64, error) {
+	ascending := 0
+	if game.Ascending() {
+		ascending = 1
+	}
+	reply, err := storage.BoardPositionScript.Run(storage.RedisCtx, storage.RedisClient, []string{key},
+		strconv.FormatFloat(c.Score, 'g', -1, 64), c.Member, ascending).Int64Slice()
+	if err != nil {
+		return 0, err
+	}
+	before, present := reply[0], reply[1]
+
+	if !c.Before {
+		return before + present, nil
+	}
+	if before < limit {
+		return 0, nil
+	}
+	return before - limit, nil
+}
+
+// boardPage reads the page of the game's board selected by the offset, limit
+// and cursor query parameters.
+func boardPage(r *http.Request, game models.Game, key, rankMode string) (*LeaderboardPage, error) {
+	offset, limit, ok := parsePage(r)
+	if !ok {
+		return nil, errInvalidPage
+	}
+
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil || c.GameID != game.GameID {
+			return nil, errInvalidCursor
+		}
+		if offset, err = cursorOffset(game, key, c, limit); err != nil {
+			return nil, err
+		}
+	}
+
+	total, err := storage.RedisClient.ZCard(storage.RedisCtx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := rangeMembers(game, key, offset, offset+limit-1)
+	if err != nil {
+		return nil, err
+	}
+	entries := boardEntries(game, results, offset)
+	if err := rankBoard(game, key, rankMode, entries); err != nil {
+		return nil, err
+	}
+	if err := placeEntries(game, key, entries); err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		entries = []models.LeaderboardEntry{}
+	}
+
+	page := &LeaderboardPage{
+		GameID:   game.GameID,
+		RankMode: rankMode,
+		Total:    total,
+		Offset:   offset,
+		Limit:    limit,
+		Entries:  entries,
+	}
+	if len(results) > 0 && offset+int64(len(results)) < total {
+		last := results[len(results)-1]
+		page.NextCursor = encodeCursor(pageCursor{GameID: game.GameID, Score: last.Score, Member: last.Member.(string)})
+		page.Next = pageLink(r, "cursor", page.NextCursor)
+	}
+	if len(results) > 0 && offset > 0 {
+		first := results[0]
+		page.PrevCursor = encodeCursor(pageCursor{GameID: game.GameID, Score: first.Score, Member: first.Member.(string), Before: true})
+		page.Prev = pageLink(r, "cursor", page.PrevCursor)
+	} else if offset > 0 {
+		// Past the end: link back to the last full page.
+		last := total - limit
+		if last < 0 {
+			last = 0
+		}
+		page.Prev = pageLink(r, "offset", strconv.FormatInt(last, 10))
+	}
+	return page, nil
+}
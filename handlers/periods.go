@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	periodAll   = "all"
+	periodDay   = "day"
+	periodWeek  = "week"
+	periodMonth = "month"
+)
+
+// boardPeriods are the calendar periods every game keeps a Redis board for,
+// next to its all-time board.
+var boardPeriods = []string{periodDay, periodWeek, periodMonth}
+
+// Period boundaries are calendar-aligned in periodLocation, with weeks
+// starting on periodWeekStart. Both are set from the configuration at startup.
+var (
+	periodLocation  = time.UTC
+	periodWeekStart = time.Monday
+)
+
+var errInvalidPeriod = errors.New("invalid period")
+
+// SetPeriodClock sets the timezone (an IANA name such as "Europe/Berlin") and
+// the first day of the week ("monday" ... "sunday") period boards use.
+func SetPeriodClock(timezone, weekStart string) error {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return err
+	}
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		if strings.EqualFold(day.String(), weekStart) {
+			periodLocation, periodWeekStart = loc, day
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown weekday %q", weekStart)
+}
+
+// periodStart returns the start of the period containing t.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.In(periodLocation)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, periodLocation)
+	switch period {
+	case periodWeek:
+		back := (int(day.Weekday()) - int(periodWeekStart) + 7) % 7
+		return day.AddDate(0, 0, -back)
+	case periodMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+// periodEnd returns the start of the period following the one at start.
+func periodEnd(period string, start time.Time) time.Time {
+	switch period {
+	case periodWeek:
+		return start.AddDate(0, 0, 7)
+	case periodMonth:
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+func periodLabel(period string, start time.Time) string {
+	if period == periodMonth {
+		return start.Format("2006-01")
+	}
+	return start.Format("2006-01-02")
+}
+
+// periodBoardKey is the board of a game for the period starting at start,
+// e.g. leaderboard:game1:week:2024-03-04.
+func periodBoardKey(gameID, period string, start time.Time) string {
+	return fmt.Sprintf("%s:%s:%s", gameBoardKey(gameID), period, periodLabel(period, start))
+}
+
+// periodExpiry is when the board of the period starting at start is dropped:
+// at the end of the following period, so the previous day, week or month can
+// still be read.
+func periodExpiry(period string, start time.Time) time.Time {
+	return periodEnd(period, periodEnd(period, start))
+}
+
+// applyPeriodScores folds a submission into the game's board for each
+// calendar period it falls in. Like applyScore it is safe to repeat.
+func applyPeriodScores(game models.Game, username string, score int, submittedAt time.Time, historyID, deliveredBelow int64) error {
+	var keys []string
+	args := scoreScriptArgs(game, username, score, submittedAt, historyID, deliveredBelow)
+	for _, period := range boardPeriods {
+		start := periodStart(period, submittedAt)
+		key := periodBoardKey(game.GameID, period, start)
+		rebuild := rebuildKeysFor(key)
+		keys = append(keys, boardScriptKeys(key)...)
+		keys = append(keys, rebuild.lock)
+		keys = append(keys, boardScriptKeys(rebuild.board)...)
+		args = append(args, periodExpiry(period, start).UnixMilli())
+	}
+	return storage.PeriodScoreScript.Run(storage.RedisCtx, storage.RedisClient, keys, args...).Err()
+}
+
+// rebuildPeriodBoards rebuilds the game's boards of the current and the
+// previous day, week and month, the ones still kept (see periodExpiry).
+func rebuildPeriodBoards(game models.Game) error {
+	now := time.Now()
+	for _, period := range boardPeriods {
+		current := periodStart(period, now)
+		for _, start := range []time.Time{periodStart(period, current.AddDate(0, 0, -1)), current} {
+			key := periodBoardKey(game.GameID, period, start)
+			if err := rebuildBoard(game, key, historyFilter{from: start, to: periodEnd(period, start)}); err != nil {
+				return err
+			}
+
+			// The rebuilt keys replaced the board without its expiry.
+			expiry := periodExpiry(period, start)
+			pipe := storage.RedisClient.Pipeline()
+			for _, k := range append(boardScriptKeys(key), rebuildKeysFor(key).status) {
+				pipe.PExpireAt(storage.RedisCtx, k, expiry)
+			}
+			if _, err := pipe.Exec(storage.RedisCtx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// boardWindow is the board a request reads: the all-time board or one
+// calendar period's.
+type boardWindow struct {
+	Period string
+	Start  time.Time
+	End    time.Time
+	Key    string
+}
+
+// parsePeriod reads the period (all, day, week, month) and period_start
+// (YYYY-MM-DD, any day in the period; default today) query parameters.
+func parsePeriod(r *http.Request, gameID string) (boardWindow, error) {
+	period := r.URL.Query().Get("period")
+	switch period {
+	case "", periodAll:
+		return boardWindow{Period: periodAll, Key: gameBoardKey(gameID)}, nil
+	case periodDay, periodWeek, periodMonth:
+	default:
+		return boardWindow{}, errInvalidPeriod
+	}
+
+	at := time.Now()
+	if v := r.URL.Query().Get("period_start"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, periodLocation)
+		if err != nil {
+			return boardWindow{}, errInvalidPeriod
+		}
+		at = t
+	}
+	start := periodStart(period, at)
+	return boardWindow{
+		Period: period,
+		Start:  start,
+		End:    periodEnd(period, start),
+		Key:    periodBoardKey(gameID, period, start),
+	}, nil
+}
+
+// periodTopic names the WebSocket subscriptions for a game's current period
+// board; leaderboardTopic adds the rank mode.
+func periodTopic(gameID, period string) string {
+	return gameID + "@" + period
+}
+
+// broadcastPeriodBoards pushes the top 10 of each current period board the
+// submission landed in to its subscribers. Late deliveries into a period
+// that has already ended are not broadcast.
+func broadcastPeriodBoards(game models.Game, submittedAt time.Time) {
+	now := time.Now()
+	for _, period := range boardPeriods {
+		start := periodStart(period, submittedAt)
+		if !start.Equal(periodStart(period, now)) {
+			continue
+		}
+		broadcastTop(game, periodBoardKey(game.GameID, period, start), periodTopic(game.GameID, period), map[string]interface{}{
+			"period":       period,
+			"period_start": start.Format(time.RFC3339),
+			"period_end":   periodEnd(period, start).Format(time.RFC3339),
+		})
+	}
+}
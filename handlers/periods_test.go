@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+// usePeriodClock sets the period timezone and week start for the duration of
+// the test.
+func usePeriodClock(t *testing.T, timezone, weekStart string) {
+	t.Helper()
+	loc, start := periodLocation, periodWeekStart
+	t.Cleanup(func() { periodLocation, periodWeekStart = loc, start })
+	if err := SetPeriodClock(timezone, weekStart); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeriodBoundaries(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("timezone data not available:", err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name      string
+		weekStart string
+		period    string
+		t         time.Time
+		start     time.Time
+		end       time.Time
+		length    time.Duration
+	}{
+		{
+			// Clocks go forward on 2024-03-31, so that day has 23 hours.
+			name: "day of DST start", weekStart: "monday", period: periodDay,
+			t: at("2024-03-31 12:00"), start: at("2024-03-31 00:00"), end: at("2024-04-01 00:00"),
+			length: 23 * time.Hour,
+		},
+		{
+			// Clocks go back on 2024-10-27, so that day has 25 hours.
+			name: "day of DST end", weekStart: "monday", period: periodDay,
+			t: at("2024-10-27 23:59"), start: at("2024-10-27 00:00"), end: at("2024-10-28 00:00"),
+			length: 25 * time.Hour,
+		},
+		{
+			name: "instant given in UTC", weekStart: "monday", period: periodDay,
+			t:     time.Date(2024, 3, 30, 23, 30, 0, 0, time.UTC),
+			start: at("2024-03-31 00:00"), end: at("2024-04-01 00:00"),
+			length: 23 * time.Hour,
+		},
+		{
+			name: "week starting monday across DST", weekStart: "monday", period: periodWeek,
+			t: at("2024-03-31 12:00"), start: at("2024-03-25 00:00"), end: at("2024-04-01 00:00"),
+			length: 7*24*time.Hour - time.Hour,
+		},
+		{
+			name: "week starting sunday on its first day", weekStart: "sunday", period: periodWeek,
+			t: at("2024-03-31 00:00"), start: at("2024-03-31 00:00"), end: at("2024-04-07 00:00"),
+			length: 7*24*time.Hour - time.Hour,
+		},
+		{
+			name: "week starting sunday on its last day", weekStart: "sunday", period: periodWeek,
+			t: at("2024-03-30 23:59"), start: at("2024-03-24 00:00"), end: at("2024-03-31 00:00"),
+			length: 7 * 24 * time.Hour,
+		},
+		{
+			name: "week starting saturday", weekStart: "saturday", period: periodWeek,
+			t: at("2024-10-28 09:00"), start: at("2024-10-26 00:00"), end: at("2024-11-02 00:00"),
+			length: 7*24*time.Hour + time.Hour,
+		},
+		{
+			name: "month across DST end", weekStart: "monday", period: periodMonth,
+			t: at("2024-10-31 23:00"), start: at("2024-10-01 00:00"), end: at("2024-11-01 00:00"),
+			length: 31*24*time.Hour + time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usePeriodClock(t, "Europe/Berlin", tt.weekStart)
+			start := periodStart(tt.period, tt.t)
+			if !start.Equal(tt.start) {
+				t.Fatalf("periodStart = %v, want %v", start, tt.start)
+			}
+			end := periodEnd(tt.period, start)
+			if !end.Equal(tt.end) {
+				t.Errorf("periodEnd = %v, want %v", end, tt.end)
+			}
+			if got := end.Sub(start); got != tt.length {
+				t.Errorf("period length = %v, want %v", got, tt.length)
+			}
+		})
+	}
+}
@@ -0,0 +1,564 @@
+package handlers
+
+import (
+	"Leaderboard/config"
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Glicko-2 system constants. glickoScale converts between the Glicko rating
+// scale and the internal Glicko-2 one, and glickoTau limits how quickly
+// volatility changes.
+const (
+	glickoScale     = 173.7178
+	glickoTau       = 0.5
+	glickoTolerance = 0.000001
+)
+
+const maxMatchParticipants = 64
+
+// glicko is a rating on the Glicko scale (1500 centred).
+type glicko struct {
+	rating, deviation, volatility float64
+}
+
+func glickoG(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func glickoE(mu, muj, phij float64) float64 {
+	return 1 / (1 + math.Exp(-glickoG(phij)*(mu-muj)))
+}
+
+// glickoVolatility finds the new volatility with the Illinois algorithm
+// (step 5 of Glickman's Glicko-2 description).
+func glickoVolatility(sigma, phi, v, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2*d*d) - (x-a)/(glickoTau*glickoTau)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*glickoTau) < 0 {
+			k++
+		}
+		B = a - k*glickoTau
+	}
+
+	fA, fB := f(A), f(B)
+	for math.Abs(B-A) > glickoTolerance {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A, fA = B, fB
+		} else {
+			fA /= 2
+		}
+		B, fB = C, fC
+	}
+	return math.Exp(A / 2)
+}
+
+// rate returns the player's rating after one rating period against the
+// given opponents, where scores[i] is 1 for a win against opponents[i], 0.5
+// for a draw and 0 for a loss.
+func (p glicko) rate(opponents []glicko, scores []float64) glicko {
+	mu := (p.rating - models.DefaultRating) / glickoScale
+	phi := p.deviation / glickoScale
+
+	var vInv, improvement float64
+	for i, o := range opponents {
+		muj := (o.rating - models.DefaultRating) / glickoScale
+		phij := o.deviation / glickoScale
+		g, e := glickoG(phij), glickoE(mu, muj, phij)
+		vInv += g * g * e * (1 - e)
+		improvement += g * (scores[i] - e)
+	}
+	if vInv == 0 {
+		return p
+	}
+	v := 1 / vInv
+
+	sigma := glickoVolatility(p.volatility, phi, v, v*improvement)
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phiNew := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	muNew := mu + phiNew*phiNew*improvement
+
+	return glicko{
+		rating:     muNew*glickoScale + models.DefaultRating,
+		deviation:  phiNew * glickoScale,
+		volatility: sigma,
+	}
+}
+
+// idle returns the rating after sitting out periods rating periods: the
+// deviation grows by the volatility for each (step 6 of Glickman's
+// description applied to a player who did not compete), up to that of a new
+// player.
+func (p glicko) idle(periods int) glicko {
+	if periods <= 0 {
+		return p
+	}
+	phi := p.deviation / glickoScale
+	phi = math.Sqrt(phi*phi + float64(periods)*p.volatility*p.volatility)
+	p.deviation = math.Min(phi*glickoScale, models.DefaultDeviation)
+	return p
+}
+
+// ratingPeriod is the length of a rating period, RATING_PERIOD.
+func ratingPeriod() time.Duration {
+	period, err := time.ParseDuration(config.LoadConfig().RatingPeriod)
+	if err != nil || period <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return period
+}
+
+// currentRating is a stored rating last updated at updatedAt as of now, with
+// the deviation raised for every full rating period since.
+func currentRating(g glicko, updatedAt, now time.Time) glicko {
+	return g.idle(int(now.Sub(updatedAt) / ratingPeriod()))
+}
+
+// rateMatch rates every participant of a match as one rating period in
+// which they played each other participant: beating those placed below,
+// losing to those placed above and drawing with those placed alike. All
+// pairings use the ratings from before the match.
+func rateMatch(participants []models.MatchParticipant, before []glicko) []glicko {
+	after := make([]glicko, len(participants))
+	for i, p := range participants {
+		var opponents []glicko
+		var scores []float64
+		for j, o := range participants {
+			if i == j {
+				continue
+			}
+			score := 0.5
+			if p.Placement < o.Placement {
+				score = 1
+			} else if p.Placement > o.Placement {
+				score = 0
+			}
+			opponents = append(opponents, before[j])
+			scores = append(scores, score)
+		}
+		after[i] = before[i].rate(opponents, scores)
+	}
+	return after
+}
+
+// ratingStandingsQuery selects the stored ratings of a game in the column
+// order of aggregateHistoryQuery, so rated boards can be checked like any
+// other.
+const ratingStandingsQuery = `
+    SELECT game_id, username, rating, updated_at, matches
+    FROM player_ratings
+    WHERE game_id = $1`
+
+// seasonRatingsQuery selects the rating each player of a rated game ($1)
+// held after their last match played between $2 and $3. Ratings carry over
+// between seasons, so only the players who played are ranked.
+const seasonRatingsQuery = `
+    SELECT DISTINCT ON (p.username) p.username, p.rating_after AS aggregate_score
+    FROM match_participants p
+    JOIN matches m ON m.match_id = p.match_id
+    WHERE m.game_id = $1 AND m.played_at >= $2 AND m.played_at < $3
+    ORDER BY p.username, m.match_id DESC`
+
+// setRating puts a player's rating on the game's board.
+func setRating(game models.Game, rating models.PlayerRating) error {
+	key := gameBoardKey(game.GameID)
+	rebuild := rebuildKeysFor(key)
+	keys := append(boardScriptKeys(key), rebuild.lock)
+	keys = append(keys, boardScriptKeys(rebuild.board)...)
+	return storage.SetRatingScript.Run(storage.RedisCtx, storage.RedisClient, keys,
+		rating.Username, rating.Rating, rating.Matches).Err()
+}
+
+// recordMatch rates a match and stores it with the new ratings in one
+// transaction. Matches are rated in the order they are recorded.
+func recordMatch(game models.Game, match *models.Match) ([]models.PlayerRating, error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Rows are locked in username order so concurrent matches sharing
+	// players cannot deadlock.
+	sort.Slice(match.Participants, func(i, j int) bool {
+		return match.Participants[i].Username < match.Participants[j].Username
+	})
+	usernames := make([]string, len(match.Participants))
+	for i, p := range match.Participants {
+		usernames[i] = p.Username
+		_, err := tx.Exec(`
+            INSERT INTO player_ratings (game_id, username, rating, deviation, volatility)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT (game_id, username) DO NOTHING
+        `, game.GameID, p.Username, models.DefaultRating, models.DefaultDeviation, models.DefaultVolatility)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := tx.Query(`
+        SELECT username, rating, deviation, volatility, matches, updated_at
+        FROM player_ratings
+        WHERE game_id = $1 AND username = ANY($2)
+        ORDER BY username
+        FOR UPDATE
+    `, game.GameID, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	stored := make(map[string]glicko, len(match.Participants))
+	played := make(map[string]int, len(match.Participants))
+	for rows.Next() {
+		var username string
+		var g glicko
+		var n int
+		var updatedAt time.Time
+		if err := rows.Scan(&username, &g.rating, &g.deviation, &g.volatility, &n, &updatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		stored[username], played[username] = currentRating(g, updatedAt, now), n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	before := make([]glicko, len(match.Participants))
+	for i, p := range match.Participants {
+		before[i] = stored[p.Username]
+	}
+	after := rateMatch(match.Participants, before)
+
+	err = tx.QueryRow(
+		"INSERT INTO matches (game_id, played_at) VALUES ($1, $2) RETURNING match_id, created_at",
+		game.GameID, match.PlayedAt,
+	).Scan(&match.MatchID, &match.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	ratings := make([]models.PlayerRating, len(match.Participants))
+	for i := range match.Participants {
+		p := &match.Participants[i]
+		p.RatingBefore, p.DeviationBefore, p.VolatilityBefore = before[i].rating, before[i].deviation, before[i].volatility
+		p.RatingAfter, p.DeviationAfter, p.VolatilityAfter = after[i].rating, after[i].deviation, after[i].volatility
+
+		_, err := tx.Exec(`
+            UPDATE player_ratings
+            SET rating = $3, deviation = $4, volatility = $5, matches = matches + 1, updated_at = $6
+            WHERE game_id = $1 AND username = $2
+        `, game.GameID, p.Username, p.RatingAfter, p.DeviationAfter, p.VolatilityAfter, now)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+            INSERT INTO match_participants (match_id, username, placement, rating_before, rating_after,
+                deviation_before, deviation_after, volatility_before, volatility_after)
+            VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        `, match.MatchID, p.Username, p.Placement, p.RatingBefore, p.RatingAfter,
+			p.DeviationBefore, p.DeviationAfter, p.VolatilityBefore, p.VolatilityAfter)
+		if err != nil {
+			return nil, err
+		}
+
+		ratings[i] = models.PlayerRating{
+			GameID:     game.GameID,
+			Username:   p.Username,
+			Rating:     p.RatingAfter,
+			Deviation:  p.DeviationAfter,
+			Volatility: p.VolatilityAfter,
+			Matches:    played[p.Username] + 1,
+			UpdatedAt:  now,
+		}
+	}
+
+	sort.Slice(match.Participants, func(i, j int) bool {
+		a, b := match.Participants[i], match.Participants[j]
+		return a.Placement < b.Placement || (a.Placement == b.Placement && a.Username < b.Username)
+	})
+	return ratings, tx.Commit()
+}
+
+// publishRatings puts a recorded match's ratings on the game's board and
+// broadcasts the changes like a score submission would. A rating that cannot
+// be put on the board is logged and skipped; the others are still published.
+func publishRatings(game models.Game, match models.Match, ratings []models.PlayerRating) {
+	key := gameBoardKey(game.GameID)
+	published := ratings[:0:0]
+	for _, rating := range ratings {
+		if err := setRating(game, rating); err != nil {
+			// Postgres holds the rating; the reconciler or a rebuild puts it
+			// back on the board.
+			log.Printf("Failed to put rating of %s on %s after match %d: %v", rating.Username, key, match.MatchID, err)
+			continue
+		}
+		published = append(published, rating)
+		storage.RedisClient.SAdd(storage.RedisCtx, fmt.Sprintf("user:%s:games", rating.Username), game.GameID)
+		if err := syncPlayerRegions(game, rating.Username); err != nil {
+			log.Printf("Failed to put rating of %s on the regional boards of %s: %v", rating.Username, game.GameID, err)
+		}
+	}
+
+	broadcastTopBoard(game, key)
+	before := make(map[string]float64, len(match.Participants))
+	for _, p := range match.Participants {
+		before[p.Username] = p.RatingBefore
+	}
+	for _, rating := range published {
+		// A player's first match puts them on the board.
+		var previous *float64
+		if rating.Matches > 1 {
+			value := before[rating.Username]
+			previous = &value
+		}
+		announceTierChange(game, key, rating.Username, previous, rating.Rating)
+		if err := updateComposites(game, rating.Username, rating.Rating); err != nil {
+			log.Printf("Failed to update composite boards for %s: %v", game.GameID, err)
+		}
+	}
+}
+
+// MatchesHandler serves match history (GET) and records match results
+// (POST).
+func MatchesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListMatches(w, r)
+	case http.MethodPost:
+		SubmitMatch(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SubmitMatch records the result of a match in a rated game and updates the
+// participants' ratings. Results are reported by trusted game servers, so
+// an admin token is required.
+func SubmitMatch(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var match models.Match
+	if err := json.NewDecoder(r.Body).Decode(&match); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if match.GameID == "" {
+		match.GameID = "global"
+	}
+
+	game, ok := requireGame(w, match.GameID)
+	if !ok {
+		return
+	}
+	if !game.Rated() {
+		http.Error(w, fmt.Sprintf("Game %q is not rated; submit scores to /score", game.GameID), http.StatusBadRequest)
+		return
+	}
+	if game.Archived() {
+		http.Error(w, "Game is archived", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	if match.PlayedAt.IsZero() {
+		match.PlayedAt = now
+	} else if match.PlayedAt.After(now) {
+		http.Error(w, "played_at must not be in the future", http.StatusBadRequest)
+		return
+	}
+
+	if len(match.Participants) < 2 || len(match.Participants) > maxMatchParticipants {
+		http.Error(w, fmt.Sprintf("A match needs 2 to %d participants", maxMatchParticipants), http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	usernames := make([]string, 0, len(match.Participants))
+	for _, p := range match.Participants {
+		if p.Username == "" || seen[p.Username] {
+			http.Error(w, "Every participant needs a unique username", http.StatusBadRequest)
+			return
+		}
+		if p.Placement < 1 {
+			http.Error(w, "Every participant needs a placement of at least 1", http.StatusBadRequest)
+			return
+		}
+		seen[p.Username] = true
+		usernames = append(usernames, p.Username)
+	}
+
+	rows, err := storage.DB.Query("SELECT username FROM users WHERE username = ANY($1)", pq.Array(usernames))
+	if err != nil {
+		http.Error(w, "Failed to record match", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err == nil {
+			delete(seen, username)
+		}
+	}
+	rows.Close()
+	for _, username := range usernames {
+		if seen[username] {
+			http.Error(w, fmt.Sprintf("User %q not found", username), http.StatusNotFound)
+			return
+		}
+	}
+
+	ratings, err := recordMatch(game, &match)
+	if err != nil {
+		http.Error(w, "Failed to record match", http.StatusInternalServerError)
+		return
+	}
+	publishRatings(game, match, ratings)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(match)
+}
+
+// ListMatches returns the match history of a game (?game_id=), newest
+// first, optionally only the matches of one player (?username=). It is
+// paged with offset and limit.
+func ListMatches(w http.ResponseWriter, r *http.Request) {
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	offset, limit, ok := parsePage(r)
+	if !ok {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	}
+
+	query := "SELECT m.match_id, m.game_id, m.played_at, m.created_at FROM matches m WHERE m.game_id = $1"
+	args := []interface{}{gameID, limit, offset}
+	if username := r.URL.Query().Get("username"); username != "" {
+		query += " AND EXISTS (SELECT 1 FROM match_participants p WHERE p.match_id = m.match_id AND p.username = $4)"
+		args = append(args, username)
+	}
+	rows, err := storage.DB.Query(query+" ORDER BY m.match_id DESC LIMIT $2 OFFSET $3", args...)
+	if err != nil {
+		http.Error(w, "Failed to list matches", http.StatusInternalServerError)
+		return
+	}
+	matches := []models.Match{}
+	index := make(map[int64]int)
+	var ids []int64
+	for rows.Next() {
+		var m models.Match
+		if err := rows.Scan(&m.MatchID, &m.GameID, &m.PlayedAt, &m.CreatedAt); err != nil {
+			rows.Close()
+			http.Error(w, "Failed to list matches", http.StatusInternalServerError)
+			return
+		}
+		m.Participants = []models.MatchParticipant{}
+		index[m.MatchID] = len(matches)
+		ids = append(ids, m.MatchID)
+		matches = append(matches, m)
+	}
+	rows.Close()
+
+	if len(ids) > 0 {
+		rows, err := storage.DB.Query(`
+            SELECT match_id, username, placement, rating_before, rating_after,
+                deviation_before, deviation_after, volatility_before, volatility_after
+            FROM match_participants
+            WHERE match_id = ANY($1)
+            ORDER BY match_id, placement, username
+        `, pq.Array(ids))
+		if err != nil {
+			http.Error(w, "Failed to list matches", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var p models.MatchParticipant
+			err := rows.Scan(&id, &p.Username, &p.Placement, &p.RatingBefore, &p.RatingAfter,
+				&p.DeviationBefore, &p.DeviationAfter, &p.VolatilityBefore, &p.VolatilityAfter)
+			if err != nil {
+				http.Error(w, "Failed to list matches", http.StatusInternalServerError)
+				return
+			}
+			m := &matches[index[id]]
+			m.Participants = append(m.Participants, p)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(matches)
+}
+
+// GetRating returns a player's (?username=) Glicko-2 rating in a rated game
+// (?game_id=). The rating is also their score on the game's leaderboard.
+func GetRating(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+	if !game.Rated() {
+		http.Error(w, fmt.Sprintf("Game %q is not rated", game.GameID), http.StatusBadRequest)
+		return
+	}
+
+	rating := models.PlayerRating{GameID: game.GameID, Username: username}
+	err := storage.DB.QueryRow(`
+        SELECT rating, deviation, volatility, matches, updated_at
+        FROM player_ratings
+        WHERE game_id = $1 AND username = $2
+    `, game.GameID, username).Scan(&rating.Rating, &rating.Deviation, &rating.Volatility, &rating.Matches, &rating.UpdatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Player has no rating in this game", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get rating", http.StatusInternalServerError)
+		return
+	}
+	current := currentRating(glicko{rating.Rating, rating.Deviation, rating.Volatility}, rating.UpdatedAt, time.Now())
+	rating.Deviation = current.deviation
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rating)
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestGlickoRate(t *testing.T) {
+	tests := []struct {
+		name      string
+		player    glicko
+		opponents []glicko
+		scores    []float64
+		want      glicko
+	}{
+		{
+			// The worked example of Glickman's Glicko-2 description.
+			name:      "glickman example",
+			player:    glicko{1500, 200, 0.06},
+			opponents: []glicko{{1400, 30, 0.06}, {1550, 100, 0.06}, {1700, 300, 0.06}},
+			scores:    []float64{1, 0, 0},
+			want:      glicko{1464.06, 151.52, 0.05999},
+		},
+		{
+			name:      "draw between equals",
+			player:    glicko{1500, 350, 0.06},
+			opponents: []glicko{{1500, 350, 0.06}},
+			scores:    []float64{0.5},
+			want:      glicko{1500, 290.32, 0.06},
+		},
+		{
+			name:   "no games",
+			player: glicko{1620, 80, 0.05},
+			want:   glicko{1620, 80, 0.05},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.player.rate(tt.opponents, tt.scores)
+			if math.Abs(got.rating-tt.want.rating) > 0.05 ||
+				math.Abs(got.deviation-tt.want.deviation) > 0.05 ||
+				math.Abs(got.volatility-tt.want.volatility) > 0.00001 {
+				t.Errorf("rate() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateMatchPlacements(t *testing.T) {
+	participants := []models.MatchParticipant{
+		{Username: "alice", Placement: 1},
+		{Username: "bob", Placement: 2},
+		{Username: "carol", Placement: 2},
+	}
+	start := glicko{models.DefaultRating, 350, 0.06}
+	after := rateMatch(participants, []glicko{start, start, start})
+
+	if after[0].rating <= start.rating {
+		t.Errorf("winner rating = %v, want above %v", after[0].rating, start.rating)
+	}
+	if after[1].rating >= start.rating {
+		t.Errorf("loser rating = %v, want below %v", after[1].rating, start.rating)
+	}
+	if math.Abs(after[1].rating-after[2].rating) > 1e-9 {
+		t.Errorf("tied players rated %v and %v, want equal", after[1].rating, after[2].rating)
+	}
+}
+
+func TestCurrentRatingIdlePeriods(t *testing.T) {
+	updated := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	week := 7 * 24 * time.Hour
+	tests := []struct {
+		name   string
+		stored glicko
+		now    time.Time
+		want   float64
+	}{
+		{"within the period", glicko{1500, 200, 0.06}, updated.Add(week - time.Second), 200},
+		{"one idle period", glicko{1500, 200, 0.06}, updated.Add(week), 200.27},
+		{"ten idle periods", glicko{1500, 200, 0.06}, updated.Add(10*week + time.Hour), 202.70},
+		{"capped at a new player's", glicko{1500, 349, 0.06}, updated.Add(100 * week), models.DefaultDeviation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := currentRating(tt.stored, updated, tt.now)
+			if math.Abs(got.deviation-tt.want) > 0.005 {
+				t.Errorf("deviation = %v, want %v", got.deviation, tt.want)
+			}
+			if got.rating != tt.stored.rating || got.volatility != tt.stored.volatility {
+				t.Errorf("rating, volatility = %v, %v, want them unchanged", got.rating, got.volatility)
+			}
+		})
+	}
+}
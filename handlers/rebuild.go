@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	rebuildBatchSize = 1000
+	rebuildLockTTL   = time.Minute
+)
+
+var errRebuildRunning = errors.New("rebuild already running")
+
+// boardGamesQuery lists every game with a board to restore: those with score
+// history and rated games with ratings.
+const boardGamesQuery = "SELECT game_id FROM leaderboard UNION SELECT game_id FROM player_ratings"
+
+// rebuildKeys name the shadow board a rebuild writes into, the lock that
+// makes live submissions mirror into it and the progress hash.
+type rebuildKeys struct {
+	board  string
+	lock   string
+	status string
+}
+
+func rebuildKeysFor(key string) rebuildKeys {
+	board := "rebuild:" + key
+	return rebuildKeys{
+		board:  board,
+		lock:   board + ":lock",
+		status: board + ":status",
+	}
+}
+
+// RebuildBoard replays the game's Postgres history since the current season
+// began (see seasonBoundarySQL) into a shadow board in batches and then swaps
+// it in. Live submissions keep going to the current board and are mirrored
+// into the shadow while the rebuild runs, so /score is never blocked and no
+// submission is lost or counted twice. The board of a rated game is rebuilt
+// from the stored ratings instead, with recorded matches mirrored the same
+// way. The game's period, tournament and team boards are rebuilt afterwards.
+func RebuildBoard(game models.Game) error {
+	if err := rebuildBoard(game, gameBoardKey(game.GameID), historyFilter{}); err != nil {
+		return err
+	}
+	if err := rebuildRegionalBoards(game); err != nil {
+		return err
+	}
+	if game.Rated() {
+		return nil
+	}
+	if err := rebuildPeriodBoards(game); err != nil {
+		return err
+	}
+	if err := rebuildTournamentBoards(game); err != nil {
+		return err
+	}
+	return rebuildTeamBoards(game)
+}
+
+// historyFilter narrows the score history a board is rebuilt from. The zero
+// value replays the game's whole history since the current season began.
+type historyFilter struct {
+	// teamID keeps the submissions the team's current members made since
+	// joining.
+	teamID string
+	// tournamentID keeps the submissions of the tournament's players and
+	// those made before the current season began.
+	tournamentID string
+	// from and to, when set, keep the submissions made in between.
+	from, to time.Time
+}
+
+// where returns the SQL conditions of f on leaderboard l, whose game is $1,
+// numbering its placeholders after the n arguments the query already has,
+// and the arguments they take.
+func (f historyFilter) where(n int) (string, []interface{}) {
+	var conditions string
+	var args []interface{}
+	if f.tournamentID != "" {
+		args = append(args, f.tournamentID)
+		conditions += fmt.Sprintf(" AND l.username IN (SELECT username FROM tournament_players WHERE tournament_id = $%d)", n+len(args))
+	} else {
+		conditions += " AND l.submitted_at >= " + seasonBoundarySQL("$1")
+	}
+	if f.teamID != "" {
+		args = append(args, f.teamID)
+		conditions += " AND " + teamHistoryFilter(fmt.Sprintf("$%d", n+len(args)))
+	}
+	if !f.from.IsZero() {
+		args = append(args, f.from, f.to)
+		conditions += fmt.Sprintf(" AND l.submitted_at >= $%d AND l.submitted_at < $%d", n+len(args)-1, n+len(args))
+	}
+	return conditions, args
+}
+
+// rebuildBoard rebuilds the board at key from the game's history rows
+// matching filter.
+func rebuildBoard(game models.Game, key string, filter historyFilter) (err error) {
+	keys := rebuildKeysFor(key)
+	token := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	locked, err := storage.RedisClient.SetNX(storage.RedisCtx, keys.lock, token, rebuildLockTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return errRebuildRunning
+	}
+
+	defer func() {
+		if err == nil {
+			return
+		}
+		storage.ReleaseLockScript.Run(storage.RedisCtx, storage.RedisClient, []string{keys.lock}, token)
+		storage.RedisClient.Del(storage.RedisCtx, boardScriptKeys(keys.board)...)
+		storage.RedisClient.HSet(storage.RedisCtx, keys.status,
+			"state", "failed", "error", err.Error(), "finished_at", time.Now().Format(time.RFC3339))
+		log.Printf("Rebuild of %s failed: %v", key, err)
+	}()
+
+	// Clear anything left by an interrupted rebuild. Rows mirrored between
+	// taking the lock and this point are replayed from Postgres below.
+	if err = storage.RedisClient.Del(storage.RedisCtx, boardScriptKeys(keys.board)...).Err(); err != nil {
+		return err
+	}
+
+	var total int64
+	if game.Rated() {
+		err = storage.DB.QueryRow("SELECT COUNT(*) FROM player_ratings WHERE game_id = $1", game.GameID).Scan(&total)
+	} else {
+		conditions, args := filter.where(1)
+		err = storage.DB.QueryRow("SELECT COUNT(*) FROM leaderboard l WHERE l.game_id = $1"+conditions,
+			append([]interface{}{game.GameID}, args...)...).Scan(&total)
+	}
+	if err != nil {
+		return err
+	}
+	storage.RedisClient.HSet(storage.RedisCtx, keys.status,
+		"state", "running", "processed", 0, "total", total,
+		"started_at", time.Now().Format(time.RFC3339), "finished_at", "", "error", "")
+	log.Printf("Rebuilding %s from %d history rows", key, total)
+
+	var processed int64
+	if game.Rated() {
+		processed, err = replayRatings(game, key, keys, token, total)
+	} else {
+		processed, err = replayHistory(game, key, keys, token, total, filter)
+	}
+	if err != nil {
+		return err
+	}
+
+	swapKeys := append(boardScriptKeys(key), boardScriptKeys(keys.board)...)
+	swapKeys = append(swapKeys, keys.lock)
+	swapped, err := storage.SwapRebuiltBoardScript.Run(storage.RedisCtx, storage.RedisClient, swapKeys, token).Int()
+	if err != nil {
+		return err
+	}
+	if swapped == 0 {
+		return errors.New("rebuild lock lost")
+	}
+
+	storage.RedisClient.HSet(storage.RedisCtx, keys.status,
+		"state", "done", "finished_at", time.Now().Format(time.RFC3339))
+	log.Printf("Rebuilt %s from %d rows", key, processed)
+	return nil
+}
+
+// rebuildProgress extends the rebuild lock after a batch and records how far
+// the rebuild got.
+func rebuildProgress(key string, keys rebuildKeys, token string, processed, total int64) error {
+	refreshed, err := storage.RefreshLockScript.Run(storage.RedisCtx, storage.RedisClient,
+		[]string{keys.lock}, token, rebuildLockTTL.Milliseconds()).Int()
+	if err != nil {
+		return err
+	}
+	if refreshed == 0 {
+		return errors.New("rebuild lock lost")
+	}
+
+	storage.RedisClient.HSet(storage.RedisCtx, keys.status, "processed", processed)
+	log.Printf("Rebuilding %s: %d/%d rows", key, processed, total)
+	return nil
+}
+
+// replayHistory replays the game's score history matching filter into the
+// shadow board of key.
+func replayHistory(game models.Game, key string, keys rebuildKeys, token string, total int64, filter historyFilter) (int64, error) {
+	conditions, args := filter.where(3)
+	queryArgs := append([]interface{}{game.GameID, 0, rebuildBatchSize}, args...)
+
+	if err := storage.RebuildScoreScript.Load(storage.RedisCtx, storage.RedisClient).Err(); err != nil {
+		return 0, err
+	}
+
+	shadowKeys := boardScriptKeys(keys.board)
+	var lastID, processed int64
+	for {
+		// Every row is replayed, including those still waiting in the
+		// outbox: some of them may already be on the live board. The
+		// history IDs the shadow board records make the outbox's later
+		// delivery of the same rows a no-op. Delivered rows are never
+		// delivered again, so their IDs are not recorded.
+		queryArgs[1] = lastID
+		rows, err := storage.DB.Query(`
+            SELECT l.id, l.username, l.score, l.submitted_at, o.status IS NOT DISTINCT FROM 'pending'
+            FROM leaderboard l
+            LEFT JOIN score_outbox o ON o.history_id = l.id
+            WHERE l.game_id = $1 AND l.id > $2`+conditions+`
+            ORDER BY l.id
+            LIMIT $3
+        `, queryArgs...)
+		if err != nil {
+			return processed, err
+		}
+
+		n := 0
+		pipe := storage.RedisClient.Pipeline()
+		for rows.Next() {
+			var username string
+			var score int
+			var submittedAt time.Time
+			var pending bool
+			if err := rows.Scan(&lastID, &username, &score, &submittedAt, &pending); err != nil {
+				rows.Close()
+				return processed, err
+			}
+			historyID := int64(0)
+			if pending {
+				historyID = lastID
+			}
+			args := scoreScriptArgs(game, username, score, submittedAt, historyID, 0)
+			pipe.EvalSha(storage.RedisCtx, storage.RebuildScoreScript.Hash(), shadowKeys, args...)
+			pipe.SAdd(storage.RedisCtx, fmt.Sprintf("user:%s:games", username), game.GameID)
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return processed, err
+		}
+
+		if n > 0 {
+			if _, err := pipe.Exec(storage.RedisCtx); err != nil {
+				return processed, err
+			}
+		}
+		processed += int64(n)
+
+		if err := rebuildProgress(key, keys, token, processed, total); err != nil {
+			return processed, err
+		}
+
+		if n < rebuildBatchSize {
+			break
+		}
+	}
+	return processed, nil
+}
+
+// replayRatings copies a rated game's stored ratings into the shadow board.
+// Ratings from matches recorded meanwhile are mirrored into it and win over
+// the copied ones when newer.
+func replayRatings(game models.Game, key string, keys rebuildKeys, token string, total int64) (int64, error) {
+	if err := storage.RebuildRatingScript.Load(storage.RedisCtx, storage.RedisClient).Err(); err != nil {
+		return 0, err
+	}
+
+	shadowKeys := boardScriptKeys(keys.board)
+	var processed int64
+	lastUsername := ""
+	for {
+		rows, err := storage.DB.Query(`
+            SELECT username, rating, matches
+            FROM player_ratings
+            WHERE game_id = $1 AND username > $2
+            ORDER BY username
+            LIMIT $3
+        `, game.GameID, lastUsername, rebuildBatchSize)
+		if err != nil {
+			return processed, err
+		}
+
+		n := 0
+		pipe := storage.RedisClient.Pipeline()
+		for rows.Next() {
+			var rating float64
+			var matches int
+			if err := rows.Scan(&lastUsername, &rating, &matches); err != nil {
+				rows.Close()
+				return processed, err
+			}
+			pipe.EvalSha(storage.RedisCtx, storage.RebuildRatingScript.Hash(), shadowKeys, lastUsername, rating, matches)
+			pipe.SAdd(storage.RedisCtx, fmt.Sprintf("user:%s:games", lastUsername), game.GameID)
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return processed, err
+		}
+
+		if n > 0 {
+			if _, err := pipe.Exec(storage.RedisCtx); err != nil {
+				return processed, err
+			}
+		}
+		processed += int64(n)
+
+		if err := rebuildProgress(key, keys, token, processed, total); err != nil {
+			return processed, err
+		}
+		if n < rebuildBatchSize {
+			return processed, nil
+		}
+	}
+}
+
+// staleBoards returns the games whose Redis board is missing or holds fewer
+// players than their Postgres history for the current season, or than their
+// stored ratings for rated games, e.g. after the Redis volume was lost.
+func staleBoards() ([]models.Game, error) {
+	rows, err := storage.DB.Query(`
+        SELECT l.game_id, COUNT(DISTINCT l.username)
+        FROM leaderboard l
+        WHERE l.submitted_at >= ` + seasonBoundarySQL("l.game_id") + `
+        GROUP BY l.game_id
+        UNION ALL
+        SELECT game_id, COUNT(*)
+        FROM player_ratings
+        GROUP BY game_id
+    `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stale []models.Game
+	for rows.Next() {
+		var gameID string
+		var players int64
+		if err := rows.Scan(&gameID, &players); err != nil {
+			return nil, err
+		}
+
+		onBoard, err := storage.RedisClient.ZCard(storage.RedisCtx, gameBoardKey(gameID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if onBoard >= players {
+			continue
+		}
+
+		game, err := lookupGame(gameID)
+		if err != nil {
+			return nil, err
+		}
+		stale = append(stale, game)
+	}
+	return stale, rows.Err()
+}
+
+// RehydrateBoards rebuilds every stale board. It is run in the background at
+// startup so the server can serve traffic while boards are restored.
+func RehydrateBoards() {
+	games, err := staleBoards()
+	if err != nil {
+		log.Println("Failed to check leaderboards for rehydration:", err)
+		return
+	}
+	if len(games) == 0 {
+		return
+	}
+
+	log.Printf("Rehydrating %d leaderboards from PostgreSQL", len(games))
+	for _, game := range games {
+		if err := RebuildBoard(game); err != nil && err != errRebuildRunning {
+			log.Printf("Failed to rehydrate %s: %v", game.GameID, err)
+		}
+	}
+}
+
+// RebuildHandler starts a rebuild of one board (POST ?game_id=) and reports
+// its progress (GET ?game_id=). POST without game_id rebuilds every board
+// that has history.
+func RebuildHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+
+	switch r.Method {
+	case http.MethodGet:
+		game, ok := requireGame(w, gameID)
+		if !ok {
+			return
+		}
+		status, err := storage.RedisClient.HGetAll(storage.RedisCtx, rebuildKeysFor(gameBoardKey(game.GameID)).status).Result()
+		if err != nil && err != redis.Nil {
+			http.Error(w, "Failed to get rebuild status", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"game_id": game.GameID,
+			"status":  status,
+		})
+
+	case http.MethodPost:
+		var games []models.Game
+		if gameID != "" {
+			game, ok := requireGame(w, gameID)
+			if !ok {
+				return
+			}
+			games = append(games, game)
+		} else {
+			rows, err := storage.DB.Query(boardGamesQuery)
+			if err != nil {
+				http.Error(w, "Failed to list games", http.StatusInternalServerError)
+				return
+			}
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err != nil {
+					continue
+				}
+				if game, err := lookupGame(id); err == nil {
+					games = append(games, game)
+				}
+			}
+			rows.Close()
+		}
+
+		go func() {
+			for _, game := range games {
+				if err := RebuildBoard(game); err != nil {
+					log.Printf("Rebuild of %s not completed: %v", game.GameID, err)
+				}
+			}
+		}()
+
+		ids := make([]string, 0, len(games))
+		for _, game := range games {
+			ids = append(ids, game.GameID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Rebuild started",
+			"games":   ids,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
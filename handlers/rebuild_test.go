@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// useTestDB points storage.DB at a mock for the duration of the test and
+// checks every expected query ran.
+func useTestDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := storage.DB
+	storage.DB = db
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+		storage.DB = previous
+	})
+	return mock
+}
+
+func TestRebuildPeriodBoards(t *testing.T) {
+	mr := useTestRedis(t)
+	mock := useTestDB(t)
+	game := models.Game{
+		GameID:      "g",
+		Aggregation: models.AggregationSum,
+		SortOrder:   models.SortDescending,
+		TieBreakers: []string{},
+	}
+
+	now := time.Now()
+	type board struct {
+		key   string
+		score int
+	}
+	var boards []board
+	for _, period := range boardPeriods {
+		current := periodStart(period, now)
+		previous := periodStart(period, current.AddDate(0, 0, -1))
+		for i, start := range []time.Time{previous, current} {
+			end := periodEnd(period, start)
+			// The previous period holds one submission, the current two.
+			rows := sqlmock.NewRows([]string{"id", "username", "score", "submitted_at", "pending"}).
+				AddRow(1, "alice", 10, start, false)
+			if i == 1 {
+				rows.AddRow(2, "alice", 5, now, true)
+			}
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM leaderboard l`).
+				WithArgs(game.GameID, start, end).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(i + 1))
+			mock.ExpectQuery(`SELECT l.id, l.username, l.score, l.submitted_at`).
+				WithArgs(game.GameID, 0, rebuildBatchSize, start, end).
+				WillReturnRows(rows)
+			boards = append(boards, board{periodBoardKey(game.GameID, period, start), 10 + 5*i})
+		}
+	}
+
+	if err := rebuildPeriodBoards(game); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range boards {
+		score, err := storage.RedisClient.ZScore(storage.RedisCtx, b.key, "alice").Result()
+		if err != nil {
+			t.Fatalf("%s: %v", b.key, err)
+		}
+		if score != float64(b.score) {
+			t.Errorf("%s: alice = %v, want %d", b.key, score, b.score)
+		}
+		if mr.TTL(b.key) <= 0 {
+			t.Errorf("%s has no expiry", b.key)
+		}
+	}
+}
+
+func TestRebuildTournamentBoards(t *testing.T) {
+	useTestRedis(t)
+	mock := useTestDB(t)
+	game := models.Game{
+		GameID:      "g",
+		Aggregation: models.AggregationBest,
+		SortOrder:   models.SortDescending,
+		TieBreakers: []string{},
+	}
+
+	startsAt := time.Now().Add(-time.Hour)
+	endsAt := time.Now().Add(time.Hour)
+	columns := []string{"tournament_id", "game_id", "name", "starts_at", "ends_at", "finalized_at", "created_at", "players"}
+	mock.ExpectQuery(`SELECT tournament_id, starts_at, ends_at\s+FROM tournaments`).
+		WithArgs(game.GameID).
+		WillReturnRows(sqlmock.NewRows([]string{"tournament_id", "starts_at", "ends_at"}).
+			AddRow("open", startsAt, endsAt).
+			AddRow("closing", startsAt, endsAt))
+	for _, id := range []string{"open", "closing"} {
+		// Only the players' submissions inside the window are replayed,
+		// including those from before the current season.
+		mock.ExpectQuery(`SELECT COUNT\(\*\) FROM leaderboard l WHERE l.game_id = \$1 AND l.username IN \(SELECT username FROM tournament_players WHERE tournament_id = \$2\) AND l.submitted_at >= \$3 AND l.submitted_at < \$4$`).
+			WithArgs(game.GameID, id, startsAt, endsAt).
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+		mock.ExpectQuery(`SELECT l.id, l.username, l.score, l.submitted_at`).
+			WithArgs(game.GameID, 0, rebuildBatchSize, id, startsAt, endsAt).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "username", "score", "submitted_at", "pending"}).
+				AddRow(1, "alice", 40, startsAt.Add(time.Minute), false).
+				AddRow(2, "bob", 30, startsAt.Add(2*time.Minute), true))
+
+		// "closing" is finalized while its board is rebuilt.
+		var finalizedAt interface{}
+		if id == "closing" {
+			finalizedAt = time.Now()
+		}
+		mock.ExpectQuery(`FROM tournaments t WHERE t.tournament_id = \$1`).
+			WithArgs(id).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(id, game.GameID, id, startsAt, endsAt, finalizedAt, startsAt, 2))
+	}
+
+	if err := rebuildTournamentBoards(game); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rangeBoard(game, tournamentBoardKey("open"), 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Username != "alice" || entries[0].Score != 40 || entries[1].Username != "bob" {
+		t.Errorf("open tournament board = %+v, want alice 40 then bob 30", entries)
+	}
+	n, err := storage.RedisClient.Exists(storage.RedisCtx, boardScriptKeys(tournamentBoardKey("closing"))...).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("finalized tournament still has %d board keys", n)
+	}
+}
+
+// submitDuring is an argument matcher that delivers a live submission when
+// sqlmock matches the query it is an argument of, while the query's caller
+// holds its lock.
+type submitDuring func()
+
+func (f submitDuring) Match(driver.Value) bool {
+	f()
+	return true
+}
+
+// Submissions delivered while the board is rebuilt are mirrored into the
+// shadow board: one committed too late for the replay still counts, and
+// replaying the history row of another does not count it twice.
+func TestRebuildBoardKeepsMirroredSubmissions(t *testing.T) {
+	mr := useTestRedis(t)
+	mock := useTestDB(t)
+	game := models.Game{
+		GameID:      "g",
+		Aggregation: models.AggregationSum,
+		SortOrder:   models.SortDescending,
+		TieBreakers: []string{},
+	}
+	key := gameBoardKey(game.GameID)
+	now := time.Now()
+	// A stale entry with no history behind it.
+	if _, err := applyScore(game, "ghost", 99, now, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	live := submitDuring(func() {
+		if !mr.Exists(rebuildKeysFor(key).lock) {
+			t.Error("live submission delivered without the rebuild lock")
+		}
+		if _, err := applyScore(game, "alice", 5, now, 3, 0); err != nil {
+			t.Error(err)
+		}
+		if _, err := applyScore(game, "bob", 7, now, 4, 0); err != nil {
+			t.Error(err)
+		}
+	})
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM leaderboard l`).
+		WithArgs(game.GameID).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT l.id, l.username, l.score, l.submitted_at`).
+		WithArgs(game.GameID, live, rebuildBatchSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "score", "submitted_at", "pending"}).
+			AddRow(1, "alice", 10, now.Add(-time.Hour), false).
+			AddRow(2, "bob", 20, now.Add(-time.Hour), false).
+			AddRow(3, "alice", 5, now, true))
+
+	if err := rebuildBoard(game, key, historyFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rangeBoard(game, key, 0, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, e := range entries {
+		got[e.Username] = e.Score
+	}
+	if want := map[string]float64{"bob": 27, "alice": 15}; !reflect.DeepEqual(got, want) {
+		t.Errorf("board = %v, want %v", got, want)
+	}
+
+	// The outbox delivering row 3 again changes nothing.
+	if applied, err := applyScore(game, "alice", 5, now, 3, 0); err != nil {
+		t.Fatal(err)
+	} else if !applied.Duplicate || applied.Value != 15 {
+		t.Errorf("redelivery = %+v, want a duplicate at 15", applied)
+	}
+	keys := rebuildKeysFor(key)
+	if mr.Exists(keys.lock) || mr.Exists(keys.board) {
+		t.Error("rebuild lock or shadow board left behind")
+	}
+	if state := mr.HGet(keys.status, "state"); state != "done" {
+		t.Errorf("rebuild state = %q, want done", state)
+	}
+}
@@ -0,0 +1,360 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	driftMismatched = "mismatched"
+	driftMissing    = "missing"
+	driftPhantom    = "phantom"
+)
+
+// drift is one player whose Redis entry disagrees with the Postgres history.
+// RedisScore is nil for missing players and ExpectedScore for phantom ones.
+type drift struct {
+	Username      string   `json:"username"`
+	Kind          string   `json:"kind"`
+	RedisScore    *float64 `json:"redis_score"`
+	ExpectedScore *float64 `json:"expected_score"`
+	Repaired      bool     `json:"repaired"`
+
+	member string
+	state  memberState
+}
+
+// memberState is what a repair writes next to a player's score: their
+// personal best, their submission count (rated matches for rated games) and,
+// for latest and average games, their most recent submissions newest first
+// in the "<unix ms>:<score>" form apply keeps.
+type memberState struct {
+	best     float64
+	attempts int64
+	recent   string
+}
+
+// reconcileFilter selects the history rows the board is compared with:
+// those since the season boundary that are no longer pending in the outbox.
+var reconcileFilter = "id NOT IN (SELECT history_id FROM score_outbox WHERE status = 'pending') AND submitted_at >= " +
+	seasonBoundarySQL("$1")
+
+// DriftReport is the result of reconciling one game's board.
+type DriftReport struct {
+	GameID     string    `json:"game_id"`
+	CheckedAt  time.Time `json:"checked_at"`
+	Players    int       `json:"players"`
+	OnBoard    int       `json:"on_board"`
+	Mismatched int       `json:"mismatched"`
+	Missing    int       `json:"missing"`
+	Phantom    int       `json:"phantom"`
+	Repaired   int       `json:"repaired"`
+	Skipped    int       `json:"skipped"`
+	DryRun     bool      `json:"dry_run"`
+	Drift      []drift   `json:"drift"`
+}
+
+// InSync reports whether the board matched the history.
+func (r *DriftReport) InSync() bool {
+	return len(r.Drift) == 0
+}
+
+// tieMember encodes username the way SubmitScoreScript does for a player
+// whose aggregate was reached at reachedAt on their attempt-th submission.
+func tieMember(game models.Game, username string, reachedAt time.Time, attempt int64) string {
+	if len(game.TieBreakers) == 0 {
+		return username
+	}
+	var tie strings.Builder
+	for _, key := range game.TieBreakers {
+		switch key {
+		case models.TieBreakEarliest:
+			t := reachedAt.UnixMilli()
+			if !game.Ascending() {
+				t = 1<<48 - 1 - t
+			}
+			fmt.Fprintf(&tie, "%012x", t)
+		case models.TieBreakAttempts:
+			n := attempt
+			if n > math.MaxUint32 {
+				n = math.MaxUint32
+			}
+			if !game.Ascending() {
+				n = math.MaxUint32 - n
+			}
+			fmt.Fprintf(&tie, "%08x", n)
+		}
+	}
+	return tie.String() + "#" + username
+}
+
+// sameScore compares a board score with a history aggregate, allowing for
+// the rounding of averages computed in Lua and in Postgres.
+func sameScore(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+// ReconcileBoard compares the game's Redis board with the aggregate of its
+// Postgres history (or with its stored ratings, for a rated game) and reports
+// mismatched, missing and phantom players.
+// Submissions still pending in the outbox are left out of the comparison.
+// With repair the board is corrected in place, unless dryRun is set, in
+// which case the report only lists what would be repaired.
+func ReconcileBoard(game models.Game, repair, dryRun bool) (*DriftReport, error) {
+	key := gameBoardKey(game.GameID)
+
+	rebuilding, err := storage.RedisClient.Exists(storage.RedisCtx, rebuildKeysFor(key).lock).Result()
+	if err != nil {
+		return nil, err
+	}
+	if rebuilding > 0 {
+		return nil, errRebuildRunning
+	}
+
+	report := &DriftReport{GameID: game.GameID, CheckedAt: time.Now(), DryRun: repair && dryRun, Drift: []drift{}}
+
+	// Read the board first: a submission landing in between then shows up in
+	// Postgres but not yet on the board, and its repair is skipped below
+	// because the board entry changed.
+	results, err := storage.RedisClient.ZRangeWithScores(storage.RedisCtx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	board := make(map[string]float64, len(results))
+	for _, result := range results {
+		board[boardUsername(game, result.Member.(string))] = result.Score
+	}
+	report.OnBoard = len(board)
+
+	query := aggregateHistoryQuery(game, reconcileFilter)
+	if game.Rated() {
+		query = ratingStandingsQuery
+	}
+	rows, err := storage.DB.Query(query, game.GameID)
+	if err != nil {
+		return nil, err
+	}
+	expected := make(map[string]bool)
+	for rows.Next() {
+		var gameID, username string
+		var score float64
+		var reachedAt time.Time
+		var attempt int64
+		if err := rows.Scan(&gameID, &username, &score, &reachedAt, &attempt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		expected[username] = true
+		want := score
+
+		have, onBoard := board[username]
+		switch {
+		case !onBoard:
+			report.Drift = append(report.Drift, drift{Username: username, Kind: driftMissing,
+				ExpectedScore: &want, member: tieMember(game, username, reachedAt, attempt)})
+		case !sameScore(have, score):
+			report.Drift = append(report.Drift, drift{Username: username, Kind: driftMismatched,
+				RedisScore: &have, ExpectedScore: &want, member: tieMember(game, username, reachedAt, attempt)})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report.Players = len(expected)
+
+	for username, score := range board {
+		if expected[username] {
+			continue
+		}
+		have := score
+		report.Drift = append(report.Drift, drift{Username: username, Kind: driftPhantom, RedisScore: &have})
+	}
+
+	sort.Slice(report.Drift, func(i, j int) bool {
+		return report.Drift[i].Username < report.Drift[j].Username
+	})
+
+	var states map[string]memberState
+	if repair && !dryRun {
+		var usernames []string
+		for _, d := range report.Drift {
+			if d.ExpectedScore != nil {
+				usernames = append(usernames, d.Username)
+			}
+		}
+		if states, err = loadMemberStates(game, usernames); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range report.Drift {
+		d := &report.Drift[i]
+		switch d.Kind {
+		case driftMismatched:
+			report.Mismatched++
+		case driftMissing:
+			report.Missing++
+		case driftPhantom:
+			report.Phantom++
+		}
+		if !repair || dryRun {
+			continue
+		}
+
+		d.state = states[d.Username]
+		repaired, err := repairDrift(key, *d)
+		if err != nil {
+			return report, err
+		}
+		if repaired {
+			d.Repaired = true
+			report.Repaired++
+		} else {
+			report.Skipped++
+		}
+	}
+	return report, nil
+}
+
+func repairDrift(key string, d drift) (bool, error) {
+	seen, want := "", ""
+	if d.RedisScore != nil {
+		seen = strconv.FormatFloat(*d.RedisScore, 'g', -1, 64)
+	}
+	if d.ExpectedScore != nil {
+		want = strconv.FormatFloat(*d.ExpectedScore, 'g', -1, 64)
+	}
+	keys := []string{key, boardMembersKey(key), boardDistinctKey(key), key + ":best", key + ":attempts", key + ":recent"}
+	n, err := storage.RepairBoardMemberScript.Run(storage.RedisCtx, storage.RedisClient, keys,
+		d.Username, seen, want, d.member,
+		strconv.FormatFloat(d.state.best, 'g', -1, 64), d.state.attempts, d.state.recent).Int()
+	return n == 1, err
+}
+
+// loadMemberStates reads from Postgres the state a repair restores for each
+// of the given players of game, from the same history rows the board was
+// compared with.
+func loadMemberStates(game models.Game, usernames []string) (map[string]memberState, error) {
+	states := make(map[string]memberState, len(usernames))
+	if len(usernames) == 0 {
+		return states, nil
+	}
+
+	var rows *sql.Rows
+	var err error
+	if game.Rated() {
+		// A rated player's best is the highest rating they ever held.
+		rows, err = storage.DB.Query(`
+            SELECT r.username, GREATEST(r.rating, COALESCE(MAX(p.rating_after), r.rating)), r.matches, ''
+            FROM player_ratings r
+            LEFT JOIN match_participants p ON p.username = r.username
+                AND p.match_id IN (SELECT match_id FROM matches WHERE game_id = $1)
+            WHERE r.game_id = $1 AND r.username = ANY($2)
+            GROUP BY r.username, r.rating, r.matches
+        `, game.GameID, pq.Array(usernames))
+	} else {
+		window := 0
+		switch game.Aggregation {
+		case models.AggregationLatest:
+			window = 1
+		case models.AggregationAverage:
+			window = game.AverageWindow
+		}
+		rows, err = storage.DB.Query(`
+            WITH history AS (
+                SELECT id, username, score, submitted_at,
+                    ROW_NUMBER() OVER (PARTITION BY username ORDER BY submitted_at DESC, id DESC) AS recency
+                FROM leaderboard
+                WHERE game_id = $1 AND username = ANY($2) AND `+reconcileFilter+`
+            )
+            SELECT username, `+bestAggregate(game)+`, COUNT(*),
+                COALESCE(string_agg(FLOOR(EXTRACT(EPOCH FROM submitted_at) * 1000)::bigint || ':' || score, ','
+                    ORDER BY recency) FILTER (WHERE recency <= $3), '')
+            FROM history
+            GROUP BY username
+        `, game.GameID, pq.Array(usernames), window)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var username string
+		var state memberState
+		if err := rows.Scan(&username, &state.best, &state.attempts, &state.recent); err != nil {
+			return nil, err
+		}
+		states[username] = state
+	}
+	return states, rows.Err()
+}
+
+// ReconcileBoards reconciles the given games, or every game with history
+// when gameIDs is empty.
+func ReconcileBoards(gameIDs []string, repair, dryRun bool) ([]*DriftReport, error) {
+	if len(gameIDs) == 0 {
+		rows, err := storage.DB.Query(boardGamesQuery + " ORDER BY game_id")
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			gameIDs = append(gameIDs, id)
+		}
+		rows.Close()
+	}
+
+	var reports []*DriftReport
+	for _, id := range gameIDs {
+		game, err := lookupGame(id)
+		if err != nil {
+			return reports, fmt.Errorf("%s: %w", id, err)
+		}
+		report, err := ReconcileBoard(game, repair, dryRun)
+		if err == errRebuildRunning {
+			log.Printf("Skipping reconciliation of %s: %v", id, err)
+			continue
+		}
+		if err != nil {
+			return reports, fmt.Errorf("%s: %w", id, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// RunReconciler checks every board for drift each interval and logs what it
+// finds. It only reports; repairs are made with the reconcile command.
+func RunReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		reports, err := ReconcileBoards(nil, false, false)
+		if err != nil {
+			log.Println("Reconciliation failed:", err)
+		}
+		for _, report := range reports {
+			if report.InSync() {
+				continue
+			}
+			log.Printf("Leaderboard %s drifted from PostgreSQL: %d mismatched, %d missing, %d phantom",
+				report.GameID, report.Mismatched, report.Missing, report.Phantom)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"testing"
+	"time"
+)
+
+// tieOrderGame is a game ranking by the given tie-breakers in sortOrder.
+func tieOrderGame(sortOrder string, tieBreakers ...string) models.Game {
+	return models.Game{
+		GameID:        "g",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     sortOrder,
+		TieBreakers:   tieBreakers,
+	}
+}
+
+// ranksFirst reports whether member a is listed before b among members with
+// equal scores: Redis orders those lexicographically, reversed on boards read
+// with ZREVRANGE.
+func ranksFirst(game models.Game, a, b string) bool {
+	if game.Ascending() {
+		return a < b
+	}
+	return a > b
+}
+
+func TestTieMemberOrder(t *testing.T) {
+	early := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	late := early.Add(time.Millisecond)
+	tests := []struct {
+		name        string
+		tieBreakers []string
+		// better and worse are the times and attempts the two players
+		// reached the same score with, better being the one that ranks
+		// higher.
+		betterAt, worseAt           time.Time
+		betterAttempt, worseAttempt int64
+	}{
+		{"earliest", []string{models.TieBreakEarliest}, early, late, 5, 1},
+		{"attempts", []string{models.TieBreakAttempts}, late, early, 1, 2},
+		{"earliest then attempts", []string{models.TieBreakEarliest, models.TieBreakAttempts}, early, late, 9, 1},
+		{"attempts then earliest", []string{models.TieBreakAttempts, models.TieBreakEarliest}, early, late, 3, 3},
+		{"attempts past 32 bits", []string{models.TieBreakAttempts}, early, early, 7, 1 << 40},
+	}
+	for _, sortOrder := range []string{models.SortDescending, models.SortAscending} {
+		for _, tt := range tests {
+			t.Run(sortOrder+" "+tt.name, func(t *testing.T) {
+				game := tieOrderGame(sortOrder, tt.tieBreakers...)
+				// The usernames would order the other way round.
+				better := tieMember(game, "zed", tt.betterAt, tt.betterAttempt)
+				worse := tieMember(game, "amy", tt.worseAt, tt.worseAttempt)
+				if sortOrder == models.SortAscending {
+					better = tieMember(game, "amy", tt.betterAt, tt.betterAttempt)
+					worse = tieMember(game, "zed", tt.worseAt, tt.worseAttempt)
+				}
+				if !ranksFirst(game, better, worse) {
+					t.Errorf("%q does not rank before %q", better, worse)
+				}
+			})
+		}
+	}
+}
+
+// tieMember must encode members exactly like the submission script, or
+// reconciliation would report every tied player as drifted.
+func TestTieMemberMatchesScript(t *testing.T) {
+	for _, sortOrder := range []string{models.SortDescending, models.SortAscending} {
+		t.Run(sortOrder, func(t *testing.T) {
+			useTestRedis(t)
+			game := tieOrderGame(sortOrder, models.TieBreakEarliest, models.TieBreakAttempts)
+			at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			if _, err := applyScore(game, "alice", 50, at, 1, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := applyScore(game, "alice", 50, at.Add(time.Second), 2, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			key := gameBoardKey(game.GameID)
+			got, err := storage.RedisClient.HGet(storage.RedisCtx, boardMembersKey(key), "alice").Result()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The score was reached on the first attempt; repeating it
+			// changes neither.
+			if want := tieMember(game, "alice", at, 1); got != want {
+				t.Errorf("script member = %q, tieMember = %q", got, want)
+			}
+		})
+	}
+}
+
+// A repaired entry must keep aggregating from the restored state, not from
+// whatever drifted along with the score.
+func TestRepairDriftRestoresState(t *testing.T) {
+	useTestRedis(t)
+	game := tieOrderGame(models.SortDescending)
+	game.Aggregation = models.AggregationAverage
+	game.AverageWindow = 2
+	key := gameBoardKey(game.GameID)
+
+	at := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, score := range []int{100, 200} {
+		if _, err := applyScore(game, "alice", score, at.Add(time.Duration(i)*time.Minute), int64(i+1), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The entry drifts, and so does what it aggregates from.
+	storage.RedisClient.ZAdd(storage.RedisCtx, key, redis.Z{Score: 999, Member: "alice"})
+	storage.RedisClient.HSet(storage.RedisCtx, key+":recent", "alice", "0:999")
+	storage.RedisClient.HSet(storage.RedisCtx, key+":best", "alice", 999)
+	storage.RedisClient.HSet(storage.RedisCtx, key+":attempts", "alice", 7)
+
+	seen, want := 999.0, 150.0
+	recent := fmt.Sprintf("%d:200,%d:100", at.Add(time.Minute).UnixMilli(), at.UnixMilli())
+	repaired, err := repairDrift(key, drift{
+		Username: "alice", Kind: driftMismatched, RedisScore: &seen, ExpectedScore: &want,
+		member: "alice", state: memberState{best: 200, attempts: 2, recent: recent},
+	})
+	if err != nil || !repaired {
+		t.Fatalf("repairDrift = %v, %v", repaired, err)
+	}
+
+	got, err := applyScore(game, "alice", 300, at.Add(2*time.Minute), 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Value != 250 {
+		t.Errorf("average after repair = %v, want 250", got.Value)
+	}
+	best, _ := storage.RedisClient.HGet(storage.RedisCtx, key+":best", "alice").Float64()
+	attempts, _ := storage.RedisClient.HGet(storage.RedisCtx, key+":attempts", "alice").Int64()
+	if best != 300 || attempts != 3 {
+		t.Errorf("best, attempts = %v, %v, want 300, 3", best, attempts)
+	}
+}
@@ -0,0 +1,376 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Regional board scopes, named after the users column they filter on.
+const (
+	scopeCountry = "country"
+	scopeRegion  = "region"
+)
+
+// countryPattern matches an ISO 3166-1 alpha-2 country code.
+var countryPattern = regexp.MustCompile(`^[A-Z]{2}$`)
+
+var errInvalidRegion = errors.New("invalid region")
+
+// regionFilter selects a regional board: the players of one country or
+// region. The zero value is the global board.
+type regionFilter struct {
+	Scope string
+	Code  string
+}
+
+func (f regionFilter) global() bool {
+	return f.Scope == ""
+}
+
+// regionalBoardKey is the board of a game's players in f. It holds the same
+// members and scores as the game board, so ranks on it break ties the same
+// way.
+func regionalBoardKey(gameID string, f regionFilter) string {
+	return gameBoardKey(gameID) + ":" + f.Scope + ":" + f.Code
+}
+
+// regionalKeys are the keys SyncRegionalEntryScript keeps for each board.
+func regionalKeys(gameID string, filters []regionFilter) []string {
+	keys := make([]string, 0, 3*len(filters))
+	for _, f := range filters {
+		key := regionalBoardKey(gameID, f)
+		keys = append(keys, key, boardMembersKey(key), boardDistinctKey(key))
+	}
+	return keys
+}
+
+// normalizeCountry upper-cases a country code and checks it is alpha-2.
+// Empty means no country.
+func normalizeCountry(country string) (string, error) {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	if country != "" && !countryPattern.MatchString(country) {
+		return "", errInvalidRegion
+	}
+	return country, nil
+}
+
+// normalizeRegion lower-cases a region and checks it is a slug like a game
+// ID. Empty means no region.
+func normalizeRegion(region string) (string, error) {
+	region = strings.ToLower(strings.TrimSpace(region))
+	if region != "" && !gameIDPattern.MatchString(region) {
+		return "", errInvalidRegion
+	}
+	return region, nil
+}
+
+// parseRegionFilter reads the country or region query parameter. At most
+// one of them may be given.
+func parseRegionFilter(r *http.Request) (regionFilter, error) {
+	q := r.URL.Query()
+	country, err := normalizeCountry(q.Get("country"))
+	if err != nil {
+		return regionFilter{}, err
+	}
+	region, err := normalizeRegion(q.Get("region"))
+	if err != nil {
+		return regionFilter{}, err
+	}
+	switch {
+	case country != "" && region != "":
+		return regionFilter{}, errInvalidRegion
+	case country != "":
+		return regionFilter{Scope: scopeCountry, Code: country}, nil
+	case region != "":
+		return regionFilter{Scope: scopeRegion, Code: region}, nil
+	}
+	return regionFilter{}, nil
+}
+
+// profileFilters returns the regional boards a player with the given
+// profile belongs to.
+func profileFilters(country, region string) []regionFilter {
+	var filters []regionFilter
+	if country != "" {
+		filters = append(filters, regionFilter{Scope: scopeCountry, Code: country})
+	}
+	if region != "" {
+		filters = append(filters, regionFilter{Scope: scopeRegion, Code: region})
+	}
+	return filters
+}
+
+// userProfile loads a user's country and region.
+func userProfile(username string) (string, string, error) {
+	var country, region sql.NullString
+	err := storage.DB.QueryRow("SELECT country, region FROM users WHERE username = $1", username).Scan(&country, &region)
+	return country.String, region.String, err
+}
+
+// syncRegionalEntry copies the player's entry on the game board into the
+// put boards and removes it from the remove boards.
+func syncRegionalEntry(gameID, username string, put, remove []regionFilter) error {
+	if len(put) == 0 && len(remove) == 0 {
+		return nil
+	}
+	key := gameBoardKey(gameID)
+	keys := append([]string{key, boardMembersKey(key)}, regionalKeys(gameID, put)...)
+	keys = append(keys, regionalKeys(gameID, remove)...)
+	return storage.SyncRegionalEntryScript.Run(storage.RedisCtx, storage.RedisClient, keys, username, len(put)).Err()
+}
+
+// syncPlayerRegions brings the player's entries on the game's regional
+// boards in line with their game board entry after it changed.
+func syncPlayerRegions(game models.Game, username string) error {
+	country, region, err := userProfile(username)
+	if err != nil {
+		return err
+	}
+	return syncRegionalEntry(game.GameID, username, profileFilters(country, region), nil)
+}
+
+// moveRegionalEntries moves a player between regional boards after their
+// profile changed, in every game they have played.
+func moveRegionalEntries(username string, from, to []regionFilter) {
+	var remove []regionFilter
+	for _, old := range from {
+		kept := false
+		for _, f := range to {
+			kept = kept || f == old
+		}
+		if !kept {
+			remove = append(remove, old)
+		}
+	}
+
+	gameIDs, err := storage.RedisClient.SMembers(storage.RedisCtx, fmt.Sprintf("user:%s:games", username)).Result()
+	if err != nil {
+		log.Printf("Failed to move %s between regional boards: %v", username, err)
+		return
+	}
+	for _, gameID := range gameIDs {
+		// A rebuild of the game puts the player on the right boards.
+		if err := syncRegionalEntry(gameID, username, to, remove); err != nil {
+			log.Printf("Failed to move %s between regional boards of %s: %v", username, gameID, err)
+		}
+	}
+}
+
+// rebuildRegionalBoards rebuilds the game's regional boards from its game
+// board. Each board is swapped in a single transaction, so readers never see
+// it half built.
+func rebuildRegionalBoards(game models.Game) error {
+	rows, err := storage.DB.Query(`
+        SELECT DISTINCT 'country', country FROM users WHERE country IS NOT NULL
+        UNION
+        SELECT DISTINCT 'region', region FROM users WHERE region IS NOT NULL
+    `)
+	if err != nil {
+		return err
+	}
+	var filters []regionFilter
+	for rows.Next() {
+		var f regionFilter
+		if err := rows.Scan(&f.Scope, &f.Code); err != nil {
+			rows.Close()
+			return err
+		}
+		filters = append(filters, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := storage.SyncRegionalEntryScript.Load(storage.RedisCtx, storage.RedisClient).Err(); err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if err := rebuildRegionalBoard(game, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildRegionalBoard replaces one regional board of the game.
+func rebuildRegionalBoard(game models.Game, f regionFilter) error {
+	// Scope is one of the column names above, never user input.
+	rows, err := storage.DB.Query("SELECT username FROM users WHERE "+f.Scope+" = $1", f.Code)
+	if err != nil {
+		return err
+	}
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			rows.Close()
+			return err
+		}
+		usernames = append(usernames, username)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	key := gameBoardKey(game.GameID)
+	boardKeys := regionalKeys(game.GameID, []regionFilter{f})
+	keys := append([]string{key, boardMembersKey(key)}, boardKeys...)
+	_, err = storage.RedisClient.TxPipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		pipe.Del(storage.RedisCtx, boardKeys...)
+		for _, username := range usernames {
+			pipe.EvalSha(storage.RedisCtx, storage.SyncRegionalEntryScript.Hash(), keys, username, 1)
+		}
+		return nil
+	})
+	return err
+}
+
+// regionalRank is a player's place on a regional board.
+type regionalRank struct {
+	Scope        string  `json:"scope"`
+	Code         string  `json:"code"`
+	Rank         int64   `json:"rank"`
+	TotalPlayers int64   `json:"total_players"`
+	TopPercent   float64 `json:"top_percent"`
+}
+
+// regionalRankOf ranks username on the game's regional board f. It returns
+// redis.Nil when the player is not on it.
+func regionalRankOf(game models.Game, f regionFilter, username, mode string) (*regionalRank, error) {
+	key := regionalBoardKey(game.GameID, f)
+	position, score, err := boardPosition(game, key, username)
+	if err != nil {
+		return nil, err
+	}
+	rank, err := scoreRank(game, key, mode, position, score)
+	if err != nil {
+		return nil, err
+	}
+	total, err := storage.RedisClient.ZCard(storage.RedisCtx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	percent, _, err := placement(game, key, score, total)
+	if err != nil {
+		return nil, err
+	}
+	return &regionalRank{Scope: f.Scope, Code: f.Code, Rank: rank, TotalPlayers: total, TopPercent: percent}, nil
+}
+
+// ProfileHandler serves the caller's profile (GET) and updates their
+// country and region (PUT).
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		GetProfile(w, r)
+	case http.MethodPut:
+		UpdateProfile(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func GetProfile(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	country, region, err := userProfile(claims.Username)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get profile", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username": claims.Username,
+		"country":  country,
+		"region":   region,
+	})
+}
+
+// UpdateProfile sets the caller's country and region. An empty value clears
+// it. The player moves to their new regional boards in every game they have
+// played.
+func UpdateProfile(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Country string `json:"country"`
+		Region  string `json:"region"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	country, err := normalizeCountry(req.Country)
+	if err != nil {
+		http.Error(w, "Invalid country. Use an ISO 3166-1 alpha-2 code such as DE", http.StatusBadRequest)
+		return
+	}
+	region, err := normalizeRegion(req.Region)
+	if err != nil {
+		http.Error(w, "Invalid region. Use 1-64 characters: a-z, 0-9, _ or -", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the row keeps concurrent updates from moving the player out
+	// of boards they were never moved into.
+	var oldCountry, oldRegion sql.NullString
+	err = tx.QueryRow(
+		"SELECT country, region FROM users WHERE username = $1 FOR UPDATE", claims.Username,
+	).Scan(&oldCountry, &oldRegion)
+	if err == sql.ErrNoRows {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		"UPDATE users SET country = NULLIF($2, ''), region = NULLIF($3, '') WHERE username = $1",
+		claims.Username, country, region,
+	)
+	if err != nil {
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		return
+	}
+
+	moveRegionalEntries(claims.Username, profileFilters(oldCountry.String, oldRegion.String), profileFilters(country, region))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username": claims.Username,
+		"country":  country,
+		"region":   region,
+	})
+}
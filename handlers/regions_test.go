@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"testing"
+	"time"
+)
+
+// When a player moves country, every game they played takes them off the
+// old country's boards and onto the new one's; boards of a region they stay
+// in keep them.
+func TestMoveRegionalEntries(t *testing.T) {
+	mr := useTestRedis(t)
+	games := []models.Game{
+		{GameID: "g1", Aggregation: models.AggregationBest, AverageWindow: models.DefaultAverageWindow,
+			SortOrder: models.SortDescending, TieBreakers: []string{}},
+		{GameID: "g2", Aggregation: models.AggregationBest, AverageWindow: models.DefaultAverageWindow,
+			SortOrder: models.SortAscending, TieBreakers: []string{models.TieBreakEarliest}},
+	}
+	de := regionFilter{Scope: scopeCountry, Code: "DE"}
+	fr := regionFilter{Scope: scopeCountry, Code: "FR"}
+	eu := regionFilter{Scope: scopeRegion, Code: "eu"}
+
+	var historyID int64
+	for i, game := range games {
+		for _, username := range []string{"alice", "bob"} {
+			historyID++
+			score := 100*(i+1) + int(historyID)
+			if _, err := applyScore(game, username, score, time.Now(), historyID, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := syncRegionalEntry(game.GameID, "alice", []regionFilter{de, eu}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := syncRegionalEntry(game.GameID, "bob", []regionFilter{de}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.RedisClient.SAdd(storage.RedisCtx, "user:alice:games", game.GameID).Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moveRegionalEntries("alice", []regionFilter{de, eu}, []regionFilter{fr, eu})
+
+	for _, game := range games {
+		_, want, err := boardPosition(game, gameBoardKey(game.GameID), "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []regionFilter{fr, eu} {
+			key := regionalBoardKey(game.GameID, f)
+			_, got, err := boardPosition(game, key, "alice")
+			if err != nil {
+				t.Fatalf("%s: %v", key, err)
+			}
+			if got != want {
+				t.Errorf("%s: alice = %v, want %v", key, got, want)
+			}
+		}
+
+		key := regionalBoardKey(game.GameID, de)
+		entries, err := rangeBoard(game, key, 0, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Username != "bob" {
+			t.Errorf("%s = %+v, want only bob", key, entries)
+		}
+		if mr.Exists(boardMembersKey(key)) && mr.HGet(boardMembersKey(key), "alice") != "" {
+			t.Errorf("%s still maps alice to a member", key)
+		}
+		if n, _ := storage.RedisClient.ZCard(storage.RedisCtx, boardDistinctKey(key)).Result(); n != 1 {
+			t.Errorf("%s has %d distinct scores, want bob's only", key, n)
+		}
+	}
+}
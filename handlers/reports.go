@@ -9,9 +9,11 @@ import (
 )
 
 type TopPlayersReport struct {
+	GameID     string                    `json:"game_id"`
 	Period     string                    `json:"period"`
 	StartDate  string                    `json:"start_date"`
 	EndDate    string                    `json:"end_date"`
+	RankMode   string                    `json:"rank_mode"`
 	TopPlayers []models.LeaderboardEntry `json:"top_players"`
 }
 
@@ -26,6 +28,17 @@ func GetTopPlayersReport(w http.ResponseWriter, r *http.Request) {
 		period = "day"
 	}
 
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
 	var startDate time.Time
 	endDate := time.Now()
 
@@ -43,16 +56,19 @@ func GetTopPlayersReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
 	query := `
-        SELECT username, MAX(score) as max_score
-        FROM leaderboard
-        WHERE submitted_at BETWEEN $1 AND $2
-        GROUP BY username
-        ORDER BY max_score DESC
+        SELECT username, aggregate_score
+        FROM (` + aggregateHistoryQuery(game, "submitted_at BETWEEN $2 AND $3") + `
+        ) ranked
+        ORDER BY ` + rankingOrder(game) + `
         LIMIT 10
     `
 
-	rows, err := storage.DB.Query(query, startDate, endDate)
+	rows, err := storage.DB.Query(query, game.GameID, startDate, endDate)
 	if err != nil {
 		http.Error(w, "Failed to get report", http.StatusInternalServerError)
 		return
@@ -60,7 +76,6 @@ func GetTopPlayersReport(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 
 	var topPlayers []models.LeaderboardEntry
-	rank := int64(1)
 	for rows.Next() {
 		var entry models.LeaderboardEntry
 		var score float64
@@ -68,15 +83,16 @@ func GetTopPlayersReport(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 		entry.Score = score
-		entry.Rank = rank
 		topPlayers = append(topPlayers, entry)
-		rank++
 	}
+	assignRanks(topPlayers, rankMode, 0, 1)
 
 	report := TopPlayersReport{
+		GameID:     game.GameID,
 		Period:     period,
 		StartDate:  startDate.Format("2006-01-02 15:04:05"),
 		EndDate:    endDate.Format("2006-01-02 15:04:05"),
+		RankMode:   rankMode,
 		TopPlayers: topPlayers,
 	}
 
@@ -84,6 +100,38 @@ func GetTopPlayersReport(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(report)
 }
 
+// gameStats summarises a player's history in one game under its policy.
+type gameStats struct {
+	GameID         string    `json:"game_id"`
+	TotalGames     int       `json:"total_games"`
+	BestScore      float64   `json:"best_score"`
+	Aggregation    string    `json:"aggregation"`
+	AggregateScore float64   `json:"aggregate_score"`
+	LastGame       time.Time `json:"last_game"`
+}
+
+func playerGameStats(game models.Game, username string) (gameStats, error) {
+	query := `
+        SELECT
+            COUNT(*),
+            ` + bestAggregate(game) + `,
+            MAX(submitted_at),
+            (SELECT aggregate_score FROM (` + aggregateHistoryQuery(game, "username = $2") + `
+            ) ranked)
+        FROM leaderboard
+        WHERE game_id = $1 AND username = $2
+    `
+
+	stats := gameStats{GameID: game.GameID, Aggregation: game.Aggregation}
+	err := storage.DB.QueryRow(query, game.GameID, username).Scan(
+		&stats.TotalGames,
+		&stats.BestScore,
+		&stats.LastGame,
+		&stats.AggregateScore,
+	)
+	return stats, err
+}
+
 func GetUserStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -96,26 +144,43 @@ func GetUserStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Without game_id the totals span every game and best_score is the
+	// highest raw score; per-game figures use each game's own policy.
+	gameID := r.URL.Query().Get("game_id")
+	where := "username = $1"
+	args := []interface{}{username}
+	best := "MAX(score)"
+	if gameID != "" {
+		game, ok := requireGame(w, gameID)
+		if !ok {
+			return
+		}
+		where += " AND game_id = $2"
+		args = append(args, gameID)
+		best = bestAggregate(game)
+	}
+
 	query := `
         SELECT 
             COUNT(*) as total_games,
-            MAX(score) as best_score,
+            ` + best + ` as best_score,
             AVG(score) as avg_score,
             MIN(submitted_at) as first_game,
             MAX(submitted_at) as last_game
         FROM leaderboard
-        WHERE username = $1
-    `
+        WHERE ` + where
 
 	var stats struct {
-		TotalGames int       `json:"total_games"`
-		BestScore  float64   `json:"best_score"`
-		AvgScore   float64   `json:"avg_score"`
-		FirstGame  time.Time `json:"first_game"`
-		LastGame   time.Time `json:"last_game"`
+		TotalGames     int       `json:"total_games"`
+		BestScore      float64   `json:"best_score"`
+		AvgScore       float64   `json:"avg_score"`
+		FirstGame      time.Time `json:"first_game"`
+		LastGame       time.Time `json:"last_game"`
+		Aggregation    string    `json:"aggregation,omitempty"`
+		AggregateScore *float64  `json:"aggregate_score,omitempty"`
 	}
 
-	err := storage.DB.QueryRow(query, username).Scan(
+	err := storage.DB.QueryRow(query, args...).Scan(
 		&stats.TotalGames,
 		&stats.BestScore,
 		&stats.AvgScore,
@@ -128,15 +193,54 @@ func GetUserStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	gameRows, err := storage.DB.Query(`
+        SELECT DISTINCT game_id
+        FROM leaderboard
+        WHERE `+where+`
+        ORDER BY game_id
+    `, args...)
+	if err != nil {
+		http.Error(w, "Failed to get user stats", http.StatusInternalServerError)
+		return
+	}
+	var gameIDs []string
+	for gameRows.Next() {
+		var id string
+		if err := gameRows.Scan(&id); err != nil {
+			continue
+		}
+		gameIDs = append(gameIDs, id)
+	}
+	gameRows.Close()
+
+	perGame := []gameStats{}
+	for _, id := range gameIDs {
+		game, err := lookupGame(id)
+		if err != nil {
+			http.Error(w, "Failed to get user stats", http.StatusInternalServerError)
+			return
+		}
+		entry, err := playerGameStats(game, username)
+		if err != nil {
+			http.Error(w, "Failed to get user stats", http.StatusInternalServerError)
+			return
+		}
+		perGame = append(perGame, entry)
+		if id == gameID {
+			stats.Aggregation = entry.Aggregation
+			stats.AggregateScore = &entry.AggregateScore
+		}
+	}
+
 	recentQuery := `
-        SELECT score, submitted_at
+        SELECT game_id, score, submitted_at
         FROM leaderboard
-        WHERE username = $1
+        WHERE ` + where + `
         ORDER BY submitted_at DESC
         LIMIT 10
     `
 
-	rows, err := storage.DB.Query(recentQuery, username)
+	rows, err := storage.DB.Query(recentQuery, args...)
 	if err != nil {
 		http.Error(w, "Failed to get recent games", http.StatusInternalServerError)
 		return
@@ -145,12 +249,14 @@ func GetUserStats(w http.ResponseWriter, r *http.Request) {
 
 	var recentGames []map[string]interface{}
 	for rows.Next() {
+		var recentGameID string
 		var score float64
 		var submittedAt time.Time
-		if err := rows.Scan(&score, &submittedAt); err != nil {
+		if err := rows.Scan(&recentGameID, &score, &submittedAt); err != nil {
 			continue
 		}
 		recentGames = append(recentGames, map[string]interface{}{
+			"game_id":      recentGameID,
 			"score":        score,
 			"submitted_at": submittedAt.Format("2006-01-02 15:04:05"),
 		})
@@ -159,6 +265,7 @@ func GetUserStats(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"username":     username,
 		"stats":        stats,
+		"games":        perGame,
 		"recent_games": recentGames,
 	}
 
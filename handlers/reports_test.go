@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var speedrun = models.Game{
+	GameID:        "speedrun",
+	Aggregation:   models.AggregationBest,
+	AverageWindow: models.DefaultAverageWindow,
+	SortOrder:     models.SortAscending,
+	TieBreakers:   []string{},
+}
+
+func TestTopPlayersReportFiltersByGame(t *testing.T) {
+	useTestGames(t, speedrun)
+	mock := useTestDB(t)
+	mock.ExpectQuery(`(?s)WHERE game_id = \$1 AND submitted_at BETWEEN \$2 AND \$3.*MIN\(score\).*ORDER BY aggregate_score ASC`).
+		WithArgs("speedrun", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "aggregate_score"}).
+			AddRow("alice", 61.5).
+			AddRow("bob", 64.0))
+
+	w := httptest.NewRecorder()
+	GetTopPlayersReport(w, httptest.NewRequest(http.MethodGet, "/report?period=week&game_id=speedrun", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", w.Code, w.Body.String())
+	}
+	var report TopPlayersReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.GameID != "speedrun" || len(report.TopPlayers) != 2 || report.TopPlayers[0].Username != "alice" {
+		t.Errorf("report = %+v", report)
+	}
+}
+
+func TestUserStatsFiltersByGame(t *testing.T) {
+	useTestGames(t, speedrun)
+	mock := useTestDB(t)
+	now := time.Now()
+	mock.ExpectQuery(`(?s)MIN\(score\) as best_score.*WHERE username = \$1 AND game_id = \$2`).
+		WithArgs("alice", "speedrun").
+		WillReturnRows(sqlmock.NewRows([]string{"total_games", "best_score", "avg_score", "first_game", "last_game"}).
+			AddRow(3, 61.5, 65.0, now.Add(-time.Hour), now))
+	mock.ExpectQuery(`(?s)SELECT DISTINCT game_id.*WHERE username = \$1 AND game_id = \$2`).
+		WithArgs("alice", "speedrun").
+		WillReturnRows(sqlmock.NewRows([]string{"game_id"}).AddRow("speedrun"))
+	mock.ExpectQuery(`(?s)MIN\(score\),.*WHERE game_id = \$1 AND username = \$2`).
+		WithArgs("speedrun", "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"count", "best", "last", "aggregate"}).
+			AddRow(3, 61.5, now, 61.5))
+	mock.ExpectQuery(`(?s)SELECT game_id, score, submitted_at.*WHERE username = \$1 AND game_id = \$2`).
+		WithArgs("alice", "speedrun").
+		WillReturnRows(sqlmock.NewRows([]string{"game_id", "score", "submitted_at"}).
+			AddRow("speedrun", 61.5, now))
+
+	w := httptest.NewRecorder()
+	GetUserStats(w, httptest.NewRequest(http.MethodGet, "/stats?username=alice&game_id=speedrun", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s)", w.Code, w.Body.String())
+	}
+	var response struct {
+		Stats struct {
+			BestScore      float64  `json:"best_score"`
+			Aggregation    string   `json:"aggregation"`
+			AggregateScore *float64 `json:"aggregate_score"`
+		} `json:"stats"`
+		Games []gameStats `json:"games"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Stats.BestScore != 61.5 || response.Stats.Aggregation != models.AggregationBest ||
+		response.Stats.AggregateScore == nil || *response.Stats.AggregateScore != 61.5 {
+		t.Errorf("stats = %+v", response.Stats)
+	}
+	if len(response.Games) != 1 || response.Games[0].GameID != "speedrun" {
+		t.Errorf("games = %+v", response.Games)
+	}
+}
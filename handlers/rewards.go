@@ -0,0 +1,521 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+var errSeasonNotArchived = errors.New("season has not been archived")
+
+func validateRewardRules(rules []models.RewardRule) error {
+	if len(rules) == 0 {
+		return errors.New("rules must list at least one rule")
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Reward == "" || rule.Amount <= 0 {
+			return fmt.Errorf("rule %d needs a reward and a positive amount", i+1)
+		}
+
+		criteria := 0
+		if rule.FromRank != 0 || rule.ToRank != 0 {
+			criteria++
+			if rule.ToRank == 0 {
+				rule.ToRank = rule.FromRank
+			}
+			if rule.FromRank < 1 || rule.ToRank < rule.FromRank {
+				return fmt.Errorf("rule %d needs 1 <= from_rank <= to_rank", i+1)
+			}
+		}
+		if rule.TopPercent != nil {
+			criteria++
+			if *rule.TopPercent <= 0 || *rule.TopPercent > 100 {
+				return fmt.Errorf("rule %d needs top_percent between 0 and 100", i+1)
+			}
+		}
+		if rule.Tier != "" {
+			criteria++
+		}
+		if criteria != 1 {
+			return fmt.Errorf("rule %d must set exactly one of from_rank/to_rank, top_percent or tier", i+1)
+		}
+	}
+	return nil
+}
+
+// matchReward returns the first rule a final standing qualifies for, or nil.
+func matchReward(rules []models.RewardRule, rank int64, percent float64, tier string) *models.RewardRule {
+	for i, rule := range rules {
+		switch {
+		case rule.FromRank > 0:
+			if rank >= int64(rule.FromRank) && rank <= int64(rule.ToRank) {
+				return &rules[i]
+			}
+		case rule.TopPercent != nil:
+			if percent <= *rule.TopPercent {
+				return &rules[i]
+			}
+		case rule.Tier == tier:
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// distributeRewards writes a grant for every player of an archived season
+// who qualifies under its reward table, or the game's default table. Players
+// who already have a grant for the season are skipped, so distributing again
+// never pays twice. It returns the number of new grants. The caller holds the
+// season row lock.
+func distributeRewards(tx *sql.Tx, season models.Season) (int, error) {
+	if season.Status != models.SeasonArchived {
+		return 0, errSeasonNotArchived
+	}
+
+	var raw []byte
+	err := tx.QueryRow(`
+        SELECT rules FROM reward_tables
+        WHERE game_id = $1 AND season IN ($2, 0)
+        ORDER BY season DESC
+        LIMIT 1
+    `, season.GameID, season.Number).Scan(&raw)
+	var rules []models.RewardRule
+	if err == nil {
+		err = json.Unmarshal(raw, &rules)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	granted := 0
+	if len(rules) > 0 {
+		rows, err := tx.Query(`
+            SELECT username, standard_rank, top_percent, tier
+            FROM season_standings
+            WHERE game_id = $1 AND season = $2
+            ORDER BY rank
+        `, season.GameID, season.Number)
+		if err != nil {
+			return 0, err
+		}
+		type grant struct {
+			username string
+			rank     int64
+			rule     *models.RewardRule
+		}
+		var grants []grant
+		for rows.Next() {
+			var username, tier string
+			var rank int64
+			var percent float64
+			if err := rows.Scan(&username, &rank, &percent, &tier); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if rule := matchReward(rules, rank, percent, tier); rule != nil {
+				grants = append(grants, grant{username, rank, rule})
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+
+		for _, g := range grants {
+			result, err := tx.Exec(`
+                INSERT INTO reward_grants (game_id, season, username, rank, reward, amount)
+                VALUES ($1, $2, $3, $4, $5, $6)
+                ON CONFLICT (game_id, season, username) DO NOTHING
+            `, season.GameID, season.Number, g.username, g.rank, g.rule.Reward, g.rule.Amount)
+			if err != nil {
+				return 0, err
+			}
+			n, _ := result.RowsAffected()
+			granted += int(n)
+		}
+	}
+
+	_, err = tx.Exec(`
+        UPDATE seasons SET rewards_distributed_at = CURRENT_TIMESTAMP
+        WHERE game_id = $1 AND number = $2
+    `, season.GameID, season.Number)
+	return granted, err
+}
+
+// distributeNextSeason pays out the earliest archived season whose rewards
+// have not been distributed. It returns false when there is none left.
+func distributeNextSeason() (bool, error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	season, err := scanSeason(tx.QueryRow(`
+        SELECT ` + seasonColumns + ` FROM seasons
+        WHERE archived_at IS NOT NULL AND rewards_distributed_at IS NULL
+        ORDER BY archived_at
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED
+    `))
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	granted, err := distributeRewards(tx, season)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	log.Printf("Distributed %d rewards for season %d of %s", granted, season.Number, season.GameID)
+	return true, nil
+}
+
+// distributeArchivedSeasons pays out every archived season not paid yet.
+func distributeArchivedSeasons() error {
+	for {
+		more, err := distributeNextSeason()
+		if err != nil || !more {
+			return err
+		}
+	}
+}
+
+func RewardTablesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListRewardTables(w, r)
+	case http.MethodPut:
+		SaveRewardTable(w, r)
+	case http.MethodDelete:
+		DeleteRewardTable(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// parseRewardSeason reads the season query parameter, 0 (every season) when
+// omitted.
+func parseRewardSeason(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("season")
+	if v == "" {
+		return 0, true
+	}
+	season, err := strconv.Atoi(v)
+	return season, err == nil && season >= 0
+}
+
+func ListRewardTables(w http.ResponseWriter, r *http.Request) {
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	rows, err := storage.DB.Query(
+		"SELECT game_id, season, rules, updated_at FROM reward_tables WHERE game_id = $1 ORDER BY season", game.GameID)
+	if err != nil {
+		http.Error(w, "Failed to list reward tables", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tables := []models.RewardTable{}
+	for rows.Next() {
+		var table models.RewardTable
+		var rules []byte
+		if err := rows.Scan(&table.GameID, &table.Season, &rules, &table.UpdatedAt); err != nil {
+			http.Error(w, "Failed to list reward tables", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(rules, &table.Rules); err != nil {
+			http.Error(w, "Failed to list reward tables", http.StatusInternalServerError)
+			return
+		}
+		tables = append(tables, table)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tables)
+}
+
+// SaveRewardTable sets the rules for ?game_id= and ?season= (omit for the
+// game's default table). Seasons already paid out are not affected unless
+// distributed again.
+func SaveRewardTable(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	season, ok := parseRewardSeason(r)
+	if !ok {
+		http.Error(w, "Invalid season", http.StatusBadRequest)
+		return
+	}
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	var table models.RewardTable
+	if err := json.NewDecoder(r.Body).Decode(&table); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateRewardRules(table.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	table.GameID, table.Season = game.GameID, season
+
+	rules, _ := json.Marshal(table.Rules)
+	err := storage.DB.QueryRow(`
+        INSERT INTO reward_tables (game_id, season, rules) VALUES ($1, $2, $3)
+        ON CONFLICT (game_id, season) DO UPDATE SET rules = EXCLUDED.rules, updated_at = CURRENT_TIMESTAMP
+        RETURNING updated_at
+    `, table.GameID, table.Season, string(rules)).Scan(&table.UpdatedAt)
+	if err != nil {
+		http.Error(w, "Failed to save reward table", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(table)
+}
+
+func DeleteRewardTable(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	season, ok := parseRewardSeason(r)
+	if !ok {
+		http.Error(w, "Invalid season", http.StatusBadRequest)
+		return
+	}
+
+	result, err := storage.DB.Exec("DELETE FROM reward_tables WHERE game_id = $1 AND season = $2", gameID, season)
+	if err != nil {
+		http.Error(w, "Failed to delete reward table", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Reward table not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Reward table deleted"})
+}
+
+// DistributeRewardsHandler pays out ?season= of ?game_id= now, e.g. after
+// adding a reward table for a season that has already ended.
+func DistributeRewardsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	number, err := strconv.Atoi(r.URL.Query().Get("season"))
+	if err != nil {
+		http.Error(w, "Invalid season", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to distribute rewards", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	season, err := scanSeason(tx.QueryRow(
+		"SELECT "+seasonColumns+" FROM seasons WHERE game_id = $1 AND number = $2 FOR UPDATE", gameID, number))
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Season %d of %q not found", number, gameID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to distribute rewards", http.StatusInternalServerError)
+		return
+	}
+
+	granted, err := distributeRewards(tx, season)
+	if err == errSeasonNotArchived {
+		http.Error(w, fmt.Sprintf("Season %d is %s; rewards are distributed once it is archived", number, season.Status), http.StatusConflict)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, "Failed to distribute rewards", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"game_id": season.GameID,
+		"season":  season.Number,
+		"granted": granted,
+	})
+}
+
+const rewardGrantColumns = "id, game_id, season, username, rank, reward, amount, status, created_at, claimed_at"
+
+func scanRewardGrant(row rowScanner) (models.RewardGrant, error) {
+	var grant models.RewardGrant
+	var claimedAt sql.NullTime
+	err := row.Scan(&grant.ID, &grant.GameID, &grant.Season, &grant.Username, &grant.Rank,
+		&grant.Reward, &grant.Amount, &grant.Status, &grant.CreatedAt, &claimedAt)
+	if claimedAt.Valid {
+		grant.ClaimedAt = &claimedAt.Time
+	}
+	return grant, err
+}
+
+// ListRewards returns the caller's grants, optionally only those with
+// ?status=pending or claimed.
+func ListRewards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	where := "username = $1"
+	args := []interface{}{claims.Username}
+	switch status := r.URL.Query().Get("status"); status {
+	case "":
+	case models.RewardPending, models.RewardClaimed:
+		where += " AND status = $2"
+		args = append(args, status)
+	default:
+		http.Error(w, "Invalid status. Use: pending, claimed", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := storage.DB.Query("SELECT "+rewardGrantColumns+" FROM reward_grants WHERE "+where+" ORDER BY id DESC", args...)
+	if err != nil {
+		http.Error(w, "Failed to list rewards", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	grants := []models.RewardGrant{}
+	for rows.Next() {
+		grant, err := scanRewardGrant(rows)
+		if err != nil {
+			http.Error(w, "Failed to list rewards", http.StatusInternalServerError)
+			return
+		}
+		grants = append(grants, grant)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(grants)
+}
+
+// ClaimRewards claims one of the caller's pending grants (?grant_id=) or all
+// of them. Each grant can be claimed once.
+func ClaimRewards(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	where := "username = $1 AND status = 'pending'"
+	args := []interface{}{claims.Username}
+	var grantID int64
+	if v := r.URL.Query().Get("grant_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid grant_id", http.StatusBadRequest)
+			return
+		}
+		grantID = id
+		where += " AND id = $2"
+		args = append(args, grantID)
+	}
+
+	rows, err := storage.DB.Query(`
+        UPDATE reward_grants SET status = 'claimed', claimed_at = CURRENT_TIMESTAMP
+        WHERE `+where+`
+        RETURNING `+rewardGrantColumns, args...)
+	if err != nil {
+		http.Error(w, "Failed to claim rewards", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	claimed := []models.RewardGrant{}
+	for rows.Next() {
+		grant, err := scanRewardGrant(rows)
+		if err != nil {
+			http.Error(w, "Failed to claim rewards", http.StatusInternalServerError)
+			return
+		}
+		claimed = append(claimed, grant)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to claim rewards", http.StatusInternalServerError)
+		return
+	}
+
+	if grantID != 0 && len(claimed) == 0 {
+		var status string
+		err := storage.DB.QueryRow("SELECT status FROM reward_grants WHERE id = $1 AND username = $2",
+			grantID, claims.Username).Scan(&status)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Reward not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to claim rewards", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Reward already claimed", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"claimed": claimed,
+	})
+}
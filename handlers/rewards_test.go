@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+)
+
+func TestMatchReward(t *testing.T) {
+	ten := 10.0
+	rules := []models.RewardRule{
+		{FromRank: 1, ToRank: 1, Reward: "crown"},
+		{Tier: "Diamond", Reward: "gem"},
+		{TopPercent: &ten, Reward: "chest"},
+		{FromRank: 2, ToRank: 50, Reward: "coins"},
+		{Tier: "Bronze", Reward: "badge"},
+	}
+	tests := []struct {
+		name    string
+		rank    int64
+		percent float64
+		tier    string
+		want    string
+	}{
+		{"rank rule before tier", 1, 0.5, "Diamond", "crown"},
+		{"tier before top percent", 2, 1, "Diamond", "gem"},
+		{"top percent before later ranks", 5, 5, "Gold", "chest"},
+		{"percent bound is inclusive", 7, 10, "Gold", "chest"},
+		{"rank range", 20, 40, "Silver", "coins"},
+		{"catch-all tier", 80, 80, "Bronze", "badge"},
+		{"no match", 80, 80, "Silver", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if rule := matchReward(rules, tt.rank, tt.percent, tt.tier); rule != nil {
+				got = rule.Reward
+			}
+			if got != tt.want {
+				t.Errorf("matchReward(%d, %v, %q) = %q, want %q", tt.rank, tt.percent, tt.tier, got, tt.want)
+			}
+		})
+	}
+}
+
+// Distributing a season again only counts the grants the database inserted:
+// players paid the first time conflict and are skipped.
+func TestDistributeRewardsAgainPaysNothing(t *testing.T) {
+	mock := useTestDB(t)
+	season := models.Season{GameID: "g", Number: 3, Status: models.SeasonArchived}
+	rules, _ := json.Marshal([]models.RewardRule{{FromRank: 1, ToRank: 2, Reward: "coins", Amount: 100}})
+
+	for _, inserted := range []int64{1, 0} {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT rules FROM reward_tables").
+			WithArgs("g", 3).
+			WillReturnRows(sqlmock.NewRows([]string{"rules"}).AddRow(rules))
+		mock.ExpectQuery("SELECT username, standard_rank, top_percent, tier").
+			WithArgs("g", 3).
+			WillReturnRows(sqlmock.NewRows([]string{"username", "standard_rank", "top_percent", "tier"}).
+				AddRow("alice", 1, 33.33, "Gold").
+				AddRow("bob", 2, 66.67, "Silver").
+				AddRow("carol", 3, 100.0, "Bronze"))
+		for _, username := range []string{"alice", "bob"} {
+			mock.ExpectExec(`INSERT INTO reward_grants .* ON CONFLICT \(game_id, season, username\) DO NOTHING`).
+				WithArgs("g", 3, username, sqlmock.AnyArg(), "coins", 100).
+				WillReturnResult(sqlmock.NewResult(0, inserted))
+		}
+		mock.ExpectExec("UPDATE seasons SET rewards_distributed_at").
+			WithArgs("g", 3).
+			WillReturnResult(driver.RowsAffected(1))
+		mock.ExpectCommit()
+
+		tx, err := storage.DB.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		granted, err := distributeRewards(tx, season)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if want := int(2 * inserted); granted != want {
+			t.Errorf("granted = %d, want %d", granted, want)
+		}
+	}
+}
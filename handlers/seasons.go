@@ -0,0 +1,626 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const seasonCheckInterval = time.Minute
+
+// seasonBoundarySQL is the SQL for the most recent season start or end of the
+// game identified by gameID (a column or placeholder), or -infinity for games
+// without seasons. The live board holds the submissions since then.
+func seasonBoundarySQL(gameID string) string {
+	return fmt.Sprintf(`COALESCE((
+            SELECT MAX(b.at) FROM seasons s, LATERAL (VALUES (s.starts_at), (s.ends_at)) b(at)
+            WHERE s.game_id = %s AND b.at <= CURRENT_TIMESTAMP
+        ), '-infinity')`, gameID)
+}
+
+var seasonCache struct {
+	sync.RWMutex
+	boundaries map[string][]time.Time
+	loadedAt   time.Time
+}
+
+func invalidateSeasonCache() {
+	seasonCache.Lock()
+	seasonCache.boundaries = nil
+	seasonCache.Unlock()
+}
+
+// seasonBoundary is the Go side of seasonBoundarySQL: the zero time for games
+// without seasons.
+func seasonBoundary(gameID string) (time.Time, error) {
+	seasonCache.RLock()
+	boundaries, fresh := seasonCache.boundaries, time.Since(seasonCache.loadedAt) < gameCacheTTL
+	seasonCache.RUnlock()
+
+	if boundaries == nil || !fresh {
+		rows, err := storage.DB.Query("SELECT game_id, starts_at, ends_at FROM seasons")
+		if err != nil {
+			return time.Time{}, err
+		}
+		defer rows.Close()
+
+		boundaries = make(map[string][]time.Time)
+		for rows.Next() {
+			var id string
+			var startsAt, endsAt time.Time
+			if err := rows.Scan(&id, &startsAt, &endsAt); err != nil {
+				return time.Time{}, err
+			}
+			boundaries[id] = append(boundaries[id], startsAt, endsAt)
+		}
+		if err := rows.Err(); err != nil {
+			return time.Time{}, err
+		}
+
+		seasonCache.Lock()
+		seasonCache.boundaries, seasonCache.loadedAt = boundaries, time.Now()
+		seasonCache.Unlock()
+	}
+
+	var latest time.Time
+	now := time.Now()
+	for _, at := range boundaries[gameID] {
+		if !at.After(now) && at.After(latest) {
+			latest = at
+		}
+	}
+	return latest, nil
+}
+
+const seasonColumns = "game_id, number, name, starts_at, ends_at, archived_at"
+
+func scanSeason(row rowScanner) (models.Season, error) {
+	var season models.Season
+	var archivedAt sql.NullTime
+	err := row.Scan(&season.GameID, &season.Number, &season.Name, &season.StartsAt, &season.EndsAt, &archivedAt)
+	if err != nil {
+		return season, err
+	}
+
+	now := time.Now()
+	switch {
+	case archivedAt.Valid:
+		season.ArchivedAt = &archivedAt.Time
+		season.Status = models.SeasonArchived
+	case !season.EndsAt.After(now):
+		season.Status = models.SeasonEnded
+	case !season.StartsAt.After(now):
+		season.Status = models.SeasonActive
+	default:
+		season.Status = models.SeasonScheduled
+	}
+	return season, nil
+}
+
+// archiveSeason writes the final standings of a season, ranked from the
+// Postgres history of its submissions the way the live board ranks them. A
+// rated game's standings are the ratings its players finished the season
+// with (see seasonRatingsQuery).
+func archiveSeason(tx *sql.Tx, game models.Game, season models.Season) (int, error) {
+	source := aggregateHistoryQuery(game, "submitted_at >= $2 AND submitted_at < $3")
+	if game.Rated() {
+		source = seasonRatingsQuery
+	}
+	rows, err := tx.Query(`
+        SELECT username, aggregate_score
+        FROM (`+source+`
+        ) ranked
+        ORDER BY `+rankingOrder(game), game.GameID, season.StartsAt, season.EndsAt)
+	if err != nil {
+		return 0, err
+	}
+	var standings []models.SeasonStanding
+	for rows.Next() {
+		var standing models.SeasonStanding
+		if err := rows.Scan(&standing.Username, &standing.Score); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		standings = append(standings, standing)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("season_standings", "game_id", "season", "username", "score",
+		"rank", "standard_rank", "dense_rank", "top_percent", "tier"))
+	if err != nil {
+		return 0, err
+	}
+	total := int64(len(standings))
+	var standard, dense int64
+	for i, standing := range standings {
+		if i == 0 || standing.Score != standings[i-1].Score {
+			standard = int64(i) + 1
+			dense++
+		}
+		percent := topPercent(standard, total)
+		_, err := stmt.Exec(game.GameID, season.Number, standing.Username, standing.Score,
+			i+1, standard, dense, percent, tierFor(game, standing.Score, percent))
+		if err != nil {
+			stmt.Close()
+			return 0, err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return 0, err
+	}
+	return len(standings), stmt.Close()
+}
+
+// endNextSeason archives the earliest season that has ended and, unless
+// another season is already scheduled after it, starts the next one with the
+// length it was scheduled for. It returns the game of the archived season, or "" when there
+// is nothing to archive. Instances skip seasons another one is archiving.
+func endNextSeason() (string, error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	season, err := scanSeason(tx.QueryRow(`
+        SELECT ` + seasonColumns + ` FROM seasons
+        WHERE archived_at IS NULL AND ends_at <= CURRENT_TIMESTAMP
+        ORDER BY ends_at
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED
+    `))
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	game, err := lookupGame(season.GameID)
+	if err != nil {
+		return "", err
+	}
+	players, err := archiveSeason(tx, game, season)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tx.Exec(`
+        UPDATE seasons SET archived_at = CURRENT_TIMESTAMP
+        WHERE game_id = $1 AND number = $2
+    `, season.GameID, season.Number); err != nil {
+		return "", err
+	}
+
+	// The next season lasts as long as this one was scheduled for, even if
+	// it was ended early.
+	_, err = tx.Exec(`
+        INSERT INTO seasons (game_id, number, name, starts_at, ends_at, duration)
+        SELECT game_id, number + 1, 'Season ' || (number + 1), ends_at, ends_at + duration, duration
+        FROM seasons
+        WHERE game_id = $1 AND number = $2
+            AND NOT EXISTS (SELECT 1 FROM seasons WHERE game_id = $1 AND number > $2)
+    `, season.GameID, season.Number)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	log.Printf("Archived season %d of %s with %d players", season.Number, season.GameID, players)
+	return season.GameID, nil
+}
+
+// processSeasons archives every season that has ended, marks those that have
+// started, and rebuilds the boards of the games concerned so they only hold
+// the new season's submissions. Archived seasons are then paid out.
+func processSeasons() error {
+	reset := make(map[string]bool)
+	err := archiveEndedSeasons(reset)
+	if err == nil {
+		err = openStartedSeasons(reset)
+	}
+
+	// Boards of seasons already rolled over are reset even if a later one
+	// failed.
+	if len(reset) > 0 {
+		invalidateSeasonCache()
+	}
+	for gameID := range reset {
+		game, lookupErr := lookupGame(gameID)
+		if lookupErr != nil {
+			log.Printf("Failed to reset %s for the new season: %v", gameID, lookupErr)
+			continue
+		}
+		if err := RebuildBoard(game); err != nil {
+			log.Printf("Failed to reset %s for the new season: %v", gameID, err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return distributeArchivedSeasons()
+}
+
+// archiveEndedSeasons archives ended seasons one by one, adding their games to reset.
+func archiveEndedSeasons(reset map[string]bool) error {
+	for {
+		gameID, err := endNextSeason()
+		if err != nil || gameID == "" {
+			return err
+		}
+		reset[gameID] = true
+	}
+}
+
+// openStartedSeasons marks the seasons that have started since the last
+// check, adding their games to reset.
+func openStartedSeasons(reset map[string]bool) error {
+	rows, err := storage.DB.Query(`
+        UPDATE seasons SET opened_at = CURRENT_TIMESTAMP
+        WHERE opened_at IS NULL AND starts_at <= CURRENT_TIMESTAMP
+        RETURNING game_id
+    `)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var gameID string
+		if err := rows.Scan(&gameID); err != nil {
+			return err
+		}
+		reset[gameID] = true
+	}
+	return rows.Err()
+}
+
+// RunSeasonScheduler rolls seasons over as they start and end.
+func RunSeasonScheduler() {
+	ticker := time.NewTicker(seasonCheckInterval)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		if err := processSeasons(); err != nil {
+			log.Println("Season scheduler error:", err)
+		}
+	}
+}
+
+func SeasonsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListSeasons(w, r)
+	case http.MethodPost:
+		CreateSeason(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func ListSeasons(w http.ResponseWriter, r *http.Request) {
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	rows, err := storage.DB.Query("SELECT "+seasonColumns+" FROM seasons WHERE game_id = $1 ORDER BY number", game.GameID)
+	if err != nil {
+		http.Error(w, "Failed to list seasons", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	seasons := []models.Season{}
+	for rows.Next() {
+		season, err := scanSeason(rows)
+		if err != nil {
+			http.Error(w, "Failed to list seasons", http.StatusInternalServerError)
+			return
+		}
+		seasons = append(seasons, season)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seasons)
+}
+
+// CreateSeason schedules the next season of a game. It starts when the
+// previous one ends (or now) unless starts_at says otherwise, and may neither
+// start in the past nor overlap an earlier season.
+func CreateSeason(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var req struct {
+		GameID   string     `json:"game_id"`
+		Name     string     `json:"name"`
+		StartsAt *time.Time `json:"starts_at"`
+		EndsAt   time.Time  `json:"ends_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.GameID == "" {
+		req.GameID = "global"
+	}
+	game, ok := requireGame(w, req.GameID)
+	if !ok {
+		return
+	}
+
+	var lastEnd sql.NullTime
+	if err := storage.DB.QueryRow("SELECT MAX(ends_at) FROM seasons WHERE game_id = $1", game.GameID).Scan(&lastEnd); err != nil {
+		http.Error(w, "Failed to create season", http.StatusInternalServerError)
+		return
+	}
+	startsAt := time.Now()
+	if lastEnd.Valid && lastEnd.Time.After(startsAt) {
+		startsAt = lastEnd.Time
+	}
+	if req.StartsAt != nil {
+		if req.StartsAt.Before(time.Now()) {
+			http.Error(w, "starts_at must not be in the past", http.StatusBadRequest)
+			return
+		}
+		startsAt = *req.StartsAt
+	}
+	if !req.EndsAt.After(startsAt) {
+		http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+	if lastEnd.Valid && startsAt.Before(lastEnd.Time) {
+		http.Error(w, fmt.Sprintf("Seasons cannot overlap; the last one ends at %s", lastEnd.Time.Format(time.RFC3339)), http.StatusConflict)
+		return
+	}
+
+	season, err := scanSeason(storage.DB.QueryRow(`
+        INSERT INTO seasons (game_id, number, name, starts_at, ends_at, duration)
+        SELECT $1, COALESCE(MAX(number), 0) + 1, COALESCE(NULLIF($2, ''), 'Season ' || (COALESCE(MAX(number), 0) + 1)),
+            $3::timestamp, $4::timestamp, $4::timestamp - $3::timestamp
+        FROM seasons WHERE game_id = $1
+        RETURNING `+seasonColumns,
+		game.GameID, req.Name, startsAt, req.EndsAt))
+	if isUniqueViolation(err) {
+		http.Error(w, "Season was created concurrently, try again", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create season", http.StatusInternalServerError)
+		return
+	}
+	invalidateSeasonCache()
+
+	go func() {
+		if err := processSeasons(); err != nil {
+			log.Println("Season scheduler error:", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(season)
+}
+
+// EndSeason ends the running season of a game now and rolls over.
+func EndSeason(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+
+	season, err := scanSeason(storage.DB.QueryRow(`
+        UPDATE seasons SET ends_at = CURRENT_TIMESTAMP
+        WHERE game_id = $1 AND starts_at <= CURRENT_TIMESTAMP AND ends_at > CURRENT_TIMESTAMP
+        RETURNING `+seasonColumns, gameID))
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("No season of %q is running", gameID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to end season", http.StatusInternalServerError)
+		return
+	}
+	invalidateSeasonCache()
+
+	go func() {
+		if err := processSeasons(); err != nil {
+			log.Println("Season scheduler error:", err)
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(season)
+}
+
+// standingRankColumn is the season_standings column holding ranks under the
+// rank mode.
+func standingRankColumn(mode string) string {
+	switch mode {
+	case models.RankStandard:
+		return "standard_rank"
+	case models.RankDense:
+		return "dense_rank"
+	default:
+		return "rank"
+	}
+}
+
+// GetSeasonLeaderboard pages through the final standings of an archived
+// season.
+func GetSeasonLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	offset, limit, ok := parsePage(r)
+	if !ok {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	}
+
+	number, err := strconv.Atoi(r.URL.Query().Get("season"))
+	if err != nil {
+		http.Error(w, "Invalid season", http.StatusBadRequest)
+		return
+	}
+
+	season, err := scanSeason(storage.DB.QueryRow(
+		"SELECT "+seasonColumns+" FROM seasons WHERE game_id = $1 AND number = $2", gameID, number))
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Season %d of %q not found", number, gameID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get season", http.StatusInternalServerError)
+		return
+	}
+	if season.Status != models.SeasonArchived {
+		http.Error(w, fmt.Sprintf("Season %d is %s; its standings are archived when it ends", number, season.Status), http.StatusConflict)
+		return
+	}
+
+	var total int64
+	err = storage.DB.QueryRow("SELECT COUNT(*) FROM season_standings WHERE game_id = $1 AND season = $2",
+		gameID, number).Scan(&total)
+	if err != nil {
+		http.Error(w, "Failed to get season leaderboard", http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := storage.DB.Query(`
+        SELECT username, score, `+standingRankColumn(rankMode)+`, top_percent, tier
+        FROM season_standings
+        WHERE game_id = $1 AND season = $2
+        ORDER BY rank
+        LIMIT $3 OFFSET $4
+    `, gameID, number, limit, offset)
+	if err != nil {
+		http.Error(w, "Failed to get season leaderboard", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []models.LeaderboardEntry{}
+	for rows.Next() {
+		var entry models.LeaderboardEntry
+		if err := rows.Scan(&entry.Username, &entry.Score, &entry.Rank, &entry.TopPercent, &entry.Tier); err != nil {
+			http.Error(w, "Failed to get season leaderboard", http.StatusInternalServerError)
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"game_id":   season.GameID,
+		"season":    season.Number,
+		"name":      season.Name,
+		"starts_at": season.StartsAt,
+		"ends_at":   season.EndsAt,
+		"rank_mode": rankMode,
+		"total":     total,
+		"offset":    offset,
+		"limit":     limit,
+		"entries":   entries,
+	})
+}
+
+// GetSeasonHistory lists a player's final placement in every archived season
+// they played, optionally for one game.
+func GetSeasonHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "Username required", http.StatusBadRequest)
+		return
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	where := "st.username = $1"
+	args := []interface{}{username}
+	if gameID := r.URL.Query().Get("game_id"); gameID != "" {
+		if _, ok := requireGame(w, gameID); !ok {
+			return
+		}
+		where += " AND st.game_id = $2"
+		args = append(args, gameID)
+	}
+
+	rows, err := storage.DB.Query(`
+        SELECT st.game_id, st.season, s.name, st.score, st.`+standingRankColumn(rankMode)+`, st.top_percent, st.tier,
+            (SELECT COUNT(*) FROM season_standings p WHERE p.game_id = st.game_id AND p.season = st.season)
+        FROM season_standings st
+        JOIN seasons s ON s.game_id = st.game_id AND s.number = st.season
+        WHERE `+where+`
+        ORDER BY st.game_id, st.season
+    `, args...)
+	if err != nil {
+		http.Error(w, "Failed to get season history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []models.SeasonStanding{}
+	for rows.Next() {
+		standing := models.SeasonStanding{Username: username}
+		if err := rows.Scan(&standing.GameID, &standing.Season, &standing.SeasonName, &standing.Score,
+			&standing.Rank, &standing.TopPercent, &standing.Tier, &standing.Players); err != nil {
+			http.Error(w, "Failed to get season history", http.StatusInternalServerError)
+			return
+		}
+		history = append(history, standing)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"username":  username,
+		"rank_mode": rankMode,
+		"seasons":   history,
+	})
+}
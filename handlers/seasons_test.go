@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql/driver"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+	"time"
+)
+
+// useSeasons answers the next season boundary lookup with seasons, given as
+// game ID, start and end.
+func useSeasons(t *testing.T, mock sqlmock.Sqlmock, seasons ...[3]interface{}) {
+	t.Helper()
+	invalidateSeasonCache()
+	t.Cleanup(invalidateSeasonCache)
+	rows := sqlmock.NewRows([]string{"game_id", "starts_at", "ends_at"})
+	for _, s := range seasons {
+		rows.AddRow(s[0], s[1], s[2])
+	}
+	mock.ExpectQuery("SELECT game_id, starts_at, ends_at FROM seasons").WillReturnRows(rows)
+}
+
+func TestSeasonBoundary(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	tests := []struct {
+		name    string
+		seasons [][3]interface{}
+		want    time.Time
+	}{
+		{"no seasons", nil, time.Time{}},
+		{"first season scheduled", [][3]interface{}{{"g", now.Add(day), now.Add(8 * day)}}, time.Time{}},
+		{"first season running", [][3]interface{}{{"g", now.Add(-day), now.Add(day)}}, now.Add(-day)},
+		{"rolled over", [][3]interface{}{
+			{"g", now.Add(-15 * day), now.Add(-8 * day)},
+			{"g", now.Add(-8 * day), now.Add(6 * day)},
+			{"g", now.Add(6 * day), now.Add(20 * day)},
+		}, now.Add(-8 * day)},
+		// Between seasons the board starts empty at the end of the last one.
+		{"between seasons", [][3]interface{}{
+			{"g", now.Add(-15 * day), now.Add(-8 * day)},
+			{"g", now.Add(day), now.Add(8 * day)},
+		}, now.Add(-8 * day)},
+		{"other games ignored", [][3]interface{}{{"h", now.Add(-day), now.Add(day)}}, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := useTestDB(t)
+			useSeasons(t, mock, tt.seasons...)
+			got, err := seasonBoundary("g")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("seasonBoundary = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A submission made before the season rolled over but delivered after it
+// stays off the new season's board.
+func TestDeliverSubmissionFromEndedSeason(t *testing.T) {
+	mr := useTestRedis(t)
+	mock := useTestDB(t)
+	game := models.Game{
+		GameID:        "g",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortDescending,
+		TieBreakers:   []string{},
+	}
+	useTestGames(t, game)
+	rollover := time.Now().Add(-time.Hour)
+	sub := pendingSubmission{HistoryID: 7, GameID: "g", Username: "alice", Score: 100, SubmittedAt: rollover.Add(-time.Second)}
+
+	mock.ExpectQuery("SELECT t.tournament_id").
+		WithArgs("g", "alice", sub.SubmittedAt).
+		WillReturnRows(sqlmock.NewRows([]string{"tournament_id"}))
+	useSeasons(t, mock,
+		[3]interface{}{"g", rollover.Add(-7 * 24 * time.Hour), rollover},
+		[3]interface{}{"g", rollover, rollover.Add(7 * 24 * time.Hour)})
+
+	if _, err := deliverSubmission(sub); err != nil {
+		t.Fatal(err)
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("submission from the ended season wrote %v", keys)
+	}
+}
+
+// Final standings rank the season's submissions in [starts_at, ends_at) and
+// share standard and dense ranks, percentiles and tiers between ties.
+func TestArchiveSeason(t *testing.T) {
+	mock := useTestDB(t)
+	game := models.Game{
+		GameID:        "g",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortDescending,
+		TieBreakers:   []string{},
+		Tiers:         models.DefaultTiers(),
+	}
+	season := models.Season{GameID: "g", Number: 2, StartsAt: time.Now().Add(-48 * time.Hour), EndsAt: time.Now()}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`submitted_at >= \$2 AND submitted_at < \$3`).
+		WithArgs("g", season.StartsAt, season.EndsAt).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "aggregate_score"}).
+			AddRow("alice", 50.0).
+			AddRow("bob", 40.0).
+			AddRow("carol", 40.0).
+			AddRow("dave", 30.0))
+	copyIn := mock.ExpectPrepare("COPY")
+	for _, row := range [][]interface{}{
+		{"alice", 50.0, 1, 1, 1, 25.0, "Silver"},
+		{"bob", 40.0, 2, 2, 2, 50.0, "Bronze"},
+		{"carol", 40.0, 3, 2, 2, 50.0, "Bronze"},
+		{"dave", 30.0, 4, 4, 3, 100.0, "Bronze"},
+	} {
+		args := []driver.Value{"g", 2}
+		for _, v := range row {
+			args = append(args, v)
+		}
+		copyIn.ExpectExec().WithArgs(args...).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	copyIn.ExpectExec().WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	n, err := archiveSeason(tx, game, season)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("archived %d players, want 4", n)
+	}
+}
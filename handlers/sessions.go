@@ -0,0 +1,384 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Kinds of token revocation: a single access token by jti, or every access
+// token of a login session family.
+const (
+	revokeToken  = "token"
+	revokeFamily = "family"
+)
+
+// revocationsLoadedKey marks that Redis holds every live revocation. If it
+// is missing, e.g. after Redis lost its data, they are reloaded from
+// PostgreSQL before a token is accepted.
+const revocationsLoadedKey = "revoked:loaded"
+
+var (
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+var errTokenRevoked = errors.New("token revoked")
+
+// revocationsMu serializes reloading the revocation cache.
+var revocationsMu sync.Mutex
+
+// SetTokenLifetimes sets how long access and refresh tokens are valid.
+func SetTokenLifetimes(access, refresh string) error {
+	a, err := time.ParseDuration(access)
+	if err != nil {
+		return err
+	}
+	r, err := time.ParseDuration(refresh)
+	if err != nil {
+		return err
+	}
+	if a <= 0 || r <= a {
+		return errors.New("access token lifetime must be positive and shorter than the refresh token lifetime")
+	}
+	accessTokenTTL, refreshTokenTTL = a, r
+	return nil
+}
+
+// randomToken returns n random bytes, base64url encoded.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken is the form refresh tokens are stored in, so a leaked
+// table cannot be replayed.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// issueTokenPair stores a new refresh token of family for user and signs the
+// access token that goes with it.
+func issueTokenPair(q execer, user models.User, family string) (models.TokenPair, error) {
+	refresh, err := randomToken(32)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	_, err = q.Exec(`
+        INSERT INTO refresh_tokens (token_hash, family_id, username, expires_at)
+        VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * INTERVAL '1 millisecond')
+    `, hashRefreshToken(refresh), family, user.Username, refreshTokenTTL.Milliseconds())
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+
+	access, err := issueToken(user, family, accessTokenTTL)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	return models.TokenPair{
+		Token:            access,
+		TokenType:        "Bearer",
+		ExpiresIn:        int64(accessTokenTTL.Seconds()),
+		RefreshToken:     refresh,
+		RefreshExpiresIn: int64(refreshTokenTTL.Seconds()),
+	}, nil
+}
+
+// startSession starts a new login session family for user.
+func startSession(user models.User) (models.TokenPair, error) {
+	family, err := randomToken(16)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	// Expired refresh tokens can no longer be used or replayed.
+	if _, err := storage.DB.Exec("DELETE FROM refresh_tokens WHERE username = $1 AND expires_at < CURRENT_TIMESTAMP", user.Username); err != nil {
+		return models.TokenPair{}, err
+	}
+	return issueTokenPair(storage.DB, user, family)
+}
+
+func revocationKey(kind, value string) string {
+	return "revoked:" + kind + ":" + value
+}
+
+// revocationLifetime is how long a revocation has to be kept: until the
+// last access token it can cover has expired.
+func revocationLifetime() time.Duration {
+	return accessTokenTTL + clockSkew()
+}
+
+// revokeAccess records a revocation in PostgreSQL and the Redis cache.
+func revokeAccess(kind, value string) error {
+	lifetime := revocationLifetime()
+	_, err := storage.DB.Exec(`
+        INSERT INTO token_revocations (kind, value, expires_at)
+        VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond')
+        ON CONFLICT (kind, value) DO UPDATE SET expires_at = EXCLUDED.expires_at
+    `, kind, value, lifetime.Milliseconds())
+	if err != nil {
+		return err
+	}
+	return storage.RedisClient.Set(storage.RedisCtx, revocationKey(kind, value), 1, lifetime).Err()
+}
+
+// revokeFamilies revokes the refresh tokens and access tokens of the given
+// login session families.
+func revokeFamilies(families []string) error {
+	for _, family := range families {
+		_, err := storage.DB.Exec(
+			"UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE family_id = $1 AND revoked_at IS NULL",
+			family,
+		)
+		if err != nil {
+			return err
+		}
+		if err := revokeAccess(revokeFamily, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadRevocations copies the live revocations from PostgreSQL into Redis and
+// prunes the expired ones.
+func loadRevocations() error {
+	revocationsMu.Lock()
+	defer revocationsMu.Unlock()
+
+	if n, err := storage.RedisClient.Exists(storage.RedisCtx, revocationsLoadedKey).Result(); err != nil {
+		return err
+	} else if n == 1 {
+		return nil
+	}
+
+	if _, err := storage.DB.Exec("DELETE FROM token_revocations WHERE expires_at < CURRENT_TIMESTAMP"); err != nil {
+		return err
+	}
+	rows, err := storage.DB.Query(`
+        SELECT kind, value, EXTRACT(EPOCH FROM expires_at - CURRENT_TIMESTAMP) * 1000
+        FROM token_revocations
+    `)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	pipe := storage.RedisClient.Pipeline()
+	for rows.Next() {
+		var kind, value string
+		var ms float64
+		if err := rows.Scan(&kind, &value, &ms); err != nil {
+			return err
+		}
+		if ms > 0 {
+			pipe.Set(storage.RedisCtx, revocationKey(kind, value), 1, time.Duration(ms)*time.Millisecond)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	pipe.Set(storage.RedisCtx, revocationsLoadedKey, 1, 0)
+	_, err = pipe.Exec(storage.RedisCtx)
+	return err
+}
+
+// RehydrateRevocations fills the Redis revocation cache at startup.
+func RehydrateRevocations() {
+	if err := loadRevocations(); err != nil {
+		log.Println("Failed to load token revocations:", err)
+	}
+}
+
+// tokenRevoked reports whether the token or its family was revoked. It asks
+// Redis and falls back to PostgreSQL when Redis is unavailable.
+func tokenRevoked(claims *models.Claims) (bool, error) {
+	keys := []string{revocationKey(revokeToken, claims.ID)}
+	if claims.Family != "" {
+		keys = append(keys, revocationKey(revokeFamily, claims.Family))
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		var loaded, revoked *redis.IntCmd
+		_, err := storage.RedisClient.Pipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+			loaded = pipe.Exists(storage.RedisCtx, revocationsLoadedKey)
+			revoked = pipe.Exists(storage.RedisCtx, keys...)
+			return nil
+		})
+		if err != nil {
+			break
+		}
+		if loaded.Val() == 1 {
+			return revoked.Val() > 0, nil
+		}
+		if err := loadRevocations(); err != nil {
+			break
+		}
+	}
+
+	var revoked bool
+	err := storage.DB.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM token_revocations
+            WHERE expires_at > CURRENT_TIMESTAMP
+                AND ((kind = $1 AND value = $2) OR (kind = $3 AND value = $4))
+        )
+    `, revokeToken, claims.ID, revokeFamily, claims.Family).Scan(&revoked)
+	return revoked, err
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new token pair. Each
+// refresh token works once: presenting a used one again revokes its whole
+// family, since either the player or whoever stole the token is replaying it.
+func RefreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var family string
+	var user models.User
+	var expired, used, revoked bool
+	err = tx.QueryRow(`
+        SELECT t.family_id, u.user_id, u.username,
+            t.expires_at < CURRENT_TIMESTAMP, t.used_at IS NOT NULL, t.revoked_at IS NOT NULL
+        FROM refresh_tokens t
+        JOIN users u ON u.username = t.username
+        WHERE t.token_hash = $1
+        FOR UPDATE OF t
+    `, hashRefreshToken(req.RefreshToken)).Scan(&family, &user.UserId, &user.Username, &expired, &used, &revoked)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case revoked:
+		http.Error(w, "Refresh token revoked", http.StatusUnauthorized)
+		return
+	case used:
+		tx.Rollback()
+		log.Printf("Refresh token reuse by %s, revoking session %s", user.Username, family)
+		if err := revokeFamilies([]string{family}); err != nil {
+			http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Refresh token reuse detected. Log in again", http.StatusUnauthorized)
+		return
+	case expired:
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	_, err = tx.Exec("UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1", hashRefreshToken(req.RefreshToken))
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	pair, err := issueTokenPair(tx, user, family)
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+}
+
+// Logout ends the caller's session: its refresh tokens stop working and its
+// access tokens are revoked. With all=true every session of the caller ends.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var families []string
+	if r.URL.Query().Get("all") == "true" {
+		rows, err := storage.DB.Query(`
+            SELECT DISTINCT family_id FROM refresh_tokens
+            WHERE username = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+        `, claims.Username)
+		if err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var family string
+			if err := rows.Scan(&family); err != nil {
+				rows.Close()
+				http.Error(w, "Failed to log out", http.StatusInternalServerError)
+				return
+			}
+			families = append(families, family)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+	if claims.Family != "" {
+		families = append(families, claims.Family)
+	}
+
+	if err := revokeFamilies(families); err != nil {
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	// Tokens issued outside a session have no family to revoke.
+	if claims.ID != "" {
+		if err := revokeAccess(revokeToken, claims.ID); err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
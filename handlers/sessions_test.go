@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRefreshTokenReuseRevokesFamily(t *testing.T) {
+	mr := useTestKeys(t)
+	mock := useTestDB(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT t.family_id").
+		WithArgs(hashRefreshToken("stolen")).
+		WillReturnRows(sqlmock.NewRows([]string{"family_id", "user_id", "username", "expired", "used", "revoked"}).
+			AddRow("session", 1, "alice", false, true, false))
+	mock.ExpectRollback()
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").
+		WithArgs("session").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("INSERT INTO token_revocations").
+		WithArgs(revokeFamily, "session", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := httptest.NewRecorder()
+	RefreshTokenHandler(w, httptest.NewRequest(http.MethodPost, "/token/refresh", strings.NewReader(`{"refresh_token":"stolen"}`)))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if !mr.Exists(revocationKey(revokeFamily, "session")) {
+		t.Fatal("family revocation not cached in Redis")
+	}
+
+	// An access token of the family is refused, also once Redis lost the
+	// revocation and has to reload it from PostgreSQL.
+	claims := testClaims("alice", func(c *models.Claims) { c.Family = "session" })
+	token := signTestToken(t, jwt.SigningMethodHS256, []byte(testSecret), defaultSecretKID, claims)
+	handler := WithAuth(AuthRequired, func(w http.ResponseWriter, r *http.Request) {})
+	for _, emptyCache := range []bool{false, true} {
+		if emptyCache {
+			mr.FlushAll()
+			mock.ExpectExec("DELETE FROM token_revocations").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery("SELECT kind, value").
+				WillReturnRows(sqlmock.NewRows([]string{"kind", "value", "ms"}).AddRow(revokeFamily, "session", 60000.0))
+		}
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("empty cache %v: status = %d, want %d", emptyCache, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if !mr.Exists(revocationsLoadedKey) || !mr.Exists(revocationKey(revokeFamily, "session")) {
+		t.Error("revocations not reloaded into Redis")
+	}
+}
+
+func TestTokenRevokedFallsBackToPostgres(t *testing.T) {
+	mr := useTestRedis(t)
+	mock := useTestDB(t)
+	mr.Close()
+
+	mock.ExpectQuery("SELECT EXISTS").
+		WithArgs(revokeToken, "alice-jti", revokeFamily, "session").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	revoked, err := tokenRevoked(testClaims("alice", func(c *models.Claims) { c.Family = "session" }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revoked {
+		t.Error("revocation in PostgreSQL not honoured while Redis is down")
+	}
+}
@@ -0,0 +1,908 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"net/http"
+	"time"
+)
+
+// teamBoardKey is a game's team board: team IDs scored from their members'
+// contributions.
+func teamBoardKey(gameID string) string {
+	return "teams:leaderboard:" + gameID
+}
+
+// teamContributionsKey is the board of a team's members in a game, kept
+// under the game's policies from the submissions they made as members.
+func teamContributionsKey(teamID, gameID string) string {
+	return "team:" + teamID + ":board:" + gameID
+}
+
+// teamMembersKey is a hash of the team's members -> join time in unix
+// milliseconds, mirrored from Postgres. The team scripts only count a
+// submission while the member it was made by is still in it.
+func teamMembersKey(teamID string) string {
+	return "team:" + teamID + ":members"
+}
+
+// teamTopic names the WebSocket subscriptions for a game's team board;
+// leaderboardTopic adds the rank mode.
+func teamTopic(gameID string) string {
+	return gameID + "@teams"
+}
+
+// teamGame is the game used to page a team board. Teams tie by team ID and
+// have no tiers.
+func teamGame(game models.Game) models.Game {
+	game.GameID = teamBoardKey(game.GameID)
+	game.TieBreakers = []string{}
+	game.Tiers = nil
+	return game
+}
+
+// contributionsGame is the game used to page a team's contributions board.
+func contributionsGame(game models.Game, teamID string) models.Game {
+	game.GameID = teamContributionsKey(teamID, game.GameID)
+	game.Tiers = nil
+	return game
+}
+
+// teamScoreArgs are the team score method arguments of the team scripts.
+func teamScoreArgs(game models.Game) []interface{} {
+	ascending := 0
+	if game.Ascending() {
+		ascending = 1
+	}
+	return []interface{}{game.TeamAggregation, game.TeamBestN, ascending}
+}
+
+// teamMembership returns the player's team and when they joined it, or
+// sql.ErrNoRows when they are in none.
+func teamMembership(username string) (string, time.Time, error) {
+	var teamID string
+	var joinedAt time.Time
+	err := storage.DB.QueryRow("SELECT team_id, joined_at FROM team_members WHERE username = $1", username).
+		Scan(&teamID, &joinedAt)
+	return teamID, joinedAt, err
+}
+
+// applyTeamScores adds a submission to the team board of the submitter's
+// team, if they made it as a member, and broadcasts the new top 10.
+func applyTeamScores(game models.Game, sub pendingSubmission) error {
+	teamID, joinedAt, err := teamMembership(sub.Username)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if sub.SubmittedAt.Before(joinedAt) {
+		return nil
+	}
+
+	key := teamContributionsKey(teamID, game.GameID)
+	rebuild := rebuildKeysFor(key)
+	keys := append(boardScriptKeys(key), rebuild.lock)
+	keys = append(keys, boardScriptKeys(rebuild.board)...)
+	keys = append(keys, teamMembersKey(teamID), teamBoardKey(game.GameID))
+	args := scoreScriptArgs(game, sub.Username, sub.Score, sub.SubmittedAt, sub.HistoryID, sub.DeliveredBelow)
+	args = append(args, joinedAt.UnixMilli(), teamID, game.TeamAggregation, game.TeamBestN)
+
+	applied, err := storage.TeamScoreScript.Run(storage.RedisCtx, storage.RedisClient, keys, args...).Int()
+	if err != nil {
+		return err
+	}
+	if applied == 1 {
+		broadcastTeamBoard(game)
+	}
+	return nil
+}
+
+// rescoreTeam recomputes a team's score on the game's team board.
+func rescoreTeam(game models.Game, teamID string) error {
+	keys := []string{teamContributionsKey(teamID, game.GameID), teamBoardKey(game.GameID)}
+	args := append([]interface{}{teamID}, teamScoreArgs(game)...)
+	return storage.RescoreTeamScript.Run(storage.RedisCtx, storage.RedisClient, keys, args...).Err()
+}
+
+// syncTeamMembers rewrites the team's Redis member hash from Postgres.
+func syncTeamMembers(teamID string) error {
+	rows, err := storage.DB.Query("SELECT username, joined_at FROM team_members WHERE team_id = $1", teamID)
+	if err != nil {
+		return err
+	}
+	var members []interface{}
+	for rows.Next() {
+		var username string
+		var joinedAt time.Time
+		if err := rows.Scan(&username, &joinedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		members = append(members, username, joinedAt.UnixMilli())
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	key := teamMembersKey(teamID)
+	_, err = storage.RedisClient.TxPipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+		pipe.Del(storage.RedisCtx, key)
+		if len(members) > 0 {
+			pipe.HSet(storage.RedisCtx, key, members...)
+		}
+		return nil
+	})
+	return err
+}
+
+// teamHistoryFilter is an SQL condition on a leaderboard row l that holds
+// when it was submitted by a current member of the team whose ID is bound to
+// placeholder, since they joined.
+func teamHistoryFilter(placeholder string) string {
+	return `EXISTS (SELECT 1 FROM team_members m
+            WHERE m.team_id = ` + placeholder + ` AND m.username = l.username AND l.submitted_at >= m.joined_at)`
+}
+
+// rebuildTeamBoards rebuilds every team's contributions to the game from
+// Postgres and rescores the teams.
+func rebuildTeamBoards(game models.Game) error {
+	rows, err := storage.DB.Query("SELECT team_id FROM teams ORDER BY team_id")
+	if err != nil {
+		return err
+	}
+	var teamIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		teamIDs = append(teamIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, teamID := range teamIDs {
+		if err := syncTeamMembers(teamID); err != nil {
+			return err
+		}
+		err := rebuildBoard(game, teamContributionsKey(teamID, game.GameID), historyFilter{teamID: teamID})
+		if err == errRebuildRunning {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := rescoreTeam(game, teamID); err != nil {
+			return err
+		}
+	}
+	broadcastTeamBoard(game)
+	return nil
+}
+
+// teamGames returns the games that keep team boards: all but rated ones.
+func teamGames() ([]models.Game, error) {
+	games, err := loadGames()
+	if err != nil {
+		return nil, err
+	}
+	var scored []models.Game
+	for _, game := range games {
+		if !game.Rated() {
+			scored = append(scored, game)
+		}
+	}
+	return scored, nil
+}
+
+// dropTeamMember removes a departed member from the team's Redis state:
+// their later submissions stop counting and their contributions are taken
+// off the team boards.
+func dropTeamMember(teamID, username string) error {
+	if err := storage.RedisClient.HDel(storage.RedisCtx, teamMembersKey(teamID), username).Err(); err != nil {
+		return err
+	}
+	games, err := teamGames()
+	if err != nil {
+		return err
+	}
+	for _, game := range games {
+		keys := append(boardScriptKeys(teamContributionsKey(teamID, game.GameID)), teamBoardKey(game.GameID))
+		args := append([]interface{}{username, teamID}, teamScoreArgs(game)...)
+		if err := storage.RemoveTeamContributionScript.Run(storage.RedisCtx, storage.RedisClient, keys, args...).Err(); err != nil {
+			return err
+		}
+		broadcastTeamBoard(game)
+	}
+	return nil
+}
+
+// dropTeam removes a disbanded team from Redis.
+func dropTeam(teamID string) error {
+	if err := storage.RedisClient.Del(storage.RedisCtx, teamMembersKey(teamID)).Err(); err != nil {
+		return err
+	}
+	games, err := teamGames()
+	if err != nil {
+		return err
+	}
+	for _, game := range games {
+		keys := boardScriptKeys(teamContributionsKey(teamID, game.GameID))
+		_, err := storage.RedisClient.TxPipelined(storage.RedisCtx, func(pipe redis.Pipeliner) error {
+			pipe.Del(storage.RedisCtx, keys...)
+			pipe.ZRem(storage.RedisCtx, teamBoardKey(game.GameID), teamID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		broadcastTeamBoard(game)
+	}
+	return nil
+}
+
+// teamEntries turns entries of a team board into team entries with names.
+func teamEntries(entries []models.LeaderboardEntry) ([]models.TeamEntry, error) {
+	teams := make([]models.TeamEntry, len(entries))
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Username
+		teams[i] = models.TeamEntry{TeamID: entry.Username, Name: entry.Username, Score: entry.Score,
+			Rank: entry.Rank, TopPercent: entry.TopPercent}
+	}
+	if len(ids) == 0 {
+		return teams, nil
+	}
+
+	rows, err := storage.DB.Query("SELECT team_id, name FROM teams WHERE team_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		names[id] = name
+	}
+	for i := range teams {
+		if name, ok := names[teams[i].TeamID]; ok {
+			teams[i].Name = name
+		}
+	}
+	return teams, rows.Err()
+}
+
+// broadcastTeamBoard pushes the game's top 10 teams to the subscribers of
+// each rank mode of its team board.
+func broadcastTeamBoard(game models.Game) {
+	board := teamGame(game)
+	key := teamBoardKey(game.GameID)
+	for _, mode := range models.RankModes {
+		topic := leaderboardTopic(teamTopic(game.GameID), mode)
+		if !GlobalHub.HasSubscribers(topic) {
+			continue
+		}
+		entries, err := rangeBoard(board, key, 0, 9)
+		if err != nil {
+			return
+		}
+		if err := rankBoard(board, key, mode, entries); err != nil {
+			continue
+		}
+		teams, err := teamEntries(entries)
+		if err != nil {
+			continue
+		}
+		BroadcastLeaderboardUpdate(topic, map[string]interface{}{
+			"type":        "team_leaderboard_update",
+			"game_id":     game.GameID,
+			"rank_mode":   mode,
+			"leaderboard": teams,
+		})
+	}
+}
+
+const teamColumns = `t.team_id, t.name, t.created_at,
+    (SELECT COUNT(*) FROM team_members m WHERE m.team_id = t.team_id)`
+
+func scanTeam(row rowScanner) (models.Team, error) {
+	var t models.Team
+	err := row.Scan(&t.TeamID, &t.Name, &t.CreatedAt, &t.MemberCount)
+	return t, err
+}
+
+// getTeam returns a team with its members, owner first.
+func getTeam(teamID string) (models.Team, error) {
+	t, err := scanTeam(storage.DB.QueryRow("SELECT "+teamColumns+" FROM teams t WHERE t.team_id = $1", teamID))
+	if err != nil {
+		return t, err
+	}
+
+	rows, err := storage.DB.Query(`
+        SELECT username, role, joined_at
+        FROM team_members
+        WHERE team_id = $1
+        ORDER BY CASE role WHEN 'owner' THEN 0 WHEN 'officer' THEN 1 ELSE 2 END, joined_at, username
+    `, teamID)
+	if err != nil {
+		return t, err
+	}
+	defer rows.Close()
+	t.Members = []models.TeamMember{}
+	for rows.Next() {
+		var m models.TeamMember
+		if err := rows.Scan(&m.Username, &m.Role, &m.JoinedAt); err != nil {
+			return t, err
+		}
+		t.Members = append(t.Members, m)
+	}
+	return t, rows.Err()
+}
+
+// writeTeam responds with the team, or 404 when it no longer exists.
+func writeTeam(w http.ResponseWriter, teamID string, status int) {
+	t, err := getTeam(teamID)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Team %q not found", teamID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get team", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(t)
+}
+
+// TeamsHandler lists teams (GET), creates one (POST) and disbands one
+// (DELETE ?team_id=).
+func TeamsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListTeams(w, r)
+	case http.MethodPost:
+		CreateTeam(w, r)
+	case http.MethodDelete:
+		DisbandTeam(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListTeams returns one team with its members (?team_id=) or all teams.
+func ListTeams(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("team_id"); id != "" {
+		writeTeam(w, id, http.StatusOK)
+		return
+	}
+
+	rows, err := storage.DB.Query("SELECT " + teamColumns + " FROM teams t ORDER BY t.team_id")
+	if err != nil {
+		http.Error(w, "Failed to list teams", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	teams := []models.Team{}
+	for rows.Next() {
+		t, err := scanTeam(rows)
+		if err != nil {
+			http.Error(w, "Failed to list teams", http.StatusInternalServerError)
+			return
+		}
+		teams = append(teams, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(teams)
+}
+
+// CreateTeam creates a team owned by the caller, who must not be in one.
+func CreateTeam(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.Team
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !gameIDPattern.MatchString(req.TeamID) {
+		http.Error(w, "team_id must be 1-64 characters of a-z, 0-9, '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if req.Name == "" {
+		req.Name = req.TeamID
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create team", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO teams (team_id, name) VALUES ($1, $2)", req.TeamID, req.Name)
+	if isUniqueViolation(err) {
+		http.Error(w, "Team already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create team", http.StatusInternalServerError)
+		return
+	}
+	var joinedAt time.Time
+	err = tx.QueryRow(
+		"INSERT INTO team_members (team_id, username, role) VALUES ($1, $2, $3) RETURNING joined_at",
+		req.TeamID, claims.Username, models.TeamRoleOwner,
+	).Scan(&joinedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "Leave your current team first", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create team", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to create team", http.StatusInternalServerError)
+		return
+	}
+
+	if err := storage.RedisClient.HSet(storage.RedisCtx, teamMembersKey(req.TeamID), claims.Username, joinedAt.UnixMilli()).Err(); err != nil {
+		log.Printf("Failed to cache members of team %s: %v", req.TeamID, err)
+	}
+	writeTeam(w, req.TeamID, http.StatusCreated)
+}
+
+// DisbandTeam deletes the caller's team (?team_id=), which only its owner
+// may do. Its team board entries go with it.
+func DisbandTeam(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	teamID := r.URL.Query().Get("team_id")
+	result, err := storage.DB.Exec(`
+        DELETE FROM teams t
+        USING team_members m
+        WHERE m.team_id = t.team_id AND t.team_id = $1 AND m.username = $2 AND m.role = $3
+    `, teamID, claims.Username, models.TeamRoleOwner)
+	if err != nil {
+		http.Error(w, "Failed to disband team", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Only the team's owner can disband it", http.StatusForbidden)
+		return
+	}
+
+	if err := dropTeam(teamID); err != nil {
+		log.Printf("Failed to drop team %s from Redis: %v", teamID, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JoinTeam adds the caller to ?team_id=. Only their submissions from now on
+// count towards the team.
+func JoinTeam(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	teamID := r.URL.Query().Get("team_id")
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to join team", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Locking the team row serializes joins, so the size cap holds.
+	var members int
+	err = tx.QueryRow("SELECT team_id FROM teams WHERE team_id = $1 FOR UPDATE", teamID).Scan(&teamID)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Team %q not found", teamID), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to join team", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.QueryRow("SELECT COUNT(*) FROM team_members WHERE team_id = $1", teamID).Scan(&members); err != nil {
+		http.Error(w, "Failed to join team", http.StatusInternalServerError)
+		return
+	}
+	if members >= models.MaxTeamMembers {
+		http.Error(w, "Team is full", http.StatusConflict)
+		return
+	}
+
+	var joinedAt time.Time
+	err = tx.QueryRow(
+		"INSERT INTO team_members (team_id, username, role) VALUES ($1, $2, $3) RETURNING joined_at",
+		teamID, claims.Username, models.TeamRoleMember,
+	).Scan(&joinedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "Leave your current team first", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to join team", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to join team", http.StatusInternalServerError)
+		return
+	}
+
+	if err := storage.RedisClient.HSet(storage.RedisCtx, teamMembersKey(teamID), claims.Username, joinedAt.UnixMilli()).Err(); err != nil {
+		log.Printf("Failed to cache members of team %s: %v", teamID, err)
+	}
+	writeTeam(w, teamID, http.StatusOK)
+}
+
+// LeaveTeam removes the caller from their team, taking their contributions
+// with them. The owner must hand over ownership first unless they are the
+// last member, in which case the team is disbanded.
+func LeaveTeam(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to leave team", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var teamID, role string
+	err = tx.QueryRow("SELECT team_id, role FROM team_members WHERE username = $1 FOR UPDATE", claims.Username).
+		Scan(&teamID, &role)
+	if err == sql.ErrNoRows {
+		http.Error(w, "You are not in a team", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to leave team", http.StatusInternalServerError)
+		return
+	}
+
+	disband := false
+	if role == models.TeamRoleOwner {
+		var others int
+		err := tx.QueryRow("SELECT COUNT(*) FROM team_members WHERE team_id = $1 AND username <> $2",
+			teamID, claims.Username).Scan(&others)
+		if err != nil {
+			http.Error(w, "Failed to leave team", http.StatusInternalServerError)
+			return
+		}
+		if others > 0 {
+			http.Error(w, "Transfer ownership before leaving", http.StatusConflict)
+			return
+		}
+		disband = true
+	}
+
+	if disband {
+		_, err = tx.Exec("DELETE FROM teams WHERE team_id = $1", teamID)
+	} else {
+		_, err = tx.Exec("DELETE FROM team_members WHERE team_id = $1 AND username = $2", teamID, claims.Username)
+	}
+	if err != nil {
+		http.Error(w, "Failed to leave team", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to leave team", http.StatusInternalServerError)
+		return
+	}
+
+	if disband {
+		err = dropTeam(teamID)
+	} else {
+		err = dropTeamMember(teamID, claims.Username)
+	}
+	if err != nil {
+		// A rebuild of the game boards restores the team boards from
+		// Postgres.
+		log.Printf("Failed to remove %s from team %s in Redis: %v", claims.Username, teamID, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"team_id":   teamID,
+		"username":  claims.Username,
+		"disbanded": disband,
+	})
+}
+
+// TeamMembersHandler changes a member's role (PUT) or removes them from the
+// team (DELETE), for ?team_id=&username=.
+func TeamMembersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		SetTeamRole(w, r)
+	case http.MethodDelete:
+		KickTeamMember(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// teamRoles returns the roles of the caller and of username in the team,
+// locking both rows. A role is "" when the player is not a member.
+func teamRoles(tx *sql.Tx, teamID, caller, username string) (string, string, error) {
+	rows, err := tx.Query(`
+        SELECT username, role FROM team_members
+        WHERE team_id = $1 AND username IN ($2, $3)
+        FOR UPDATE
+    `, teamID, caller, username)
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+	var callerRole, role string
+	for rows.Next() {
+		var name, r string
+		if err := rows.Scan(&name, &r); err != nil {
+			return "", "", err
+		}
+		if name == caller {
+			callerRole = r
+		}
+		if name == username {
+			role = r
+		}
+	}
+	return callerRole, role, rows.Err()
+}
+
+// SetTeamRole makes a member an officer or a plain member. Only the owner
+// can change roles; giving a member the owner role hands over ownership and
+// makes the previous owner an officer.
+func SetTeamRole(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role != models.TeamRoleOwner && req.Role != models.TeamRoleOfficer && req.Role != models.TeamRoleMember {
+		http.Error(w, "Invalid role. Use: owner, officer, member", http.StatusBadRequest)
+		return
+	}
+
+	teamID, username := r.URL.Query().Get("team_id"), r.URL.Query().Get("username")
+	if username == claims.Username {
+		http.Error(w, "You cannot change your own role", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	callerRole, role, err := teamRoles(tx, teamID, claims.Username, username)
+	if err != nil {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
+	if callerRole != models.TeamRoleOwner {
+		http.Error(w, "Only the team's owner can change roles", http.StatusForbidden)
+		return
+	}
+	if role == "" {
+		http.Error(w, fmt.Sprintf("User %q is not in the team", username), http.StatusNotFound)
+		return
+	}
+
+	if req.Role == models.TeamRoleOwner {
+		_, err = tx.Exec("UPDATE team_members SET role = $3 WHERE team_id = $1 AND username = $2",
+			teamID, claims.Username, models.TeamRoleOfficer)
+		if err != nil {
+			http.Error(w, "Failed to change role", http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = tx.Exec("UPDATE team_members SET role = $3 WHERE team_id = $1 AND username = $2", teamID, username, req.Role)
+	if err != nil {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to change role", http.StatusInternalServerError)
+		return
+	}
+	writeTeam(w, teamID, http.StatusOK)
+}
+
+// KickTeamMember removes a member from the team, taking their contributions
+// with them. The owner can remove anyone else; officers only plain members.
+func KickTeamMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	teamID, username := r.URL.Query().Get("team_id"), r.URL.Query().Get("username")
+	if username == claims.Username {
+		http.Error(w, "Use /teams/leave to leave your team", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	callerRole, role, err := teamRoles(tx, teamID, claims.Username, username)
+	if err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	if callerRole != models.TeamRoleOwner && callerRole != models.TeamRoleOfficer {
+		http.Error(w, "Only the team's owner and officers can remove members", http.StatusForbidden)
+		return
+	}
+	if role == "" {
+		http.Error(w, fmt.Sprintf("User %q is not in the team", username), http.StatusNotFound)
+		return
+	}
+	if role == models.TeamRoleOwner || (callerRole == models.TeamRoleOfficer && role != models.TeamRoleMember) {
+		http.Error(w, "You cannot remove this member", http.StatusForbidden)
+		return
+	}
+
+	if _, err := tx.Exec("DELETE FROM team_members WHERE team_id = $1 AND username = $2", teamID, username); err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to remove member", http.StatusInternalServerError)
+		return
+	}
+
+	if err := dropTeamMember(teamID, username); err != nil {
+		log.Printf("Failed to remove %s from team %s in Redis: %v", username, teamID, err)
+	}
+	writeTeam(w, teamID, http.StatusOK)
+}
+
+// GetTeamLeaderboard pages through a game's team board (?game_id=), like
+// /leaderboard.
+func GetTeamLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+	if game.Rated() {
+		http.Error(w, "Rated games have no team boards", http.StatusBadRequest)
+		return
+	}
+
+	page, err := boardPage(r, teamGame(game), teamBoardKey(game.GameID), rankMode)
+	if err == errInvalidPage {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	} else if err == errInvalidCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+	page.GameID = game.GameID
+
+	teams, err := teamEntries(page.Entries)
+	if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		TeamAggregation string `json:"team_aggregation"`
+		*LeaderboardPage
+		Entries []models.TeamEntry `json:"entries"`
+	}{game.TeamAggregation, page, teams})
+}
+
+// GetTeamContributions pages through what each member of ?team_id= has
+// contributed to its score in ?game_id=.
+func GetTeamContributions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+	teamID := r.URL.Query().Get("team_id")
+	var exists bool
+	if err := storage.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM teams WHERE team_id = $1)", teamID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to get team", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, fmt.Sprintf("Team %q not found", teamID), http.StatusNotFound)
+		return
+	}
+	gameID := r.URL.Query().Get("game_id")
+	if gameID == "" {
+		gameID = "global"
+	}
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	page, err := boardPage(r, contributionsGame(game, teamID), teamContributionsKey(teamID, game.GameID), rankMode)
+	if err == errInvalidPage {
+		http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+		return
+	} else if err == errInvalidCursor {
+		http.Error(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+		return
+	}
+	page.GameID = game.GameID
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		TeamID string `json:"team_id"`
+		*LeaderboardPage
+	}{teamID, page})
+}
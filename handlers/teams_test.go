@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"github.com/DATA-DOG/go-sqlmock"
+	"testing"
+	"time"
+)
+
+func TestTeamScores(t *testing.T) {
+	tests := []struct {
+		name      string
+		sortOrder string
+		method    string
+		bestN     int
+		// The team's score with alice 50, bob 30 and carol 40, and after
+		// alice left.
+		want, afterLeave float64
+	}{
+		{"sum", models.SortDescending, models.TeamScoreSum, 0, 120, 70},
+		{"best 2", models.SortDescending, models.TeamScoreBestN, 2, 45, 35},
+		{"best 2 ascending", models.SortAscending, models.TeamScoreBestN, 2, 35, 35},
+		{"best 5 of fewer", models.SortDescending, models.TeamScoreBestN, 5, 40, 35},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTestRedis(t)
+			mock := useTestDB(t)
+			game := models.Game{
+				GameID:          "g",
+				Aggregation:     models.AggregationBest,
+				AverageWindow:   models.DefaultAverageWindow,
+				SortOrder:       tt.sortOrder,
+				TieBreakers:     []string{},
+				TeamAggregation: tt.method,
+				TeamBestN:       tt.bestN,
+			}
+			joinedAt := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+			err := storage.RedisClient.HSet(storage.RedisCtx, teamMembersKey("team"),
+				"alice", joinedAt.UnixMilli(), "bob", joinedAt.UnixMilli(), "carol", joinedAt.UnixMilli()).Err()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var historyID int64
+			submit := func(username string, score int, at time.Time) {
+				t.Helper()
+				mock.ExpectQuery("SELECT team_id, joined_at FROM team_members").
+					WithArgs(username).
+					WillReturnRows(sqlmock.NewRows([]string{"team_id", "joined_at"}).AddRow("team", joinedAt))
+				historyID++
+				sub := pendingSubmission{HistoryID: historyID, GameID: "g", Username: username, Score: score, SubmittedAt: at}
+				if err := applyTeamScores(game, sub); err != nil {
+					t.Fatal(err)
+				}
+			}
+			teamScore := func() float64 {
+				t.Helper()
+				score, err := storage.RedisClient.ZScore(storage.RedisCtx, teamBoardKey("g"), "team").Result()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return score
+			}
+
+			// Scores from before joining do not count.
+			submit("alice", 10, joinedAt.Add(-time.Minute))
+			submit("alice", 50, time.Now())
+			submit("bob", 30, time.Now())
+			submit("carol", 40, time.Now())
+			if got := teamScore(); got != tt.want {
+				t.Errorf("team score = %v, want %v", got, tt.want)
+			}
+
+			gameRow := sqlmock.NewRows([]string{"game_id", "game_name", "aggregation", "average_window", "sort_order",
+				"tie_breakers", "score_unit", "min_score", "max_score", "tiers", "team_aggregation", "team_best_n",
+				"archived_at", "created_at"}).
+				AddRow("g", "g", game.Aggregation, game.AverageWindow, game.SortOrder, "{}", "points", nil, nil,
+					[]byte("[]"), game.TeamAggregation, game.TeamBestN, nil, time.Now())
+			mock.ExpectQuery("SELECT .* FROM games").WillReturnRows(gameRow)
+			if err := dropTeamMember("team", "alice"); err != nil {
+				t.Fatal(err)
+			}
+			if got := teamScore(); got != tt.afterLeave {
+				t.Errorf("team score after alice left = %v, want %v", got, tt.afterLeave)
+			}
+
+			// A submission delivered after alice left, with the membership
+			// read before, is not counted either.
+			submit("alice", 90, time.Now())
+			if got := teamScore(); got != tt.afterLeave {
+				t.Errorf("team score after a late submission = %v, want %v", got, tt.afterLeave)
+			}
+			contributions, err := rangeBoard(contributionsGame(game, "team"), teamContributionsKey("team", "g"), 0, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range contributions {
+				if c.Username == "alice" {
+					t.Errorf("alice still contributes %v", c.Score)
+				}
+			}
+		})
+	}
+}
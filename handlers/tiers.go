@@ -0,0 +1,150 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"math"
+	"strconv"
+)
+
+// betterScore reports whether a ranks above b in the game's sort order.
+func betterScore(game models.Game, a, b float64) bool {
+	if game.Ascending() {
+		return a < b
+	}
+	return a > b
+}
+
+// topPercent is the share of the board at or above a standard competition
+// rank, so tied players share a percentile. It is rounded to two decimals.
+func topPercent(rank, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Round(float64(rank)/float64(total)*10000) / 100
+}
+
+// tierFor returns the first of the game's tiers that a score placed in the
+// top percent of the board qualifies for, or "" if none does.
+func tierFor(game models.Game, score, percent float64) string {
+	for _, tier := range game.Tiers {
+		switch {
+		case tier.TopPercent != nil:
+			if percent <= *tier.TopPercent {
+				return tier.Name
+			}
+		case tier.Threshold != nil:
+			if !betterScore(game, *tier.Threshold, score) {
+				return tier.Name
+			}
+		default:
+			return tier.Name
+		}
+	}
+	return ""
+}
+
+// placement returns the top percent and tier of a score on the board.
+func placement(game models.Game, key string, score float64, total int64) (float64, string, error) {
+	rank, err := scoreRank(game, key, models.RankStandard, 0, score)
+	if err != nil {
+		return 0, "", err
+	}
+	percent := topPercent(rank, total)
+	return percent, tierFor(game, score, percent), nil
+}
+
+// placeEntries sets TopPercent and Tier on consecutive entries of the board,
+// whatever rank mode their Rank was assigned under.
+func placeEntries(game models.Game, key string, entries []models.LeaderboardEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	total, err := storage.RedisClient.ZCard(storage.RedisCtx, key).Result()
+	if err != nil {
+		return err
+	}
+	first, err := scoreRank(game, key, models.RankStandard, 0, entries[0].Score)
+	if err != nil {
+		return err
+	}
+
+	// The page may start inside a tie, so the first score after it ranks
+	// below every member of the tie, not only those on the page.
+	rank, offset := first, int64(-1)
+	for i := range entries {
+		if i > 0 && entries[i].Score != entries[i-1].Score {
+			if offset < 0 {
+				score := strconv.FormatFloat(entries[0].Score, 'f', -1, 64)
+				tied, err := storage.RedisClient.ZCount(storage.RedisCtx, key, score, score).Result()
+				if err != nil {
+					return err
+				}
+				offset = first + tied - int64(i)
+			}
+			rank = offset + int64(i)
+		}
+		entries[i].TopPercent = topPercent(rank, total)
+		entries[i].Tier = tierFor(game, entries[i].Score, entries[i].TopPercent)
+	}
+	return nil
+}
+
+// announceTierChange tells the game's WebSocket subscribers when a
+// submission moved a player into another tier, or placed them in one for the
+// first time. previous is the player's score before the submission, nil on
+// their first.
+//
+// Only the submitting player is announced. Other players whose percentile
+// tier changed because the board grew or was overtaken are not.
+func announceTierChange(game models.Game, key, username string, previous *float64, value float64) (string, float64) {
+	total, err := storage.RedisClient.ZCard(storage.RedisCtx, key).Result()
+	if err != nil {
+		return "", 0
+	}
+	percent, tier, err := placement(game, key, value, total)
+	if err != nil {
+		return "", 0
+	}
+
+	var previousTier interface{}
+	if previous != nil {
+		if *previous == value {
+			return tier, percent
+		}
+		// Rank the previous score on the board as it was: without the
+		// player's new entry if it now counts as better.
+		rank, err := scoreRank(game, key, models.RankStandard, 0, *previous)
+		if err != nil {
+			return tier, percent
+		}
+		if betterScore(game, value, *previous) {
+			rank--
+		}
+		was := tierFor(game, *previous, topPercent(rank, total))
+		if was == tier {
+			return tier, percent
+		}
+		previousTier = was
+	} else if tier == "" {
+		return tier, percent
+	}
+
+	message := map[string]interface{}{
+		"type":          "tier_change",
+		"game_id":       game.GameID,
+		"username":      username,
+		"previous_tier": previousTier,
+		"tier":          tier,
+		"top_percent":   percent,
+	}
+	for _, mode := range models.RankModes {
+		if topic := leaderboardTopic(game.GameID, mode); GlobalHub.HasSubscribers(topic) {
+			BroadcastLeaderboardUpdate(topic, message)
+		}
+	}
+	if topic := aroundTopic(game.GameID); GlobalHub.HasSubscribers(topic) {
+		BroadcastLeaderboardUpdate(topic, message)
+	}
+	return tier, percent
+}
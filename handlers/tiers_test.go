@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTopPercent(t *testing.T) {
+	tests := []struct {
+		rank, total int64
+		want        float64
+	}{
+		{1, 1, 100},
+		{1, 3, 33.33},
+		{2, 3, 66.67},
+		{1, 1000, 0.1},
+		{10, 10, 100},
+		{0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := topPercent(tt.rank, tt.total); got != tt.want {
+			t.Errorf("topPercent(%d, %d) = %v, want %v", tt.rank, tt.total, got, tt.want)
+		}
+	}
+}
+
+// Tied players share a percentile, whichever rank mode their page was ranked
+// under.
+func TestPlaceEntriesTies(t *testing.T) {
+	for _, mode := range models.RankModes {
+		t.Run(mode, func(t *testing.T) {
+			useTestRedis(t)
+			game := models.Game{
+				GameID:        "g",
+				Aggregation:   models.AggregationBest,
+				AverageWindow: models.DefaultAverageWindow,
+				SortOrder:     models.SortAscending,
+				TieBreakers:   []string{models.TieBreakEarliest},
+				Tiers:         models.DefaultTiers(),
+			}
+			scores := []struct {
+				username string
+				score    int
+			}{{"alice", 10}, {"bob", 12}, {"carol", 12}, {"dave", 12}, {"erin", 15}}
+			base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			for i, s := range scores {
+				at := base.Add(time.Duration(i) * time.Second)
+				if _, err := applyScore(game, s.username, s.score, at, int64(i+1), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			key := gameBoardKey(game.GameID)
+			entries, err := rangeBoard(game, key, 2, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rankBoard(game, key, mode, entries); err != nil {
+				t.Fatal(err)
+			}
+			if err := placeEntries(game, key, entries); err != nil {
+				t.Fatal(err)
+			}
+
+			got := make([]float64, len(entries))
+			for i, e := range entries {
+				got[i] = e.TopPercent
+			}
+			if want := []float64{40, 40, 100}; !reflect.DeepEqual(got, want) {
+				t.Errorf("top percents = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// tierMessages runs announce with the game's top board subscribed to and
+// returns the messages it broadcast.
+func tierMessages(t *testing.T, game models.Game, announce func()) []map[string]interface{} {
+	t.Helper()
+	hub := NewHub()
+	topic := leaderboardTopic(game.GameID, models.RankOrdinal)
+	hub.clients[topic] = map[*Client]bool{{topic: topic}: true}
+	previous := GlobalHub
+	GlobalHub = hub
+	defer func() { GlobalHub = previous }()
+
+	done := make(chan struct{})
+	go func() {
+		announce()
+		close(done)
+	}()
+	var messages []map[string]interface{}
+	for {
+		select {
+		case m := <-hub.broadcast:
+			var message map[string]interface{}
+			if err := json.Unmarshal(m.Message, &message); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, message)
+		case <-done:
+			return messages
+		}
+	}
+}
+
+func TestAnnounceTierChange(t *testing.T) {
+	useTestRedis(t)
+	game := models.Game{
+		GameID:        "g",
+		Aggregation:   models.AggregationBest,
+		AverageWindow: models.DefaultAverageWindow,
+		SortOrder:     models.SortDescending,
+		TieBreakers:   []string{},
+		Tiers:         models.DefaultTiers(),
+	}
+	key := gameBoardKey(game.GameID)
+	submit := func(username string, score int, historyID int64) *float64 {
+		t.Helper()
+		applied, err := applyScore(game, username, score, time.Now(), historyID, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return applied.Previous
+	}
+
+	// A first placement is announced with no previous tier.
+	submit("alice", 50, 1)
+	messages := tierMessages(t, game, func() { announceTierChange(game, key, "alice", nil, 50) })
+	if len(messages) != 1 || messages[0]["previous_tier"] != nil || messages[0]["tier"] != "Bronze" {
+		t.Fatalf("first placement messages = %v, want one Bronze with no previous tier", messages)
+	}
+
+	for i := 2; i <= 10; i++ {
+		submit(fmt.Sprintf("player%d", i), 50+i, int64(i))
+	}
+	// bob enters last, in Bronze, then improves without leaving it.
+	submit("bob", 10, 11)
+	messages = tierMessages(t, game, func() { announceTierChange(game, key, "bob", nil, 10) })
+	if len(messages) != 1 {
+		t.Fatalf("bob's first placement: %d messages, want 1", len(messages))
+	}
+	previous := submit("bob", 20, 12)
+	messages = tierMessages(t, game, func() { announceTierChange(game, key, "bob", previous, 20) })
+	if len(messages) != 0 {
+		t.Errorf("move within Bronze announced: %v", messages)
+	}
+
+	// Rank 1 of 11 is the top 9.09%: Gold.
+	previous = submit("bob", 100, 13)
+	messages = tierMessages(t, game, func() { announceTierChange(game, key, "bob", previous, 100) })
+	if len(messages) != 1 || messages[0]["previous_tier"] != "Bronze" || messages[0]["tier"] != "Gold" {
+		t.Errorf("promotion messages = %v, want Bronze to Gold", messages)
+	}
+}
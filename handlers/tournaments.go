@@ -0,0 +1,589 @@
+package handlers
+
+import (
+	"Leaderboard/models"
+	"Leaderboard/storage"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const tournamentCheckInterval = 10 * time.Second
+
+// tournamentBoardKey is the Redis board of a running tournament. It is
+// dropped once the final standings are in Postgres.
+func tournamentBoardKey(tournamentID string) string {
+	return "tournament:" + tournamentID
+}
+
+// tournamentTopic names the WebSocket subscriptions for a tournament's board
+// and lifecycle events; leaderboardTopic adds the rank mode.
+func tournamentTopic(tournamentID string) string {
+	return "tournament@" + tournamentID
+}
+
+// tournamentGame is the game used to page a tournament board, so its cursors
+// are not accepted on other boards.
+func tournamentGame(game models.Game, tournamentID string) models.Game {
+	game.GameID = tournamentBoardKey(tournamentID)
+	return game
+}
+
+const tournamentColumns = `t.tournament_id, t.game_id, t.name, t.starts_at, t.ends_at, t.finalized_at, t.created_at,
+    (SELECT COUNT(*) FROM tournament_players p WHERE p.tournament_id = t.tournament_id)`
+
+func scanTournament(row rowScanner) (models.Tournament, error) {
+	var t models.Tournament
+	var finalizedAt sql.NullTime
+	err := row.Scan(&t.TournamentID, &t.GameID, &t.Name, &t.StartsAt, &t.EndsAt, &finalizedAt, &t.CreatedAt, &t.Players)
+	if err != nil {
+		return t, err
+	}
+
+	now := time.Now()
+	switch {
+	case finalizedAt.Valid:
+		t.FinalizedAt = &finalizedAt.Time
+		t.Status = models.TournamentFinal
+	case !t.EndsAt.After(now):
+		t.Status = models.TournamentEnded
+	case !t.StartsAt.After(now):
+		t.Status = models.TournamentRunning
+	default:
+		t.Status = models.TournamentRegistration
+	}
+	return t, nil
+}
+
+func getTournament(tournamentID string) (models.Tournament, error) {
+	return scanTournament(storage.DB.QueryRow(
+		"SELECT "+tournamentColumns+" FROM tournaments t WHERE t.tournament_id = $1", tournamentID))
+}
+
+// broadcastTournamentEvent sends a lifecycle event to every subscriber of the
+// tournament, whatever rank mode they follow.
+func broadcastTournamentEvent(t models.Tournament, event string, fields map[string]interface{}) {
+	message := map[string]interface{}{
+		"type":          event,
+		"tournament_id": t.TournamentID,
+		"game_id":       t.GameID,
+		"status":        t.Status,
+		"players":       t.Players,
+		"starts_at":     t.StartsAt,
+		"ends_at":       t.EndsAt,
+	}
+	for name, value := range fields {
+		message[name] = value
+	}
+	for _, mode := range models.RankModes {
+		if topic := leaderboardTopic(tournamentTopic(t.TournamentID), mode); GlobalHub.HasSubscribers(topic) {
+			BroadcastLeaderboardUpdate(topic, message)
+		}
+	}
+}
+
+// applyTournamentScores adds a submission to the board of every running
+// tournament of the game the player registered for, provided it was made
+// inside the tournament's window. Boards of finalized tournaments are locked.
+func applyTournamentScores(game models.Game, sub pendingSubmission) error {
+	rows, err := storage.DB.Query(`
+        SELECT t.tournament_id
+        FROM tournaments t
+        JOIN tournament_players p ON p.tournament_id = t.tournament_id
+        WHERE t.game_id = $1 AND p.username = $2 AND t.finalized_at IS NULL
+            AND t.starts_at <= $3 AND t.ends_at > $3
+    `, game.GameID, sub.Username, sub.SubmittedAt)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		key := tournamentBoardKey(id)
+		if _, err := applyToBoard(game, key, sub.Username, sub.Score, sub.SubmittedAt, sub.HistoryID, sub.DeliveredBelow); err != nil {
+			return err
+		}
+		broadcastTop(game, key, tournamentTopic(id), map[string]interface{}{"tournament_id": id})
+	}
+	return nil
+}
+
+// rebuildTournamentBoards rebuilds the boards of the game's running and
+// ended tournaments that are not finalized yet, from their players'
+// submissions inside each tournament's window.
+func rebuildTournamentBoards(game models.Game) error {
+	rows, err := storage.DB.Query(`
+        SELECT tournament_id, starts_at, ends_at
+        FROM tournaments
+        WHERE game_id = $1 AND finalized_at IS NULL AND starts_at <= CURRENT_TIMESTAMP
+        ORDER BY tournament_id
+    `, game.GameID)
+	if err != nil {
+		return err
+	}
+	var filters []historyFilter
+	for rows.Next() {
+		var f historyFilter
+		if err := rows.Scan(&f.tournamentID, &f.from, &f.to); err != nil {
+			rows.Close()
+			return err
+		}
+		filters = append(filters, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, f := range filters {
+		key := tournamentBoardKey(f.tournamentID)
+		if err := rebuildBoard(game, key, f); err != nil {
+			return err
+		}
+		// A tournament finalized during the rebuild has its standings in
+		// Postgres; drop the board the rebuild swapped back in.
+		t, err := getTournament(f.tournamentID)
+		if err != nil {
+			return err
+		}
+		if t.FinalizedAt != nil {
+			storage.RedisClient.Del(storage.RedisCtx, boardScriptKeys(key)...)
+		}
+	}
+	return nil
+}
+
+// finalizeNextTournament writes the final standings of the earliest
+// tournament that has ended, ranked from the Postgres history of its
+// players' submissions inside the window, and drops its Redis board.
+// Instances skip tournaments another one is finalizing.
+func finalizeNextTournament() (*models.Tournament, error) {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t, err := scanTournament(tx.QueryRow(`
+        SELECT ` + tournamentColumns + ` FROM tournaments t
+        WHERE t.finalized_at IS NULL AND t.ends_at <= CURRENT_TIMESTAMP
+        ORDER BY t.ends_at
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED
+    `))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	game, err := lookupGame(t.GameID)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+        SELECT username, aggregate_score
+        FROM (`+aggregateHistoryQuery(game, `submitted_at >= $2 AND submitted_at < $3
+            AND username IN (SELECT username FROM tournament_players WHERE tournament_id = $4)`)+`
+        ) ranked
+        ORDER BY `+rankingOrder(game), game.GameID, t.StartsAt, t.EndsAt, t.TournamentID)
+	if err != nil {
+		return nil, err
+	}
+	var entries []models.LeaderboardEntry
+	for rows.Next() {
+		var entry models.LeaderboardEntry
+		if err := rows.Scan(&entry.Username, &entry.Score); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var standard, dense int64
+	for i, entry := range entries {
+		if i == 0 || entry.Score != entries[i-1].Score {
+			standard = int64(i) + 1
+			dense++
+		}
+		_, err := tx.Exec(`
+            INSERT INTO tournament_results (tournament_id, username, score, rank, standard_rank, dense_rank)
+            VALUES ($1, $2, $3, $4, $5, $6)
+        `, t.TournamentID, entry.Username, entry.Score, i+1, standard, dense)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.QueryRow(
+		"UPDATE tournaments SET finalized_at = CURRENT_TIMESTAMP WHERE tournament_id = $1 RETURNING finalized_at",
+		t.TournamentID).Scan(&t.FinalizedAt); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	t.Status = models.TournamentFinal
+
+	storage.RedisClient.Del(storage.RedisCtx, boardScriptKeys(tournamentBoardKey(t.TournamentID))...)
+	log.Printf("Finalized tournament %s with %d players", t.TournamentID, len(entries))
+	return &t, nil
+}
+
+// processTournaments announces tournaments that have started and publishes
+// the results of those that have ended.
+func processTournaments() error {
+	rows, err := storage.DB.Query(`
+        UPDATE tournaments SET started_at = CURRENT_TIMESTAMP
+        WHERE started_at IS NULL AND starts_at <= CURRENT_TIMESTAMP AND finalized_at IS NULL
+        RETURNING tournament_id
+    `)
+	if err != nil {
+		return err
+	}
+	var started []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		started = append(started, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range started {
+		if t, err := getTournament(id); err == nil {
+			broadcastTournamentEvent(t, "tournament_started", nil)
+		}
+	}
+
+	for {
+		t, err := finalizeNextTournament()
+		if err != nil || t == nil {
+			return err
+		}
+		standings, _, err := tournamentResults(t.TournamentID, models.RankOrdinal, 0, 10)
+		if err != nil {
+			return err
+		}
+		broadcastTournamentEvent(*t, "tournament_ended", map[string]interface{}{
+			"leaderboard": standings,
+		})
+	}
+}
+
+// RunTournamentScheduler starts and ends tournaments on time.
+func RunTournamentScheduler() {
+	ticker := time.NewTicker(tournamentCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := processTournaments(); err != nil {
+			log.Println("Tournament scheduler error:", err)
+		}
+	}
+}
+
+// tournamentResults reads a page of a finalized tournament's standings and
+// their total.
+func tournamentResults(tournamentID, rankMode string, offset, limit int64) ([]models.LeaderboardEntry, int64, error) {
+	var total int64
+	err := storage.DB.QueryRow("SELECT COUNT(*) FROM tournament_results WHERE tournament_id = $1", tournamentID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := storage.DB.Query(`
+        SELECT username, score, `+standingRankColumn(rankMode)+`
+        FROM tournament_results
+        WHERE tournament_id = $1
+        ORDER BY rank
+        LIMIT $2 OFFSET $3
+    `, tournamentID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	entries := []models.LeaderboardEntry{}
+	for rows.Next() {
+		var entry models.LeaderboardEntry
+		if err := rows.Scan(&entry.Username, &entry.Score, &entry.Rank); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, total, rows.Err()
+}
+
+func TournamentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ListTournaments(w, r)
+	case http.MethodPost:
+		CreateTournament(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// ListTournaments returns one tournament (?tournament_id=) or all of them,
+// optionally of one game (?game_id=).
+func ListTournaments(w http.ResponseWriter, r *http.Request) {
+	if id := r.URL.Query().Get("tournament_id"); id != "" {
+		t, err := getTournament(id)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Tournament %q not found", id), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get tournament", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+		return
+	}
+
+	query := "SELECT " + tournamentColumns + " FROM tournaments t"
+	var args []interface{}
+	if gameID := r.URL.Query().Get("game_id"); gameID != "" {
+		query += " WHERE t.game_id = $1"
+		args = append(args, gameID)
+	}
+	rows, err := storage.DB.Query(query+" ORDER BY t.starts_at DESC", args...)
+	if err != nil {
+		http.Error(w, "Failed to list tournaments", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tournaments := []models.Tournament{}
+	for rows.Next() {
+		t, err := scanTournament(rows)
+		if err != nil {
+			http.Error(w, "Failed to list tournaments", http.StatusInternalServerError)
+			return
+		}
+		tournaments = append(tournaments, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tournaments)
+}
+
+func CreateTournament(w http.ResponseWriter, r *http.Request) {
+	if _, ok := requireAdmin(w, r); !ok {
+		return
+	}
+
+	var req models.Tournament
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !gameIDPattern.MatchString(req.TournamentID) {
+		http.Error(w, "tournament_id must be 1-64 characters of a-z, 0-9, '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if req.GameID == "" {
+		req.GameID = "global"
+	}
+	if req.Name == "" {
+		req.Name = req.TournamentID
+	}
+	if !req.StartsAt.After(time.Now()) {
+		http.Error(w, "starts_at must be in the future so players can register", http.StatusBadRequest)
+		return
+	}
+	if !req.EndsAt.After(req.StartsAt) {
+		http.Error(w, "ends_at must be after starts_at", http.StatusBadRequest)
+		return
+	}
+	game, ok := requireGame(w, req.GameID)
+	if !ok {
+		return
+	}
+	if game.Rated() {
+		http.Error(w, "Tournaments rank submitted scores; rated games have none", http.StatusBadRequest)
+		return
+	}
+
+	_, err := storage.DB.Exec(`
+        INSERT INTO tournaments (tournament_id, game_id, name, starts_at, ends_at)
+        VALUES ($1, $2, $3, $4, $5)
+    `, req.TournamentID, game.GameID, req.Name, req.StartsAt, req.EndsAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "Tournament already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create tournament", http.StatusInternalServerError)
+		return
+	}
+
+	t, err := getTournament(req.TournamentID)
+	if err != nil {
+		http.Error(w, "Failed to get tournament", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+// TournamentRegistrationHandler registers the caller for ?tournament_id=
+// (POST) or withdraws them (DELETE). Both close when the tournament starts.
+func TournamentRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := requireUser(w, r)
+	if !ok {
+		return
+	}
+
+	id := r.URL.Query().Get("tournament_id")
+	t, err := getTournament(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Tournament %q not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get tournament", http.StatusInternalServerError)
+		return
+	}
+
+	if t.Status != models.TournamentRegistration {
+		http.Error(w, fmt.Sprintf("Registration for %q is closed", id), http.StatusConflict)
+		return
+	}
+
+	// The start time is checked again in SQL so a request racing the start
+	// cannot slip in.
+	var result sql.Result
+	if r.Method == http.MethodPost {
+		result, err = storage.DB.Exec(`
+            INSERT INTO tournament_players (tournament_id, username)
+            SELECT $1, $2 FROM tournaments WHERE tournament_id = $1 AND starts_at > CURRENT_TIMESTAMP
+            ON CONFLICT DO NOTHING
+        `, t.TournamentID, claims.Username)
+	} else {
+		result, err = storage.DB.Exec(`
+            DELETE FROM tournament_players p
+            USING tournaments t
+            WHERE p.tournament_id = t.tournament_id AND t.tournament_id = $1 AND p.username = $2
+                AND t.starts_at > CURRENT_TIMESTAMP
+        `, t.TournamentID, claims.Username)
+	}
+	if err != nil {
+		http.Error(w, "Failed to update registration", http.StatusInternalServerError)
+		return
+	}
+
+	registered := r.Method == http.MethodPost
+	if n, _ := result.RowsAffected(); n > 0 {
+		if t, err = getTournament(id); err == nil {
+			broadcastTournamentEvent(t, "tournament_registration", map[string]interface{}{
+				"username":   claims.Username,
+				"registered": registered,
+			})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tournament_id": t.TournamentID,
+		"username":      claims.Username,
+		"registered":    registered,
+		"players":       t.Players,
+	})
+}
+
+// GetTournamentLeaderboard pages through a tournament's live board while it
+// runs and its final standings once published. Final standings page by
+// offset only.
+func GetTournamentLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	id := r.URL.Query().Get("tournament_id")
+	t, err := getTournament(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("Tournament %q not found", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to get tournament", http.StatusInternalServerError)
+		return
+	}
+
+	page := &LeaderboardPage{GameID: t.GameID, RankMode: rankMode}
+	if t.Status == models.TournamentFinal {
+		offset, limit, ok := parsePage(r)
+		if !ok {
+			http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		page.Offset, page.Limit = offset, limit
+		page.Entries, page.Total, err = tournamentResults(t.TournamentID, rankMode, offset, limit)
+		if err != nil {
+			http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		game, ok := requireGame(w, t.GameID)
+		if !ok {
+			return
+		}
+		page, err = boardPage(r, tournamentGame(game, t.TournamentID), tournamentBoardKey(t.TournamentID), rankMode)
+		if err == errInvalidPage {
+			http.Error(w, "Invalid offset or limit. limit must be between 1 and 100", http.StatusBadRequest)
+			return
+		} else if err == errInvalidCursor {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get leaderboard", http.StatusInternalServerError)
+			return
+		}
+		page.GameID = game.GameID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		TournamentID string `json:"tournament_id"`
+		Status       string `json:"status"`
+		*LeaderboardPage
+	}{t.TournamentID, t.Status, page})
+}
@@ -1,7 +1,10 @@
 package handlers
 
 import (
+	"Leaderboard/models"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
@@ -17,30 +20,46 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
-	hub    *Hub
-	conn   *websocket.Conn
-	send   chan []byte
-	gameID string
+	hub   *Hub
+	conn  *websocket.Conn
+	send  chan []byte
+	topic string
+
+	// Set for "around me" subscriptions, which get their own window of the
+	// board instead of the shared top 10.
+	gameID   string
+	rankMode string
+	username string
+	around   int64
 }
 
 type Hub struct {
 	clients    map[string]map[*Client]bool
 	broadcast  chan *BroadcastMessage
+	direct     chan *directMessage
 	register   chan *Client
 	unregister chan *Client
 	mu         sync.RWMutex
 }
 
+// BroadcastMessage is delivered to every client subscribed to Topic.
 type BroadcastMessage struct {
-	GameID  string
+	Topic   string
 	Message []byte
 }
 
+// directMessage is delivered to a single client, if it is still connected.
+type directMessage struct {
+	client  *Client
+	message []byte
+}
+
 var GlobalHub = NewHub()
 
 func NewHub() *Hub {
 	return &Hub{
 		broadcast:  make(chan *BroadcastMessage),
+		direct:     make(chan *directMessage),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[string]map[*Client]bool),
@@ -52,25 +71,25 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
-			if h.clients[client.gameID] == nil {
-				h.clients[client.gameID] = make(map[*Client]bool)
+			if h.clients[client.topic] == nil {
+				h.clients[client.topic] = make(map[*Client]bool)
 			}
-			h.clients[client.gameID][client] = true
+			h.clients[client.topic][client] = true
 			h.mu.Unlock()
-			log.Printf("Client registered for game: %s. Total: %d", client.gameID, len(h.clients[client.gameID]))
+			log.Printf("Client registered for topic: %s. Total: %d", client.topic, len(h.clients[client.topic]))
 
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.gameID][client]; ok {
-				delete(h.clients[client.gameID], client)
+			if _, ok := h.clients[client.topic][client]; ok {
+				delete(h.clients[client.topic], client)
 				close(client.send)
-				log.Printf("Client unregistered from game: %s", client.gameID)
+				log.Printf("Client unregistered from topic: %s", client.topic)
 			}
 			h.mu.Unlock()
 
 		case message := <-h.broadcast:
 			h.mu.RLock()
-			clients := h.clients[message.GameID]
+			clients := h.clients[message.Topic]
 			h.mu.RUnlock()
 
 			for client := range clients {
@@ -79,14 +98,65 @@ func (h *Hub) Run() {
 				default:
 					h.mu.Lock()
 					close(client.send)
-					delete(h.clients[message.GameID], client)
+					delete(h.clients[message.Topic], client)
 					h.mu.Unlock()
 				}
 			}
+
+		case message := <-h.direct:
+			client := message.client
+			h.mu.RLock()
+			_, ok := h.clients[client.topic][client]
+			h.mu.RUnlock()
+			if !ok {
+				continue
+			}
+
+			select {
+			case client.send <- message.message:
+			default:
+				h.mu.Lock()
+				close(client.send)
+				delete(h.clients[client.topic], client)
+				h.mu.Unlock()
+			}
 		}
 	}
 }
 
+// HasSubscribers reports whether any client is subscribed to topic.
+func (h *Hub) HasSubscribers(topic string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[topic]) > 0
+}
+
+// subscribers returns the clients currently subscribed to topic.
+func (h *Hub) subscribers(topic string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients[topic]))
+	for client := range h.clients[topic] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// aroundTopic names the "around me" subscriptions of a game. Each of its
+// clients is sent its own window.
+func aroundTopic(gameID string) string {
+	return gameID + "@around"
+}
+
+// leaderboardTopic names the subscription for a game's board under a rank
+// mode; ordinal subscribers keep the plain game ID.
+func leaderboardTopic(gameID, rankMode string) string {
+	if rankMode == models.RankOrdinal {
+		return gameID
+	}
+	return gameID + "#" + rankMode
+}
+
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister <- c
@@ -114,32 +184,124 @@ func (c *Client) writePump() {
 	}
 }
 
+// ServeWs subscribes a client to a game's top 10, all-time or for the current
+// day, week or month (period=), to a tournament's board and lifecycle events
+// (tournament_id=), to the game's team board (teams=true), or with around=N
+// to the N players above and below the authenticated user. Browsers cannot
+// set headers on WebSocket requests, so the token may be passed as ?token=.
 func ServeWs(w http.ResponseWriter, r *http.Request) {
 	gameID := r.URL.Query().Get("game_id")
 	if gameID == "" {
 		gameID = "global"
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println("WebSocket upgrade error:", err)
+	game, ok := requireGame(w, gameID)
+	if !ok {
+		return
+	}
+
+	rankMode, ok := parseRankMode(r)
+	if !ok {
+		http.Error(w, "Invalid rank_mode. Use: ordinal, standard, dense", http.StatusBadRequest)
+		return
+	}
+
+	window, err := parsePeriod(r, gameID)
+	if err != nil || (window.Period != periodAll && r.URL.Query().Get("period_start") != "") {
+		http.Error(w, "Invalid period. Use: all, day, week, month", http.StatusBadRequest)
 		return
 	}
 
 	client := &Client{
-		hub:    GlobalHub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		gameID: gameID,
+		hub:   GlobalHub,
+		send:  make(chan []byte, 256),
+		topic: leaderboardTopic(gameID, rankMode),
+	}
+	if window.Period != periodAll {
+		client.topic = leaderboardTopic(periodTopic(gameID, window.Period), rankMode)
 	}
 
+	tournamentID := r.URL.Query().Get("tournament_id")
+	if tournamentID != "" {
+		if window.Period != periodAll {
+			http.Error(w, "period is not available for tournaments", http.StatusBadRequest)
+			return
+		}
+		if _, err := getTournament(tournamentID); err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Tournament %q not found", tournamentID), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to get tournament", http.StatusInternalServerError)
+			return
+		}
+		client.topic = leaderboardTopic(tournamentTopic(tournamentID), rankMode)
+	}
+
+	teams := r.URL.Query().Get("teams") == "true"
+	if teams {
+		if window.Period != periodAll || tournamentID != "" {
+			http.Error(w, "teams is only available on the all-time board", http.StatusBadRequest)
+			return
+		}
+		client.topic = leaderboardTopic(teamTopic(gameID), rankMode)
+	}
+
+	if r.URL.Query().Get("around") != "" {
+		if window.Period != periodAll || tournamentID != "" || teams {
+			http.Error(w, "around is only available on the all-time board", http.StatusBadRequest)
+			return
+		}
+		n, ok := parseAroundSize(r, "around")
+		if !ok {
+			http.Error(w, "Invalid around. Use a number between 1 and 50", http.StatusBadRequest)
+			return
+		}
+		claims, ok := requireUser(w, r)
+		if !ok {
+			return
+		}
+		client.topic = aroundTopic(gameID)
+		client.gameID = gameID
+		client.rankMode = rankMode
+		client.username = claims.Username
+		client.around = n
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("WebSocket upgrade error:", err)
+		return
+	}
+	client.conn = conn
+
 	client.hub.register <- client
 
 	go client.writePump()
 	go client.readPump()
+
+	if client.around > 0 {
+		sendAroundWindow(game, client)
+	}
+}
+
+// sendAroundWindow sends an "around me" client its current window. Nothing is
+// sent while the user is not on the board.
+func sendAroundWindow(game models.Game, client *Client) {
+	payload, err := aroundPayload(game, client.rankMode, client.username, client.around)
+	if err != nil {
+		return
+	}
+	payload["type"] = "around_update"
+
+	message, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Error marshaling around update:", err)
+		return
+	}
+	client.hub.direct <- &directMessage{client: client, message: message}
 }
 
-func BroadcastLeaderboardUpdate(gameID string, data interface{}) {
+func BroadcastLeaderboardUpdate(topic string, data interface{}) {
 	message, err := json.Marshal(data)
 	if err != nil {
 		log.Println("Error marshaling leaderboard update:", err)
@@ -147,7 +309,7 @@ func BroadcastLeaderboardUpdate(gameID string, data interface{}) {
 	}
 
 	GlobalHub.broadcast <- &BroadcastMessage{
-		GameID:  gameID,
+		Topic:   topic,
 		Message: message,
 	}
 }
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"Leaderboard/config"
 	"Leaderboard/handlers"
 	"Leaderboard/storage"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func enableCORS(next http.Handler) http.Handler {
@@ -23,33 +30,190 @@ func enableCORS(next http.Handler) http.Handler {
 	})
 }
 
+// reconcile compares Redis boards with the PostgreSQL history and optionally
+// repairs them. It exits with status 1 when drift remains.
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	games := flags.String("game", "", "comma separated game IDs to check (default: every game with history)")
+	repair := flags.Bool("repair", false, "fix drifted entries in Redis")
+	dryRun := flags.Bool("dry-run", false, "with -repair, only report what would be fixed")
+	flags.Parse(args)
+
+	var gameIDs []string
+	if *games != "" {
+		gameIDs = strings.Split(*games, ",")
+	}
+
+	reports, err := handlers.ReconcileBoards(gameIDs, *repair, *dryRun)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(reports)
+	if err != nil {
+		log.Fatal("Reconciliation failed:", err)
+	}
+
+	for _, report := range reports {
+		if !report.InSync() && report.Repaired < len(report.Drift) {
+			os.Exit(1)
+		}
+	}
+}
+
+// migrate applies (up [version]) or rolls back (down [steps]) schema
+// migrations, or lists them (status).
+func migrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: migrate up [version] | down [steps] | status")
+	}
+
+	number := func(def int) int {
+		if len(args) < 2 {
+			return def
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			log.Fatalf("Invalid number %q", args[1])
+		}
+		return n
+	}
+
+	switch args[0] {
+	case "up":
+		n, err := storage.MigrateUp(number(0))
+		if err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		fmt.Printf("Applied %d migrations\n", n)
+	case "down":
+		n, err := storage.MigrateDown(number(1))
+		if err != nil {
+			log.Fatal("Rollback failed:", err)
+		}
+		fmt.Printf("Rolled back %d migrations\n", n)
+	case "status":
+		states, err := storage.MigrationStatus()
+		if err != nil {
+			log.Fatal("Failed to get migration status:", err)
+		}
+		for _, state := range states {
+			applied := "pending"
+			if state.AppliedAt != nil {
+				applied = "applied " + state.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", state.Version, state.Name, applied)
+		}
+	default:
+		log.Fatal("Usage: migrate up [version] | down [steps] | status")
+	}
+}
+
 func main() {
 	if err := storage.InitDB(); err != nil {
 		log.Fatal("Failed to initialize database:", err)
 	}
 	defer storage.CloseDB()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+
+	if _, err := storage.MigrateUp(0); err != nil {
+		log.Fatal("Failed to migrate database:", err)
+	}
+
 	if err := storage.InitRedis(); err != nil {
 		log.Fatal("Failed to initialize Redis:", err)
 	}
 	defer storage.CloseRedis()
 
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		reconcile(os.Args[2:])
+		return
+	}
+
+	if interval := config.LoadConfig().ReconcileInterval; interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatal("Invalid RECONCILE_INTERVAL:", err)
+		}
+		go handlers.RunReconciler(d)
+	}
+
+	cfg := config.LoadConfig()
+	if err := handlers.LoadSigningKeys(); err != nil {
+		log.Fatal("Invalid JWT keys:", err)
+	}
+	if err := handlers.SetTokenLifetimes(cfg.AccessTokenTTL, cfg.RefreshTokenTTL); err != nil {
+		log.Fatal("Invalid ACCESS_TOKEN_TTL or REFRESH_TOKEN_TTL:", err)
+	}
+	handlers.RehydrateRevocations()
+	if err := handlers.SetPeriodClock(cfg.PeriodTimezone, cfg.WeekStart); err != nil {
+		log.Fatal("Invalid PERIOD_TIMEZONE or WEEK_START:", err)
+	}
+
+	compositeInterval, err := time.ParseDuration(config.LoadConfig().CompositeRefreshInterval)
+	if err != nil {
+		log.Fatal("Invalid COMPOSITE_REFRESH_INTERVAL:", err)
+	}
+	go handlers.RunCompositeRefresher(compositeInterval)
+
 	go handlers.GlobalHub.Run()
+	go handlers.RunAroundBroadcaster()
+	go handlers.RehydrateBoards()
+	go handlers.RunOutboxWorker()
+	go handlers.RunSeasonScheduler()
+	go handlers.RunTournamentScheduler()
 
+	// Each route declares whether a token is optional, required or must
+	// belong to an admin. Routes whose methods differ, such as GET and POST
+	// /games, are optional and checked again by the handler.
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/score", handlers.SubmitScoreRedis)
-	mux.HandleFunc("/leaderboard", handlers.GetLeaderboardRedis)
-	mux.HandleFunc("/rank", handlers.GetUserRank)
-	mux.HandleFunc("/report", handlers.GetTopPlayersReport)
-	mux.HandleFunc("/stats", handlers.GetUserStats)
+	mux.HandleFunc("/score", handlers.WithAuth(handlers.AuthRequired, handlers.SubmitScoreRedis))
+	mux.HandleFunc("/score/status", handlers.WithAuth(handlers.AuthRequired, handlers.GetSubmissionStatus))
+	mux.HandleFunc("/leaderboard", handlers.WithAuth(handlers.AuthOptional, handlers.GetLeaderboardRedis))
+	mux.HandleFunc("/leaderboard/around", handlers.WithAuth(handlers.AuthRequired, handlers.GetAroundMe))
+	mux.HandleFunc("/leaderboard/friends", handlers.WithAuth(handlers.AuthRequired, handlers.GetFriendsLeaderboard))
+	mux.HandleFunc("/rank", handlers.WithAuth(handlers.AuthRequired, handlers.GetUserRank))
+	mux.HandleFunc("/profile", handlers.WithAuth(handlers.AuthRequired, handlers.ProfileHandler))
+	mux.HandleFunc("/report", handlers.WithAuth(handlers.AuthOptional, handlers.GetTopPlayersReport))
+	mux.HandleFunc("/stats", handlers.WithAuth(handlers.AuthOptional, handlers.GetUserStats))
+	mux.HandleFunc("/.well-known/jwks.json", handlers.GetJWKS)
 	mux.HandleFunc("/register", handlers.RegistrationDB)
 	mux.HandleFunc("/login", handlers.LoginDB)
-	mux.HandleFunc("/ws", handlers.ServeWs)
+	mux.HandleFunc("/token/refresh", handlers.RefreshTokenHandler)
+	mux.HandleFunc("/logout", handlers.WithAuth(handlers.AuthRequired, handlers.Logout))
+	mux.HandleFunc("/ws", handlers.WithAuth(handlers.AuthOptional, handlers.ServeWs))
+	mux.HandleFunc("/games", handlers.WithAuth(handlers.AuthOptional, handlers.GamesHandler))
+	mux.HandleFunc("/friends", handlers.WithAuth(handlers.AuthRequired, handlers.FriendsHandler))
+	mux.HandleFunc("/seasons", handlers.WithAuth(handlers.AuthOptional, handlers.SeasonsHandler))
+	mux.HandleFunc("/seasons/end", handlers.WithAuth(handlers.AuthAdmin, handlers.EndSeason))
+	mux.HandleFunc("/seasons/leaderboard", handlers.WithAuth(handlers.AuthOptional, handlers.GetSeasonLeaderboard))
+	mux.HandleFunc("/seasons/history", handlers.WithAuth(handlers.AuthOptional, handlers.GetSeasonHistory))
+	mux.HandleFunc("/rewards", handlers.WithAuth(handlers.AuthRequired, handlers.ListRewards))
+	mux.HandleFunc("/rewards/claim", handlers.WithAuth(handlers.AuthRequired, handlers.ClaimRewards))
+	mux.HandleFunc("/rewards/tables", handlers.WithAuth(handlers.AuthOptional, handlers.RewardTablesHandler))
+	mux.HandleFunc("/rewards/distribute", handlers.WithAuth(handlers.AuthAdmin, handlers.DistributeRewardsHandler))
+	mux.HandleFunc("/tournaments", handlers.WithAuth(handlers.AuthOptional, handlers.TournamentsHandler))
+	mux.HandleFunc("/tournaments/register", handlers.WithAuth(handlers.AuthRequired, handlers.TournamentRegistrationHandler))
+	mux.HandleFunc("/tournaments/leaderboard", handlers.WithAuth(handlers.AuthOptional, handlers.GetTournamentLeaderboard))
+	mux.HandleFunc("/teams", handlers.WithAuth(handlers.AuthOptional, handlers.TeamsHandler))
+	mux.HandleFunc("/teams/join", handlers.WithAuth(handlers.AuthRequired, handlers.JoinTeam))
+	mux.HandleFunc("/teams/leave", handlers.WithAuth(handlers.AuthRequired, handlers.LeaveTeam))
+	mux.HandleFunc("/teams/members", handlers.WithAuth(handlers.AuthRequired, handlers.TeamMembersHandler))
+	mux.HandleFunc("/teams/leaderboard", handlers.WithAuth(handlers.AuthOptional, handlers.GetTeamLeaderboard))
+	mux.HandleFunc("/teams/contributions", handlers.WithAuth(handlers.AuthOptional, handlers.GetTeamContributions))
+	mux.HandleFunc("/matches", handlers.WithAuth(handlers.AuthOptional, handlers.MatchesHandler))
+	mux.HandleFunc("/ratings", handlers.WithAuth(handlers.AuthOptional, handlers.GetRating))
+	mux.HandleFunc("/composites", handlers.WithAuth(handlers.AuthOptional, handlers.CompositesHandler))
+	mux.HandleFunc("/composites/leaderboard", handlers.WithAuth(handlers.AuthOptional, handlers.GetCompositeLeaderboard))
+	mux.HandleFunc("/composites/refresh", handlers.WithAuth(handlers.AuthAdmin, handlers.RefreshCompositeHandler))
+	mux.HandleFunc("/admin/rebuild", handlers.WithAuth(handlers.AuthAdmin, handlers.RebuildHandler))
 
 	handler := enableCORS(mux)
 
-	err := http.ListenAndServe(":8080", handler)
+	err = http.ListenAndServe(":8080", handler)
 	if err != nil {
 		fmt.Println("Server error:", err)
 	}
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Methods for combining game scores into a composite board.
+const (
+	// CompositeWeighted sums weight × leaderboard score; games where lower
+	// scores win subtract instead.
+	CompositeWeighted = "weighted"
+	// CompositeRankPoints awards weight × (depth + 1 - rank) to each of a
+	// game's top depth players.
+	CompositeRankPoints = "rank_points"
+	// CompositeZScore sums weight × the player's z-score in each game.
+	CompositeZScore = "zscore"
+)
+
+const DefaultRankPointsDepth = 100
+
+type CompositeGame struct {
+	GameID string  `json:"game_id"`
+	Weight float64 `json:"weight"`
+}
+
+// CompositeBoard ranks players across several games.
+type CompositeBoard struct {
+	BoardID         string          `json:"board_id"`
+	Name            string          `json:"name"`
+	Method          string          `json:"method"`
+	Games           []CompositeGame `json:"games"`
+	RankPointsDepth int             `json:"rank_points_depth,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
@@ -1,16 +1,104 @@
 package models
 
+import "time"
+
+const (
+	AggregationBest    = "best"
+	AggregationLatest  = "latest"
+	AggregationSum     = "sum"
+	AggregationAverage = "average"
+	// AggregationRating games are scored by Glicko-2 ratings computed from
+	// match results rather than by submitted scores.
+	AggregationRating = "rating"
+)
+
+const DefaultAverageWindow = 5
+
+const (
+	SortDescending = "desc"
+	SortAscending  = "asc"
+)
+
+const (
+	TieBreakEarliest = "earliest"
+	TieBreakAttempts = "attempts"
+)
+
 type Game struct {
-	GameID   string `json:"game_id"`
-	GameName string `json:"game_name"`
+	GameID        string `json:"game_id"`
+	GameName      string `json:"game_name"`
+	Aggregation   string `json:"aggregation"`
+	AverageWindow int    `json:"average_window,omitempty"`
+	SortOrder     string `json:"sort_order"`
+	// TieBreakers orders players with equal scores, first key first.
+	// Defaults to ["earliest"]; an empty list falls back to username order.
+	TieBreakers []string `json:"tie_breakers"`
+	ScoreUnit   string   `json:"score_unit"`
+	MinScore    *int     `json:"min_score"`
+	MaxScore    *int     `json:"max_score"`
+	// Tiers are checked best first; a player is placed in the first one they
+	// qualify for.
+	Tiers []Tier `json:"tiers"`
+	// TeamAggregation is how members' contributions make up a team's
+	// score on the game's team board: sum or best_n.
+	TeamAggregation string     `json:"team_aggregation"`
+	TeamBestN       int        `json:"team_best_n,omitempty"`
+	ArchivedAt      *time.Time `json:"archived_at,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// Tier is a named band of the leaderboard. A player qualifies by ranking
+// within the top TopPercent percent of the board or by a score at least as
+// good as Threshold; a tier with neither is a catch-all.
+type Tier struct {
+	Name       string   `json:"name"`
+	TopPercent *float64 `json:"top_percent,omitempty"`
+	Threshold  *float64 `json:"threshold,omitempty"`
+}
+
+// DefaultTiers are used by games created without tiers.
+func DefaultTiers() []Tier {
+	percent := func(v float64) *float64 { return &v }
+	return []Tier{
+		{Name: "Diamond", TopPercent: percent(1)},
+		{Name: "Gold", TopPercent: percent(10)},
+		{Name: "Silver", TopPercent: percent(40)},
+		{Name: "Bronze"},
+	}
 }
+
+// Ascending reports whether lower scores rank higher, e.g. completion times.
+func (g Game) Ascending() bool {
+	return g.SortOrder == SortAscending
+}
+
+func (g Game) Archived() bool {
+	return g.ArchivedAt != nil
+}
+
+func (g Game) Rated() bool {
+	return g.Aggregation == AggregationRating
+}
+
 type ScoreSubmission struct {
 	GameID string `json:"game_id"`
 	Score  int    `json:"score"`
 }
 
+// Rank modes for tied scores: ordinal "1234", standard competition "1224"
+// and dense "1223".
+const (
+	RankOrdinal  = "ordinal"
+	RankStandard = "standard"
+	RankDense    = "dense"
+)
+
+var RankModes = []string{RankOrdinal, RankStandard, RankDense}
+
 type LeaderboardEntry struct {
-	Username string  `json:"username"`
-	Score    float64 `json:"score"`
-	Rank     int64   `json:"rank"`
+	Username   string  `json:"username"`
+	Score      float64 `json:"score"`
+	Rank       int64   `json:"rank"`
+	TopPercent float64 `json:"top_percent,omitempty"`
+	Tier       string  `json:"tier,omitempty"`
 }
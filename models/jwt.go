@@ -4,10 +4,24 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var JwtKey = []byte("mykey")
+// RoleAdmin is held by the users listed in ADMIN_USERS.
+const RoleAdmin = "admin"
 
 type Claims struct {
 	UserID   int    `json:"user"`
 	Username string `json:"username"`
+	// Family is the login session the token belongs to; logging out or a
+	// replayed refresh token revokes every access token of the family.
+	Family string `json:"fam,omitempty"`
 	jwt.RegisteredClaims
 }
+
+// TokenPair is a short-lived access token and the refresh token that
+// replaces it. Token is kept under its original name for existing clients.
+type TokenPair struct {
+	Token            string `json:"token"`
+	TokenType        string `json:"token_type"`
+	ExpiresIn        int64  `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+}
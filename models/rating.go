@@ -0,0 +1,45 @@
+package models
+
+import "time"
+
+// Glicko-2 starting values for a player's first match.
+const (
+	DefaultRating     = 1500.0
+	DefaultDeviation  = 350.0
+	DefaultVolatility = 0.06
+)
+
+// PlayerRating is a player's Glicko-2 rating in a rated game.
+type PlayerRating struct {
+	GameID     string    `json:"game_id"`
+	Username   string    `json:"username"`
+	Rating     float64   `json:"rating"`
+	Deviation  float64   `json:"deviation"`
+	Volatility float64   `json:"volatility"`
+	Matches    int       `json:"matches"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// MatchParticipant is one player's placement in a match. Lower placements
+// are better and equal placements are draws. The ratings are filled in once
+// the match is recorded.
+type MatchParticipant struct {
+	Username         string  `json:"username"`
+	Placement        int     `json:"placement"`
+	RatingBefore     float64 `json:"rating_before"`
+	RatingAfter      float64 `json:"rating_after"`
+	DeviationBefore  float64 `json:"deviation_before"`
+	DeviationAfter   float64 `json:"deviation_after"`
+	VolatilityBefore float64 `json:"volatility_before"`
+	VolatilityAfter  float64 `json:"volatility_after"`
+}
+
+// Match is the result of a head-to-head or free-for-all match in a rated
+// game.
+type Match struct {
+	MatchID      int64              `json:"match_id"`
+	GameID       string             `json:"game_id"`
+	PlayedAt     time.Time          `json:"played_at"`
+	Participants []MatchParticipant `json:"participants"`
+	CreatedAt    time.Time          `json:"created_at"`
+}
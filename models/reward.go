@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// Reward grant states.
+const (
+	RewardPending = "pending"
+	RewardClaimed = "claimed"
+)
+
+// RewardRule pays Amount of Reward to players who finish a season within
+// ranks FromRank..ToRank (standard competition ranks, so tied players are
+// paid alike), within the top TopPercent percent, or in Tier. Exactly one
+// of the three is set.
+type RewardRule struct {
+	FromRank   int      `json:"from_rank,omitempty"`
+	ToRank     int      `json:"to_rank,omitempty"`
+	TopPercent *float64 `json:"top_percent,omitempty"`
+	Tier       string   `json:"tier,omitempty"`
+	Reward     string   `json:"reward"`
+	Amount     int      `json:"amount"`
+}
+
+// RewardTable holds the rules for one season of a game, or for all of its
+// seasons without their own table when Season is 0. Rules are checked in
+// order and a player gets the first that matches.
+type RewardTable struct {
+	GameID    string       `json:"game_id"`
+	Season    int          `json:"season"`
+	Rules     []RewardRule `json:"rules"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+// RewardGrant is a ledger entry paying a player for a season placement.
+type RewardGrant struct {
+	ID        int64      `json:"grant_id"`
+	GameID    string     `json:"game_id"`
+	Season    int        `json:"season"`
+	Username  string     `json:"username"`
+	Rank      int64      `json:"rank"`
+	Reward    string     `json:"reward"`
+	Amount    int        `json:"amount"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	ClaimedAt *time.Time `json:"claimed_at,omitempty"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// Season states, derived from a season's times.
+const (
+	SeasonScheduled = "scheduled"
+	SeasonActive    = "active"
+	// SeasonEnded seasons are waiting for their standings to be archived.
+	SeasonEnded    = "ended"
+	SeasonArchived = "archived"
+)
+
+// Season is a numbered, time-boxed competition on a game's board.
+type Season struct {
+	GameID     string     `json:"game_id"`
+	Number     int        `json:"season"`
+	Name       string     `json:"name"`
+	StartsAt   time.Time  `json:"starts_at"`
+	EndsAt     time.Time  `json:"ends_at"`
+	ArchivedAt *time.Time `json:"archived_at,omitempty"`
+	Status     string     `json:"status"`
+}
+
+// SeasonStanding is a player's final placement in an archived season.
+type SeasonStanding struct {
+	GameID     string  `json:"game_id"`
+	Season     int     `json:"season"`
+	SeasonName string  `json:"season_name,omitempty"`
+	Username   string  `json:"username"`
+	Score      float64 `json:"score"`
+	Rank       int64   `json:"rank"`
+	TopPercent float64 `json:"top_percent"`
+	Tier       string  `json:"tier,omitempty"`
+	Players    int64   `json:"players,omitempty"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Team roles, most privileged first. A team has exactly one owner.
+const (
+	TeamRoleOwner   = "owner"
+	TeamRoleOfficer = "officer"
+	TeamRoleMember  = "member"
+)
+
+// Team score methods, set per game.
+const (
+	// TeamScoreSum adds up the members' contributions.
+	TeamScoreSum = "sum"
+	// TeamScoreBestN averages the best TeamBestN contributions.
+	TeamScoreBestN = "best_n"
+)
+
+const DefaultTeamBestN = 5
+
+// MaxTeamMembers caps the size of a team.
+const MaxTeamMembers = 50
+
+// Team is a clan of players. A player belongs to at most one team, and only
+// scores they submit while a member count towards its team boards.
+type Team struct {
+	TeamID      string       `json:"team_id"`
+	Name        string       `json:"name"`
+	MemberCount int64        `json:"member_count"`
+	Members     []TeamMember `json:"members,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+type TeamMember struct {
+	Username string    `json:"username"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// TeamEntry is a team's place on a game's team board.
+type TeamEntry struct {
+	TeamID     string  `json:"team_id"`
+	Name       string  `json:"name"`
+	Score      float64 `json:"score"`
+	Rank       int64   `json:"rank"`
+	TopPercent float64 `json:"top_percent,omitempty"`
+}
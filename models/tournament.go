@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// Tournament states, derived from its times.
+const (
+	// TournamentRegistration tournaments have not started; players can
+	// register.
+	TournamentRegistration = "registration"
+	TournamentRunning      = "running"
+	// TournamentEnded tournaments are waiting for their results.
+	TournamentEnded = "ended"
+	TournamentFinal = "final"
+)
+
+// Tournament is a time-boxed competition on a game between the players who
+// registered for it. Only their submissions between StartsAt and EndsAt
+// count.
+type Tournament struct {
+	TournamentID string     `json:"tournament_id"`
+	GameID       string     `json:"game_id"`
+	Name         string     `json:"name"`
+	StartsAt     time.Time  `json:"starts_at"`
+	EndsAt       time.Time  `json:"ends_at"`
+	FinalizedAt  *time.Time `json:"finalized_at,omitempty"`
+	Status       string     `json:"status"`
+	Players      int64      `json:"players"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
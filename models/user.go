@@ -4,4 +4,6 @@ type User struct {
 	UserId       int    `json:"userId"`
 	Username     string `json:"username"`
 	PasswordHash string `json:"password"`
+	Country      string `json:"country,omitempty"`
+	Region       string `json:"region,omitempty"`
 }
@@ -23,35 +23,6 @@ func InitDB() error {
 		return fmt.Errorf("failed to ping database: %w", err)
 	}
 
-	return createTables()
-}
-
-func createTables() error {
-	usersTable := `
-    CREATE TABLE IF NOT EXISTS users (
-        user_id SERIAL PRIMARY KEY,
-        username VARCHAR(255) UNIQUE NOT NULL,
-        password_hash VARCHAR(255) NOT NULL,
-        created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-    )`
-
-	leaderboardTable := `
-    CREATE TABLE IF NOT EXISTS leaderboard (
-        id SERIAL PRIMARY KEY,
-        username VARCHAR(255) NOT NULL,
-        score INTEGER NOT NULL,
-        submitted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-        FOREIGN KEY (username) REFERENCES users(username)
-    )`
-
-	if _, err := DB.Exec(usersTable); err != nil {
-		return fmt.Errorf("failed to create users table: %w", err)
-	}
-
-	if _, err := DB.Exec(leaderboardTable); err != nil {
-		return fmt.Errorf("failed to create leaderboard table: %w", err)
-	}
-
 	return nil
 }
 
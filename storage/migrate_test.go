@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrationsEmbedded(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations embedded")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("migration %d_%s at position %d, want version %d", m.Version, m.Name, i, i+1)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(body string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(body)} }
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		want    []Migration
+		wantErr string
+	}{
+		{
+			name: "ordered by version, not file name",
+			files: fstest.MapFS{
+				"migrations/10_add_index.up.sql":      file("CREATE INDEX"),
+				"migrations/10_add_index.down.sql":    file("DROP INDEX"),
+				"migrations/9_create_users.down.sql":  file("DROP TABLE"),
+				"migrations/9_create_users.up.sql":    file("CREATE TABLE"),
+				"migrations/0002_add_column.up.sql":   file("ALTER TABLE ADD"),
+				"migrations/0002_add_column.down.sql": file("ALTER TABLE DROP"),
+			},
+			want: []Migration{
+				{Version: 2, Name: "add_column", Up: "ALTER TABLE ADD", Down: "ALTER TABLE DROP"},
+				{Version: 9, Name: "create_users", Up: "CREATE TABLE", Down: "DROP TABLE"},
+				{Version: 10, Name: "add_index", Up: "CREATE INDEX", Down: "DROP INDEX"},
+			},
+		},
+		{
+			name: "missing down script",
+			files: fstest.MapFS{
+				"migrations/0001_create_users.up.sql": file("CREATE TABLE"),
+			},
+			wantErr: "needs both up and down scripts",
+		},
+		{
+			name: "scripts named differently",
+			files: fstest.MapFS{
+				"migrations/0001_create_users.up.sql":     file("CREATE TABLE"),
+				"migrations/0001_create_players.down.sql": file("DROP TABLE"),
+			},
+			wantErr: "has two names",
+		},
+		{
+			name: "no direction",
+			files: fstest.MapFS{
+				"migrations/0001_create_users.sql": file("CREATE TABLE"),
+			},
+			wantErr: "invalid migration file name",
+		},
+		{
+			name: "no version",
+			files: fstest.MapFS{
+				"migrations/create_users.up.sql":   file("CREATE TABLE"),
+				"migrations/create_users.down.sql": file("DROP TABLE"),
+			},
+			wantErr: "invalid migration file name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := loadMigrations(tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d migrations, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("migration %d = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS leaderboard;
+DROP TABLE IF EXISTS users;
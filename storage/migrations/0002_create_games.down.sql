@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS idx_leaderboard_game_user;
+ALTER TABLE leaderboard DROP COLUMN IF EXISTS game_id;
+DROP TABLE IF EXISTS games;
@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS games (
+    game_id VARCHAR(64) PRIMARY KEY,
+    game_name VARCHAR(255) NOT NULL,
+    aggregation VARCHAR(16) NOT NULL DEFAULT 'best',
+    average_window INTEGER NOT NULL DEFAULT 5,
+    sort_order VARCHAR(4) NOT NULL DEFAULT 'desc',
+    tie_breakers TEXT[] NOT NULL DEFAULT '{earliest}',
+    score_unit VARCHAR(32) NOT NULL DEFAULT 'points',
+    min_score INTEGER,
+    max_score INTEGER,
+    archived_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Scores submitted without a game_id go to the "global" board.
+INSERT INTO games (game_id, game_name) VALUES ('global', 'Global')
+ON CONFLICT (game_id) DO NOTHING;
+
+-- Rows written before scores were tracked per game belong to "global".
+ALTER TABLE leaderboard
+ADD COLUMN IF NOT EXISTS game_id VARCHAR(64) NOT NULL DEFAULT 'global' REFERENCES games(game_id);
+
+CREATE INDEX IF NOT EXISTS idx_leaderboard_game_user
+ON leaderboard (game_id, username, submitted_at);
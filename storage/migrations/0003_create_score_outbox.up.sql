@@ -0,0 +1,15 @@
+-- Each submission gets an outbox row in the same transaction as its history
+-- row; the outbox worker applies it to Redis until it succeeds.
+CREATE TABLE IF NOT EXISTS score_outbox (
+    history_id INTEGER PRIMARY KEY REFERENCES leaderboard(id),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    result JSONB,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    applied_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_score_outbox_pending
+ON score_outbox (next_attempt_at) WHERE status = 'pending';
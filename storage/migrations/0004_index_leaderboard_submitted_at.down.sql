@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_leaderboard_game_submitted_at;
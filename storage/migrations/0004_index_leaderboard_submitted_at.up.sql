@@ -0,0 +1,3 @@
+-- /report filters a game's history by submission time.
+CREATE INDEX IF NOT EXISTS idx_leaderboard_game_submitted_at
+ON leaderboard (game_id, submitted_at);
@@ -0,0 +1,11 @@
+-- follower follows followee; two users who follow each other are friends.
+CREATE TABLE IF NOT EXISTS follows (
+    follower VARCHAR(255) NOT NULL REFERENCES users(username),
+    followee VARCHAR(255) NOT NULL REFERENCES users(username),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (follower, followee),
+    CHECK (follower <> followee)
+);
+
+CREATE INDEX IF NOT EXISTS idx_follows_followee
+ON follows (followee);
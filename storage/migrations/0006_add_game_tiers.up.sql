@@ -0,0 +1,4 @@
+-- Tier bands, best first; see models.Tier.
+ALTER TABLE games
+ADD COLUMN IF NOT EXISTS tiers JSONB NOT NULL DEFAULT
+    '[{"name":"Diamond","top_percent":1},{"name":"Gold","top_percent":10},{"name":"Silver","top_percent":40},{"name":"Bronze"}]';
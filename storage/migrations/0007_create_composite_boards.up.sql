@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS composite_boards (
+    board_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    method VARCHAR(16) NOT NULL DEFAULT 'weighted',
+    games JSONB NOT NULL,
+    rank_points_depth INTEGER NOT NULL DEFAULT 100,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,35 @@
+-- A game's seasons run back to back or with gaps; the live board only holds
+-- submissions since the most recent season start or end.
+CREATE TABLE IF NOT EXISTS seasons (
+    game_id VARCHAR(64) NOT NULL REFERENCES games(game_id),
+    number INTEGER NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    opened_at TIMESTAMP,
+    archived_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (game_id, number),
+    CHECK (ends_at > starts_at)
+);
+
+-- Final standings, written once when a season ends.
+CREATE TABLE IF NOT EXISTS season_standings (
+    game_id VARCHAR(64) NOT NULL,
+    season INTEGER NOT NULL,
+    username VARCHAR(255) NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    rank INTEGER NOT NULL,
+    standard_rank INTEGER NOT NULL,
+    dense_rank INTEGER NOT NULL,
+    top_percent DOUBLE PRECISION NOT NULL,
+    tier VARCHAR(255) NOT NULL DEFAULT '',
+    PRIMARY KEY (game_id, season, username),
+    FOREIGN KEY (game_id, season) REFERENCES seasons(game_id, number) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_season_standings_rank
+ON season_standings (game_id, season, rank);
+
+CREATE INDEX IF NOT EXISTS idx_season_standings_username
+ON season_standings (username);
@@ -0,0 +1,3 @@
+ALTER TABLE seasons DROP COLUMN IF EXISTS rewards_distributed_at;
+DROP TABLE IF EXISTS reward_grants;
+DROP TABLE IF EXISTS reward_tables;
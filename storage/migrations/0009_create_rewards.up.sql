@@ -0,0 +1,31 @@
+-- Reward rules for one season of a game, or for all its seasons (season 0).
+CREATE TABLE IF NOT EXISTS reward_tables (
+    game_id VARCHAR(64) NOT NULL REFERENCES games(game_id),
+    season INTEGER NOT NULL DEFAULT 0,
+    rules JSONB NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (game_id, season)
+);
+
+-- The ledger: at most one grant per player and season, so distributing a
+-- season again never pays twice.
+CREATE TABLE IF NOT EXISTS reward_grants (
+    id SERIAL PRIMARY KEY,
+    game_id VARCHAR(64) NOT NULL,
+    season INTEGER NOT NULL,
+    username VARCHAR(255) NOT NULL REFERENCES users(username),
+    rank INTEGER NOT NULL,
+    reward VARCHAR(255) NOT NULL,
+    amount INTEGER NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    claimed_at TIMESTAMP,
+    UNIQUE (game_id, season, username),
+    FOREIGN KEY (game_id, season) REFERENCES seasons(game_id, number)
+);
+
+CREATE INDEX IF NOT EXISTS idx_reward_grants_username
+ON reward_grants (username, status);
+
+ALTER TABLE seasons
+ADD COLUMN IF NOT EXISTS rewards_distributed_at TIMESTAMP;
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS tournaments (
+    tournament_id VARCHAR(64) PRIMARY KEY,
+    game_id VARCHAR(64) NOT NULL REFERENCES games(game_id),
+    name VARCHAR(255) NOT NULL,
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    started_at TIMESTAMP,
+    finalized_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    CHECK (ends_at > starts_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tournaments_game
+ON tournaments (game_id, starts_at);
+
+CREATE TABLE IF NOT EXISTS tournament_players (
+    tournament_id VARCHAR(64) NOT NULL REFERENCES tournaments(tournament_id) ON DELETE CASCADE,
+    username VARCHAR(255) NOT NULL REFERENCES users(username),
+    registered_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (tournament_id, username)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tournament_players_username
+ON tournament_players (username);
+
+-- Final standings, written once when the tournament ends.
+CREATE TABLE IF NOT EXISTS tournament_results (
+    tournament_id VARCHAR(64) NOT NULL REFERENCES tournaments(tournament_id) ON DELETE CASCADE,
+    username VARCHAR(255) NOT NULL,
+    score DOUBLE PRECISION NOT NULL,
+    rank INTEGER NOT NULL,
+    standard_rank INTEGER NOT NULL,
+    dense_rank INTEGER NOT NULL,
+    PRIMARY KEY (tournament_id, username)
+);
+
+CREATE INDEX IF NOT EXISTS idx_tournament_results_rank
+ON tournament_results (tournament_id, rank);
@@ -0,0 +1,39 @@
+-- Glicko-2 ratings of players in rated games. The Redis board of a rated
+-- game mirrors the rating column.
+CREATE TABLE IF NOT EXISTS player_ratings (
+    game_id VARCHAR(64) NOT NULL REFERENCES games(game_id),
+    username VARCHAR(255) NOT NULL REFERENCES users(username),
+    rating DOUBLE PRECISION NOT NULL,
+    deviation DOUBLE PRECISION NOT NULL,
+    volatility DOUBLE PRECISION NOT NULL,
+    matches INTEGER NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (game_id, username)
+);
+
+CREATE TABLE IF NOT EXISTS matches (
+    match_id SERIAL PRIMARY KEY,
+    game_id VARCHAR(64) NOT NULL REFERENCES games(game_id),
+    played_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_matches_game
+ON matches (game_id, played_at);
+
+-- Each player's placement in a match and their rating either side of it.
+CREATE TABLE IF NOT EXISTS match_participants (
+    match_id INTEGER NOT NULL REFERENCES matches(match_id) ON DELETE CASCADE,
+    username VARCHAR(255) NOT NULL REFERENCES users(username),
+    placement INTEGER NOT NULL,
+    rating_before DOUBLE PRECISION NOT NULL,
+    rating_after DOUBLE PRECISION NOT NULL,
+    deviation_before DOUBLE PRECISION NOT NULL,
+    deviation_after DOUBLE PRECISION NOT NULL,
+    volatility_before DOUBLE PRECISION NOT NULL,
+    volatility_after DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (match_id, username)
+);
+
+CREATE INDEX IF NOT EXISTS idx_match_participants_username
+ON match_participants (username, match_id);
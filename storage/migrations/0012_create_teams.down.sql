@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS team_members;
+DROP TABLE IF EXISTS teams;
+
+ALTER TABLE games
+DROP COLUMN IF EXISTS team_aggregation,
+DROP COLUMN IF EXISTS team_best_n;
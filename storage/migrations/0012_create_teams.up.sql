@@ -0,0 +1,20 @@
+-- How a game's team board scores teams; see models.Game.
+ALTER TABLE games
+ADD COLUMN IF NOT EXISTS team_aggregation VARCHAR(16) NOT NULL DEFAULT 'sum',
+ADD COLUMN IF NOT EXISTS team_best_n INTEGER NOT NULL DEFAULT 5;
+
+CREATE TABLE IF NOT EXISTS teams (
+    team_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A player belongs to at most one team. Only submissions made since
+-- joined_at count towards the team.
+CREATE TABLE IF NOT EXISTS team_members (
+    team_id VARCHAR(64) NOT NULL REFERENCES teams(team_id) ON DELETE CASCADE,
+    username VARCHAR(255) NOT NULL UNIQUE REFERENCES users(username),
+    role VARCHAR(16) NOT NULL DEFAULT 'member',
+    joined_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (team_id, username)
+);
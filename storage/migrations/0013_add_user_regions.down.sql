@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_users_region;
+DROP INDEX IF EXISTS idx_users_country;
+
+ALTER TABLE users
+DROP COLUMN IF EXISTS country,
+DROP COLUMN IF EXISTS region;
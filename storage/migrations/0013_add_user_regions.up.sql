@@ -0,0 +1,8 @@
+-- Optional profile attributes used by the regional leaderboards. country is
+-- an ISO 3166-1 alpha-2 code, region a free-form slug such as "eu-west".
+ALTER TABLE users
+ADD COLUMN IF NOT EXISTS country VARCHAR(2),
+ADD COLUMN IF NOT EXISTS region VARCHAR(64);
+
+CREATE INDEX IF NOT EXISTS idx_users_country ON users (country) WHERE country IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_region ON users (region) WHERE region IS NOT NULL;
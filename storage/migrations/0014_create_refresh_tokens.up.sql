@@ -0,0 +1,25 @@
+-- Refresh tokens are stored as SHA-256 hashes. Each login starts a family;
+-- refreshing marks the presented token used and issues the next one in the
+-- same family, so a used token coming back means it was stolen.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash CHAR(64) PRIMARY KEY,
+    family_id VARCHAR(64) NOT NULL,
+    username VARCHAR(255) NOT NULL REFERENCES users(username) ON DELETE CASCADE,
+    issued_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens (family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_username ON refresh_tokens (username);
+
+-- Revoked access tokens, by token ID (jti) or by family. An entry is kept
+-- until every access token it covers has expired; Redis caches the live ones.
+CREATE TABLE IF NOT EXISTS token_revocations (
+    kind VARCHAR(16) NOT NULL,
+    value VARCHAR(64) NOT NULL,
+    revoked_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (kind, value)
+);
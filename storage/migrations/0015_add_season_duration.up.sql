@@ -0,0 +1,7 @@
+-- The length a season was scheduled for. Seasons started by the rollover
+-- inherit it, so a season ended early does not shorten the ones after it.
+ALTER TABLE seasons ADD COLUMN IF NOT EXISTS duration INTERVAL;
+
+UPDATE seasons SET duration = ends_at - starts_at WHERE duration IS NULL;
+
+ALTER TABLE seasons ALTER COLUMN duration SET NOT NULL;
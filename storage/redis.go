@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/redis/go-redis/v9"
+	"log"
 )
 
 var RedisClient *redis.Client
@@ -24,6 +25,10 @@ func InitRedis() error {
 		return fmt.Errorf("failed to connect to Redis: %w", err)
 	}
 
+	if size, err := RedisClient.DBSize(RedisCtx).Result(); err == nil && size == 0 {
+		log.Println("Redis keyspace is empty, leaderboards will be rehydrated from PostgreSQL")
+	}
+
 	return nil
 }
 
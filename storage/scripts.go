@@ -0,0 +1,851 @@
+package storage
+
+import "github.com/redis/go-redis/v9"
+
+// applyScoreLua defines apply(k, a), which folds one submission into a board
+// according to the game's aggregation policy. It is shared by the scripts
+// below so live submissions and rebuilds produce identical boards.
+//
+// When tie-breakers are configured, members are stored as
+// "<tie key>#<username>" where the tie key is fixed-width hex. Redis orders
+// equal scores lexicographically by member, so the prefix decides ties while
+// the score itself stays the exact aggregated value. Members written before
+// tie-breaking was enabled are plain usernames and are migrated on the next
+// change.
+//
+// k[1] leaderboard sorted set
+// k[2] hash of personal bests (raw submitted scores)
+// k[3] hash of username -> comma separated "<unix ms>:<score>" of the
+// player's most recent submissions, newest first (latest and average
+// policies)
+// k[4] hash of username -> encoded sorted set member
+// k[5] hash of submission counts
+// k[6] sorted set of distinct scores on the board, used for dense ranks;
+// seeded from the board the first time it is missing
+// k[7] sorted set of Postgres history IDs applied to the board, scored by
+// the time they were applied, so a redelivered submission is only counted
+// once. An ID is kept until its outbox row is marked delivered and for at
+// least a day after it was applied.
+//
+// a[1] username, a[2] score, a[3] policy, a[4] average window,
+// a[5] "1" when lower scores rank higher, a[6] comma separated tie-breakers,
+// a[7] submission time in unix milliseconds, a[8] Postgres history ID, or 0
+// for a row that is never delivered again and need not be recorded, a[9]
+// history ID below which every outbox row is marked delivered, or 0 when
+// unknown
+//
+// apply returns {value, previous value or nil, previous best or nil,
+// new best (0/1), duplicate (0/1)}. For a duplicate the value is the
+// player's current score.
+const applyScoreLua = `
+local function scoreMember(v)
+	return string.format('%.17g', v)
+end
+
+local function apply(k, a)
+	local username = a[1]
+	local score = tonumber(a[2])
+	local policy = a[3]
+	local window = tonumber(a[4])
+	local ascending = a[5] == '1'
+	local tieBreakers = a[6]
+	local now = tonumber(a[7])
+	local historyID = a[8]
+	local deliveredBelow = tonumber(a[9])
+
+	local function better(x, y)
+		if ascending then
+			return x < y
+		end
+		return x > y
+	end
+
+	if historyID ~= '0' then
+		if redis.call('ZSCORE', k[7], historyID) then
+			local member = redis.call('HGET', k[4], username) or username
+			return {tostring(redis.call('ZSCORE', k[1], member) or score), false, false, 0, 1}
+		end
+		local t = redis.call('TIME')
+		local appliedAt = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+		redis.call('ZADD', k[7], appliedAt, historyID)
+
+		-- The day's grace covers rows committed after deliveredBelow was
+		-- read: those were not delivered yet, but may sort below it.
+		if deliveredBelow > 0 then
+			local old = redis.call('ZRANGEBYSCORE', k[7], '-inf', appliedAt - 86400000, 'LIMIT', 0, 100)
+			local expired = {}
+			for _, id in ipairs(old) do
+				if tonumber(id) < deliveredBelow then
+					table.insert(expired, id)
+				end
+			end
+			if #expired > 0 then
+				redis.call('ZREM', k[7], unpack(expired))
+			end
+		end
+	end
+
+	if redis.call('EXISTS', k[6]) == 0 then
+		local scores = redis.call('ZRANGE', k[1], 0, -1, 'WITHSCORES')
+		for i = 2, #scores, 2 do
+			local v = tonumber(scores[i])
+			redis.call('ZADD', k[6], v, scoreMember(v))
+		end
+	end
+
+	local current = username
+	if tieBreakers ~= '' then
+		current = redis.call('HGET', k[4], username) or username
+	end
+
+	local previous = redis.call('ZSCORE', k[1], current)
+	local previousBest = redis.call('HGET', k[2], username)
+	local attempts = redis.call('HINCRBY', k[5], username, 1)
+
+	local value = score
+	local stale = false
+	if policy == 'latest' or policy == 'average' then
+		-- Submissions can be delivered out of order, so they are kept in
+		-- submission time order and one older than every kept submission
+		-- does not count.
+		local keep = window
+		if policy == 'latest' then
+			keep = 1
+		end
+		local recent = {}
+		local placed = false
+		local stored = redis.call('HGET', k[3], username)
+		if stored then
+			for v in string.gmatch(stored, '[^,]+') do
+				local t, s = string.match(v, '^(%d+):(.+)$')
+				if not t then
+					-- Written before submission times were kept.
+					t, s = '0', v
+				end
+				if not placed and now >= tonumber(t) then
+					table.insert(recent, {now, score})
+					placed = true
+				end
+				table.insert(recent, {tonumber(t), tonumber(s)})
+			end
+		end
+		if not placed then
+			table.insert(recent, {now, score})
+		end
+
+		local kept = {}
+		local total = 0
+		stale = true
+		for i = 1, math.min(#recent, keep) do
+			local e = recent[i]
+			if e[1] == now and e[2] == score then
+				stale = false
+			end
+			table.insert(kept, string.format('%d:%s', e[1], scoreMember(e[2])))
+			total = total + e[2]
+		end
+		redis.call('HSET', k[3], username, table.concat(kept, ','))
+		value = total / #kept
+		if not previous then
+			stale = false
+		end
+	elseif policy == 'sum' then
+		value = (tonumber(previous) or 0) + score
+	elseif previous and not better(score, tonumber(previous)) then
+		value = tonumber(previous)
+	end
+
+	-- Keep-best boards only move a player when the best improves, so an equal
+	-- resubmission keeps the earlier tie key. A stale submission leaves the
+	-- player where they are.
+	local changed = not stale and (policy ~= 'best' or not previous or better(value, tonumber(previous)))
+	if stale and previous then
+		value = tonumber(previous)
+	end
+
+	if tieBreakers == '' then
+		if not stale then
+			redis.call('ZADD', k[1], value, username)
+		end
+	elseif changed then
+		local tie = ''
+		for key in string.gmatch(tieBreakers, '[^,]+') do
+			if key == 'earliest' then
+				local t = now
+				if not ascending then
+					t = 281474976710655 - t
+				end
+				tie = tie .. string.format('%012x', t)
+			elseif key == 'attempts' then
+				local n = math.min(attempts, 4294967295)
+				if not ascending then
+					n = 4294967295 - n
+				end
+				tie = tie .. string.format('%08x', n)
+			end
+		end
+
+		local member = tie .. '#' .. username
+		if current ~= member then
+			redis.call('ZREM', k[1], current)
+		end
+		redis.call('ZADD', k[1], value, member)
+		redis.call('HSET', k[4], username, member)
+	end
+
+	if previous and tonumber(previous) ~= value then
+		if redis.call('ZCOUNT', k[1], previous, previous) == 0 then
+			redis.call('ZREM', k[6], scoreMember(tonumber(previous)))
+		end
+	end
+	redis.call('ZADD', k[6], value, scoreMember(value))
+
+	local newBest = 0
+	if not previousBest or better(score, tonumber(previousBest)) then
+		redis.call('HSET', k[2], username, score)
+		newBest = 1
+	end
+
+	return {tostring(value), previous or false, previousBest or false, newBest, 0}
+end
+`
+
+// SubmitScoreScript applies a live submission to a board.
+//
+// KEYS[1..7] board keys as described for apply
+// KEYS[8] rebuild lock, present while the board is being rebuilt
+// KEYS[9..15] keys of the board being rebuilt
+//
+// ARGV[1..9] as described for apply
+//
+// While a rebuild is running the submission is mirrored into the rebuilt
+// board in the same script, so it cannot be lost or counted twice when the
+// rebuilt board is swapped in.
+var SubmitScoreScript = redis.NewScript(applyScoreLua + `
+local result = apply({KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7]}, ARGV)
+
+if redis.call('EXISTS', KEYS[8]) == 1 then
+	apply({KEYS[9], KEYS[10], KEYS[11], KEYS[12], KEYS[13], KEYS[14], KEYS[15]}, ARGV)
+end
+
+return result
+`)
+
+// PeriodScoreScript applies a live submission to the game's calendar period
+// boards and schedules each board to expire once its period is old.
+//
+// KEYS hold fifteen keys per period board, laid out as KEYS[1..15] of
+// SubmitScoreScript. ARGV[1..9] as for apply, then one expiry time in unix
+// milliseconds per period board.
+//
+// Like SubmitScoreScript it mirrors the submission into a period board being
+// rebuilt.
+var PeriodScoreScript = redis.NewScript(applyScoreLua + `
+local boards = #KEYS / 15
+for b = 0, boards - 1 do
+	local k, rebuilt = {}, {}
+	for i = 1, 7 do
+		k[i] = KEYS[b * 15 + i]
+		rebuilt[i] = KEYS[b * 15 + 8 + i]
+	end
+	apply(k, ARGV)
+	for i = 1, 7 do
+		redis.call('PEXPIREAT', k[i], ARGV[10 + b])
+	end
+	if redis.call('EXISTS', KEYS[b * 15 + 8]) == 1 then
+		apply(rebuilt, ARGV)
+	end
+end
+return boards
+`)
+
+// RebuildScoreScript replays one history row into a board being rebuilt.
+// Rows a live submission already mirrored are skipped by apply.
+//
+// KEYS[1..7] keys of the board being rebuilt, ARGV[1..9] as for apply.
+var RebuildScoreScript = redis.NewScript(applyScoreLua + `
+return apply(KEYS, ARGV)[5]
+`)
+
+// SwapRebuiltBoardScript replaces a board with its rebuilt copy and ends the
+// rebuild, provided the caller still holds the rebuild lock.
+//
+// KEYS[1..7] board keys, KEYS[8..14] rebuilt board keys, KEYS[15] rebuild
+// lock. ARGV[1] lock token.
+//
+// Returns 1 on success and 0 when the lock was lost.
+var SwapRebuiltBoardScript = redis.NewScript(`
+if redis.call('GET', KEYS[15]) ~= ARGV[1] then
+	return 0
+end
+for i = 1, 7 do
+	if redis.call('EXISTS', KEYS[7 + i]) == 1 then
+		redis.call('RENAME', KEYS[7 + i], KEYS[i])
+	else
+		redis.call('DEL', KEYS[i])
+	end
+end
+redis.call('DEL', KEYS[15])
+return 1
+`)
+
+// RebuildDistinctScoresScript seeds the distinct score set (KEYS[2]) of a
+// board (KEYS[1]) written before dense ranking existed. It is a no-op when
+// the set already exists.
+var RebuildDistinctScoresScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+local scores = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+for i = 2, #scores, 2 do
+	local v = tonumber(scores[i])
+	redis.call('ZADD', KEYS[2], v, string.format('%.17g', v))
+end
+return 1
+`)
+
+// RefreshLockScript extends a lock (KEYS[1]) by ARGV[2] milliseconds if it is
+// still held with token ARGV[1]. Returns 1 when refreshed.
+var RefreshLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+`)
+
+// ReleaseLockScript deletes a lock (KEYS[1]) if it is still held with token
+// ARGV[1].
+var ReleaseLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// RepairBoardMemberScript corrects one player's entry on a board found to
+// have drifted from the Postgres history, together with their personal best,
+// submission count and recent submissions. The repair is skipped when the
+// entry changed since it was compared, so it never undoes a live submission.
+//
+// KEYS[1] leaderboard sorted set, KEYS[2] members hash, KEYS[3] distinct
+// score set, KEYS[4] personal bests, KEYS[5] submission counts, KEYS[6]
+// recent submissions.
+//
+// ARGV[1] username, ARGV[2] score seen on the board ("" when absent),
+// ARGV[3] correct score ("" to remove the player), ARGV[4] member to store,
+// ARGV[5] personal best, ARGV[6] submission count, ARGV[7] recent
+// submissions as apply keeps them ("" for none).
+//
+// Returns 1 when repaired and 0 when skipped.
+var RepairBoardMemberScript = redis.NewScript(`
+local username = ARGV[1]
+local current = redis.call('HGET', KEYS[2], username) or username
+local seen = redis.call('ZSCORE', KEYS[1], current)
+
+if ARGV[2] == '' then
+	if seen then
+		return 0
+	end
+elseif not seen or tonumber(seen) ~= tonumber(ARGV[2]) then
+	return 0
+end
+
+if seen then
+	redis.call('ZREM', KEYS[1], current)
+	if redis.call('ZCOUNT', KEYS[1], seen, seen) == 0 then
+		redis.call('ZREM', KEYS[3], string.format('%.17g', tonumber(seen)))
+	end
+end
+
+if ARGV[3] == '' then
+	redis.call('HDEL', KEYS[2], username)
+	redis.call('HDEL', KEYS[4], username)
+	redis.call('HDEL', KEYS[5], username)
+	redis.call('HDEL', KEYS[6], username)
+	return 1
+end
+
+local value = tonumber(ARGV[3])
+redis.call('ZADD', KEYS[1], value, ARGV[4])
+if ARGV[4] ~= username then
+	redis.call('HSET', KEYS[2], username, ARGV[4])
+else
+	redis.call('HDEL', KEYS[2], username)
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	redis.call('ZADD', KEYS[3], value, string.format('%.17g', value))
+end
+redis.call('HSET', KEYS[4], username, ARGV[5])
+redis.call('HSET', KEYS[5], username, ARGV[6])
+if ARGV[7] == '' then
+	redis.call('HDEL', KEYS[6], username)
+else
+	redis.call('HSET', KEYS[6], username, ARGV[7])
+end
+return 1
+`)
+
+// BoardPositionScript locates the entry with score ARGV[1] and member
+// ARGV[2] on a board (KEYS[1]). ARGV[3] is "1" when lower scores rank higher.
+//
+// Returns {members sorting before the entry, 1 if the entry is still on the
+// board with that score else 0}. The entry does not have to be on the board
+// any more: a page cursor keeps its place when the player it points at has
+// moved or left. Its place among tied members, which sort by member, is
+// found by binary search over their ranks, so it takes O(log² N).
+var BoardPositionScript = redis.NewScript(`
+local score = ARGV[1]
+local member = ARGV[2]
+local ascending = ARGV[3] == '1'
+
+local current = redis.call('ZSCORE', KEYS[1], member)
+if current and tonumber(current) == tonumber(score) then
+	if ascending then
+		return {redis.call('ZRANK', KEYS[1], member), 1}
+	end
+	return {redis.call('ZREVRANK', KEYS[1], member), 1}
+end
+
+local lo
+if ascending then
+	lo = redis.call('ZCOUNT', KEYS[1], '-inf', '(' .. score)
+else
+	lo = redis.call('ZCOUNT', KEYS[1], '(' .. score, '+inf')
+end
+local hi = lo + redis.call('ZCOUNT', KEYS[1], score, score)
+
+while lo < hi do
+	local mid = math.floor((lo + hi) / 2)
+	local tied
+	if ascending then
+		tied = redis.call('ZRANGE', KEYS[1], mid, mid)[1]
+	else
+		tied = redis.call('ZREVRANGE', KEYS[1], mid, mid)[1]
+	end
+	if (ascending and tied < member) or (not ascending and tied > member) then
+		lo = mid + 1
+	else
+		hi = mid
+	end
+end
+return {lo, 0}
+`)
+
+// LoadFollowSetScript caches a follow set read from Postgres, unless the
+// follows changed since the read started: then the set it read may be stale
+// and the next reader loads it again.
+//
+// KEYS[1] set, KEYS[2] version of the set, bumped by every change.
+// ARGV[1] version seen before reading ("" when none), ARGV[2] time to live
+// in milliseconds, ARGV[3..] members.
+//
+// Returns 1 when cached.
+var LoadFollowSetScript = redis.NewScript(`
+if (redis.call('GET', KEYS[2]) or '') ~= ARGV[1] then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('SADD', KEYS[1], unpack(ARGV, 3))
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// setContributionLua defines setContribution(board, contrib, username,
+// value), which records a player's contribution from one game to a composite
+// board (contrib is the hash of username -> contribution from the game) and
+// moves their composite score by the difference.
+const setContributionLua = `
+local function setContribution(board, contrib, username, value)
+	local previous = tonumber(redis.call('HGET', contrib, username) or '0')
+	if value == 0 then
+		redis.call('HDEL', contrib, username)
+	else
+		redis.call('HSET', contrib, username, string.format('%.17g', value))
+	end
+	redis.call('ZINCRBY', board, string.format('%.17g', value - previous), username)
+end
+`
+
+// rankPointsLua defines rankPoints(board, depth, weight, ascending, tied),
+// which returns the players on the first depth positions of a game board, in
+// order, and the points each earns there: depth * weight for the first down
+// to weight for the last. tied is true when the board's members carry a
+// tie-breaker prefix ("<hex>#username").
+const rankPointsLua = `
+local function boardName(member, tied)
+	if tied then
+		local sep = string.find(member, '#', 1, true)
+		if sep then
+			return string.sub(member, sep + 1)
+		end
+	end
+	return member
+end
+
+local function rankPoints(board, depth, weight, ascending, tied)
+	local members
+	if ascending then
+		members = redis.call('ZRANGE', board, 0, depth - 1)
+	else
+		members = redis.call('ZREVRANGE', board, 0, depth - 1)
+	end
+	local names, points = {}, {}
+	for i, member in ipairs(members) do
+		local name = boardName(member, tied)
+		names[i] = name
+		points[name] = weight * (depth - i + 1)
+	end
+	return names, points
+end
+`
+
+// SetContributionScript records a player's contribution from one game to a
+// composite board.
+//
+// KEYS[1] composite sorted set, KEYS[2] hash of username -> contribution
+// from the game, KEYS[3] refresh lock, present while the board is being
+// recomputed, KEYS[4..5] the same keys of the recomputed board.
+// ARGV[1] username, ARGV[2] new contribution.
+//
+// While a refresh is running the contribution is mirrored into the
+// recomputed board, so swapping it in does not undo the change.
+var SetContributionScript = redis.NewScript(setContributionLua + `
+local value = tonumber(ARGV[2])
+setContribution(KEYS[1], KEYS[2], ARGV[1], value)
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	setContribution(KEYS[4], KEYS[5], ARGV[1], value)
+end
+return 1
+`)
+
+// SetRankPointsScript recomputes the rank points a game gives on a composite
+// board after the game board changed: the players on its first positions get
+// their points and those who dropped out lose theirs.
+//
+// KEYS[1] game board, KEYS[2..6] as KEYS[1..5] of SetContributionScript.
+// ARGV[1] depth, ARGV[2] game weight, ARGV[3] "1" when lower scores rank
+// higher, ARGV[4] "1" when the game board uses tie-breakers.
+var SetRankPointsScript = redis.NewScript(setContributionLua + rankPointsLua + `
+local names, points = rankPoints(KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), ARGV[3] == '1', ARGV[4] == '1')
+
+local function update(board, contrib)
+	for _, name in ipairs(redis.call('HKEYS', contrib)) do
+		if not points[name] then
+			setContribution(board, contrib, name, 0)
+		end
+	end
+	for _, name in ipairs(names) do
+		setContribution(board, contrib, name, points[name])
+	end
+end
+
+update(KEYS[2], KEYS[3])
+if redis.call('EXISTS', KEYS[4]) == 1 then
+	update(KEYS[5], KEYS[6])
+end
+return #names
+`)
+
+// RefreshContributionsScript computes a game's contributions to a composite
+// board being recomputed from the game board as it is now. Contributions
+// mirrored into it earlier are replaced and later ones apply on top.
+//
+// KEYS[1] game board, KEYS[2] recomputed composite sorted set, KEYS[3] its
+// hash of contributions from the game, KEYS[4] its z-score statistics.
+// ARGV[1] method (weighted, rank_points or zscore), ARGV[2] game weight,
+// ARGV[3] "1" when lower scores rank higher, ARGV[4] "1" when the game
+// board uses tie-breakers, ARGV[5] rank points depth, ARGV[6] game ID.
+//
+// The statistics are the mean and population standard deviation of the game
+// board's scores. Returns the number of players on the game board.
+var RefreshContributionsScript = redis.NewScript(setContributionLua + rankPointsLua + `
+local method = ARGV[1]
+local weight = tonumber(ARGV[2])
+local ascending = ARGV[3] == '1'
+local tied = ARGV[4] == '1'
+local sign = 1
+if ascending then
+	sign = -1
+end
+
+local scores = redis.call('ZRANGE', KEYS[1], 0, -1, 'WITHSCORES')
+local n = #scores / 2
+local sum, squares = 0, 0
+for i = 2, #scores, 2 do
+	local v = tonumber(scores[i])
+	sum = sum + v
+	squares = squares + v * v
+end
+local mean, std = 0, 0
+if n > 0 then
+	mean = sum / n
+	std = math.sqrt(math.max(0, squares / n - mean * mean))
+end
+redis.call('HSET', KEYS[4], ARGV[6] .. ':mean', string.format('%.17g', mean),
+	ARGV[6] .. ':std', string.format('%.17g', std))
+
+local points = {}
+if method == 'rank_points' then
+	local _
+	_, points = rankPoints(KEYS[1], tonumber(ARGV[5]), weight, ascending, tied)
+end
+
+local seen = {}
+for i = 1, #scores, 2 do
+	local name = boardName(scores[i], tied)
+	local v = tonumber(scores[i + 1])
+	local value
+	if method == 'rank_points' then
+		value = points[name] or 0
+	elseif method == 'zscore' then
+		value = 0
+		if std ~= 0 then
+			value = sign * weight * (v - mean) / std
+		end
+	else
+		value = sign * weight * v
+	end
+	seen[name] = true
+	setContribution(KEYS[2], KEYS[3], name, value)
+end
+for _, name in ipairs(redis.call('HKEYS', KEYS[3])) do
+	if not seen[name] then
+		setContribution(KEYS[2], KEYS[3], name, 0)
+	end
+end
+return n
+`)
+
+// SwapRefreshedKeysScript replaces keys with their recomputed copies and
+// ends the refresh, provided the caller still holds the refresh lock. A copy
+// that does not exist deletes the key it replaces.
+//
+// KEYS[1..n] keys, KEYS[n+1..2n] their copies, KEYS[2n+1] refresh lock.
+// ARGV[1] lock token.
+//
+// Returns 1 on success and 0 when the lock was lost.
+var SwapRefreshedKeysScript = redis.NewScript(`
+local lock = KEYS[#KEYS]
+if redis.call('GET', lock) ~= ARGV[1] then
+	return 0
+end
+local n = (#KEYS - 1) / 2
+for i = 1, n do
+	if redis.call('EXISTS', KEYS[n + i]) == 1 then
+		redis.call('RENAME', KEYS[n + i], KEYS[i])
+	else
+		redis.call('DEL', KEYS[i])
+	end
+end
+redis.call('DEL', lock)
+return 1
+`)
+
+// setRatingLua defines setRating(k, a), which puts a player's rating on the
+// board of a rated game. k holds the seven board keys described for apply;
+// only the board, personal bests, submission counts (here the number of
+// rated matches) and distinct scores are used.
+//
+// a[1] username, a[2] rating, a[3] matches the player has been rated in
+//
+// The match count orders the writes: a rating computed from fewer matches
+// than the board already reflects is stale and is skipped. setRating returns
+// 1 when the board changed and 0 otherwise.
+const setRatingLua = `
+local function setRating(k, a)
+	local username = a[1]
+	local rating = tonumber(a[2])
+	local matches = tonumber(a[3])
+
+	if tonumber(redis.call('HGET', k[5], username) or '0') >= matches then
+		return 0
+	end
+
+	if redis.call('EXISTS', k[6]) == 0 then
+		local scores = redis.call('ZRANGE', k[1], 0, -1, 'WITHSCORES')
+		for i = 2, #scores, 2 do
+			local v = tonumber(scores[i])
+			redis.call('ZADD', k[6], v, string.format('%.17g', v))
+		end
+	end
+
+	local previous = redis.call('ZSCORE', k[1], username)
+	redis.call('ZADD', k[1], rating, username)
+	redis.call('HSET', k[5], username, matches)
+	if previous and tonumber(previous) ~= rating then
+		if redis.call('ZCOUNT', k[1], previous, previous) == 0 then
+			redis.call('ZREM', k[6], string.format('%.17g', tonumber(previous)))
+		end
+	end
+	redis.call('ZADD', k[6], rating, string.format('%.17g', rating))
+
+	local best = redis.call('HGET', k[2], username)
+	if not best or rating > tonumber(best) then
+		redis.call('HSET', k[2], username, a[2])
+	end
+	return 1
+end
+`
+
+// SetRatingScript puts a rating from a recorded match on a rated game's
+// board, mirroring it into the rebuilt board while a rebuild runs.
+//
+// KEYS[1..7] board keys, KEYS[8] rebuild lock, KEYS[9..15] keys of the board
+// being rebuilt. ARGV[1..3] as for setRating.
+var SetRatingScript = redis.NewScript(setRatingLua + `
+local result = setRating({KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7]}, ARGV)
+
+if redis.call('EXISTS', KEYS[8]) == 1 then
+	setRating({KEYS[9], KEYS[10], KEYS[11], KEYS[12], KEYS[13], KEYS[14], KEYS[15]}, ARGV)
+end
+
+return result
+`)
+
+// RebuildRatingScript replays one stored rating into a board being rebuilt.
+// Ratings a recorded match already mirrored are kept when newer.
+//
+// KEYS[1..7] keys of the board being rebuilt, ARGV[1..3] as for setRating.
+var RebuildRatingScript = redis.NewScript(setRatingLua + `
+return setRating(KEYS, ARGV)
+`)
+
+// teamScoreLua defines teamScore(board, teams, teamID, method, n, ascending),
+// which rescores a team from its members' contributions to a game (the
+// sorted set board) and stores the result on the game's team board (teams).
+// method "sum" adds up every contribution and "best_n" averages the best n.
+// A team with no contributions is removed from the team board. Returns 1
+// when the team is on the board.
+const teamScoreLua = `
+local function teamScore(board, teams, teamID, method, n, ascending)
+	local entries
+	if method == 'best_n' and ascending then
+		entries = redis.call('ZRANGE', board, 0, n - 1, 'WITHSCORES')
+	elseif method == 'best_n' then
+		entries = redis.call('ZREVRANGE', board, 0, n - 1, 'WITHSCORES')
+	else
+		entries = redis.call('ZRANGE', board, 0, -1, 'WITHSCORES')
+	end
+	if #entries == 0 then
+		redis.call('ZREM', teams, teamID)
+		return 0
+	end
+
+	local total = 0
+	for i = 2, #entries, 2 do
+		total = total + tonumber(entries[i])
+	end
+	if method == 'best_n' then
+		total = total / (#entries / 2)
+	end
+	redis.call('ZADD', teams, total, teamID)
+	return 1
+end
+`
+
+// TeamScoreScript applies a member's submission to their team's
+// contributions to a game and rescores the team, provided they are still a
+// member who joined at the given time. The contributions board is kept
+// under the game's policies like any other board.
+//
+// KEYS[1..7] contributions board keys, KEYS[8] rebuild lock, KEYS[9..15]
+// keys of the contributions board being rebuilt, KEYS[16] hash of the
+// team's members -> join time in unix milliseconds, KEYS[17] team board.
+//
+// ARGV[1..9] as for apply, ARGV[10] join time in unix milliseconds,
+// ARGV[11] team ID, ARGV[12] team score method, ARGV[13] best n.
+//
+// Returns 1 when applied and 0 when the player is no longer that member.
+var TeamScoreScript = redis.NewScript(applyScoreLua + teamScoreLua + `
+if redis.call('HGET', KEYS[16], ARGV[1]) ~= ARGV[10] then
+	return 0
+end
+
+apply({KEYS[1], KEYS[2], KEYS[3], KEYS[4], KEYS[5], KEYS[6], KEYS[7]}, ARGV)
+if redis.call('EXISTS', KEYS[8]) == 1 then
+	apply({KEYS[9], KEYS[10], KEYS[11], KEYS[12], KEYS[13], KEYS[14], KEYS[15]}, ARGV)
+end
+
+teamScore(KEYS[1], KEYS[17], ARGV[11], ARGV[12], tonumber(ARGV[13]), ARGV[5] == '1')
+return 1
+`)
+
+// RescoreTeamScript rescores a team from its contributions board (KEYS[1])
+// onto the team board (KEYS[2]). ARGV[1] team ID, ARGV[2] method, ARGV[3]
+// best n, ARGV[4] "1" when lower scores rank higher.
+var RescoreTeamScript = redis.NewScript(teamScoreLua + `
+return teamScore(KEYS[1], KEYS[2], ARGV[1], ARGV[2], tonumber(ARGV[3]), ARGV[4] == '1')
+`)
+
+// RemoveTeamContributionScript drops a departing member's contribution to a
+// game and rescores the team.
+//
+// KEYS[1..7] contributions board keys, KEYS[8] team board. ARGV[1] username,
+// ARGV[2..5] as ARGV[1..4] of RescoreTeamScript.
+var RemoveTeamContributionScript = redis.NewScript(teamScoreLua + `
+local username = ARGV[1]
+local member = redis.call('HGET', KEYS[4], username) or username
+local seen = redis.call('ZSCORE', KEYS[1], member)
+if seen then
+	redis.call('ZREM', KEYS[1], member)
+	if redis.call('ZCOUNT', KEYS[1], seen, seen) == 0 then
+		redis.call('ZREM', KEYS[6], string.format('%.17g', tonumber(seen)))
+	end
+end
+redis.call('HDEL', KEYS[2], username)
+redis.call('HDEL', KEYS[3], username)
+redis.call('HDEL', KEYS[4], username)
+redis.call('HDEL', KEYS[5], username)
+return teamScore(KEYS[1], KEYS[8], ARGV[2], ARGV[3], tonumber(ARGV[4]), ARGV[5] == '1')
+`)
+
+// SyncRegionalEntryScript copies a player's entry on a game board into the
+// regional boards they belong to and removes it from the ones they left, so
+// a regional board is always the game board restricted to its players.
+//
+// KEYS[1] game board, KEYS[2] its members hash, then three keys per regional
+// board (sorted set, members hash, distinct score set): first the ARGV[2]
+// boards the player belongs to, then the boards to remove them from.
+// ARGV[1] username.
+//
+// Returns 1 when the player is on the game board.
+var SyncRegionalEntryScript = redis.NewScript(`
+local username = ARGV[1]
+local member = redis.call('HGET', KEYS[2], username) or username
+local score = redis.call('ZSCORE', KEYS[1], member)
+local puts = tonumber(ARGV[2])
+
+for i = 3, #KEYS, 3 do
+	local board, members, distinct = KEYS[i], KEYS[i + 1], KEYS[i + 2]
+	if redis.call('EXISTS', distinct) == 0 then
+		local scores = redis.call('ZRANGE', board, 0, -1, 'WITHSCORES')
+		for j = 2, #scores, 2 do
+			local v = tonumber(scores[j])
+			redis.call('ZADD', distinct, v, string.format('%.17g', v))
+		end
+	end
+
+	local current = redis.call('HGET', members, username) or username
+	local seen = redis.call('ZSCORE', board, current)
+	if seen then
+		redis.call('ZREM', board, current)
+		if redis.call('ZCOUNT', board, seen, seen) == 0 then
+			redis.call('ZREM', distinct, string.format('%.17g', tonumber(seen)))
+		end
+	end
+	redis.call('HDEL', members, username)
+
+	if score and (i - 3) / 3 < puts then
+		redis.call('ZADD', board, score, member)
+		if member ~= username then
+			redis.call('HSET', members, username, member)
+		end
+		redis.call('ZADD', distinct, score, string.format('%.17g', tonumber(score)))
+	end
+end
+
+if score then
+	return 1
+end
+return 0
+`)